@@ -0,0 +1,297 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/hamba/avro/ocf"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The codec name avro uses for zstd compression, the ocf encoder doesnt
+// support it so blocks are written uncompressed and then recompressed
+const zstandard = "zstandard"
+
+var (
+	ocfMagic      = []byte("Obj\x01")
+	errCorruptOCF = errors.New("avro container file is corrupt")
+)
+
+// Returns the ocf encoder options for the compression
+func encoderOptions(compression data.JTBCompression) ([]ocf.EncoderFunc, error) {
+	opts := []ocf.EncoderFunc{ocf.WithBlockLength(compression.BlockLength)}
+	switch compression.Codec {
+	case "null", zstandard:
+		opts = append(opts, ocf.WithCodec(ocf.Null))
+	case "deflate":
+		// WithCompressionLevel ALSO SETS THE CODEC TO DEFLATE
+		level := compression.Level
+		if level == 0 {
+			level = -1
+		}
+		opts = append(opts, ocf.WithCompressionLevel(level))
+	case "snappy":
+		opts = append(opts, ocf.WithCodec(ocf.Snappy))
+	default:
+		return nil, fmt.Errorf("unknown avro codec: %v", compression.Codec)
+	}
+	return opts, nil
+}
+
+// Compresses every block of an uncompressed avro container file with zstd
+func zstdCompress(avroBytes []byte, level int) ([]byte, error) {
+	encoderLevel := zstd.SpeedDefault
+	if level > 0 {
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return transcode(avroBytes, zstandard, func(block []byte) ([]byte, error) {
+		return enc.EncodeAll(block, nil), nil
+	})
+}
+
+// Decompresses every block of a zstd avro container file so the ocf decoder
+// can read it
+func zstdDecompress(avroBytes []byte) ([]byte, error) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return transcode(avroBytes, "null", func(block []byte) ([]byte, error) {
+		return dec.DecodeAll(block, nil)
+	})
+}
+
+// Returns the codec an avro container file was written with
+func fileCodec(avroBytes []byte) (string, error) {
+	if len(avroBytes) == 0 {
+		return "null", nil
+	}
+	r := &ocfReader{b: avroBytes}
+	meta, err := r.header()
+	if err != nil {
+		return "", err
+	}
+	if codec, ok := meta["avro.codec"]; ok {
+		return string(codec), nil
+	}
+	return "null", nil
+}
+
+// Rewrites an avro container file with the avro.codec metadata set to codec,
+// and fn applied to the data of every block
+func transcode(avroBytes []byte, codec string, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	// THE OCF ENCODER WRITES NOTHING, NOT EVEN THE HEADER, WHEN THERE ARE NO
+	// RECORDS, SO THERE IS NOTHING TO REWRITE
+	if len(avroBytes) == 0 {
+		return avroBytes, nil
+	}
+	r := &ocfReader{b: avroBytes}
+	meta, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+	sync, err := r.fixed(16)
+	if err != nil {
+		return nil, err
+	}
+	meta["avro.codec"] = []byte(codec)
+
+	// WRITE THE HEADER BACK WITH THE SAME SYNC MARKER
+	out := append([]byte{}, ocfMagic...)
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out = appendLong(out, int64(len(keys)))
+	for _, k := range keys {
+		out = appendBytes(out, []byte(k))
+		out = appendBytes(out, meta[k])
+	}
+	out = appendLong(out, 0)
+	out = append(out, sync...)
+
+	for r.pos < len(r.b) {
+		count, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		block, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		blockSync, err := r.fixed(16)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(blockSync, sync) {
+			return nil, errCorruptOCF
+		}
+		if block, err = fn(block); err != nil {
+			return nil, err
+		}
+		out = appendLong(out, count)
+		out = appendBytes(out, block)
+		out = append(out, sync...)
+	}
+	return out, nil
+}
+
+// Reads the parts of an avro container file
+type ocfReader struct {
+	b   []byte
+	pos int
+}
+
+// Reads the magic bytes and the metadata map
+func (r *ocfReader) header() (map[string][]byte, error) {
+	magic, err := r.fixed(len(ocfMagic))
+	if err != nil || !bytes.Equal(magic, ocfMagic) {
+		return nil, errCorruptOCF
+	}
+	meta := make(map[string][]byte)
+	for {
+		count, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return meta, nil
+		}
+		// A NEGATIVE COUNT IS FOLLOWED BY THE SIZE OF THE BLOCK IN BYTES
+		if count < 0 {
+			count = -count
+			if _, err = r.long(); err != nil {
+				return nil, err
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			k, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			meta[string(k)] = v
+		}
+	}
+}
+
+func (r *ocfReader) long() (int64, error) {
+	v, n := binary.Varint(r.b[r.pos:])
+	if n <= 0 {
+		return 0, errCorruptOCF
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *ocfReader) bytes() ([]byte, error) {
+	n, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errCorruptOCF
+	}
+	return r.fixed(int(n))
+}
+
+func (r *ocfReader) fixed(n int) ([]byte, error) {
+	if r.pos+n > len(r.b) {
+		return nil, errCorruptOCF
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// Avro longs are zig zag varints, the same as binary.PutVarint
+func appendLong(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	return append(appendLong(b, int64(len(v))), v...)
+}
+
+// Returns the number of bytes a long takes up once encoded
+func longSize(v int64) int64 {
+	var buf [binary.MaxVarintLen64]byte
+	return int64(binary.PutVarint(buf[:], v))
+}
+
+// EncodedSize Returns the size of the records once avro encoded with the
+// schema before any compression, used to report the compression ratio
+func (s *Schema) EncodedSize(records []map[string]interface{}) int64 {
+	var size int64
+	for _, record := range records {
+		for _, field := range s.Fields {
+			value := record[field.Name]
+			for i, fieldType := range field.FieldType {
+				if (value == nil) != (fieldType == "null") {
+					continue
+				}
+				// THE INDEX OF THE UNION BRANCH IS WRITTEN BEFORE THE VALUE
+				size += longSize(int64(i)) + field.valueSize(value)
+				break
+			}
+		}
+	}
+	return size
+}
+
+// Returns the encoded size of a value of the fields type
+func (f Field) valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case time.Time:
+		if f.LogicalType == Date {
+			return longSize(v.Unix() / 86400)
+		}
+		return longSize(v.UnixNano() / 1000)
+	case time.Duration:
+		return longSize(v.Microseconds())
+	case *big.Rat:
+		// DECIMALS ARE THE TWOS COMPLEMENT BYTES OF THE UNSCALED VALUE
+		n := int64(new(big.Int).Div(new(big.Int).Mul(v.Num(), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(f.Scale)), nil)), v.Denom()).BitLen()/8 + 1)
+		return longSize(n) + n
+	case string:
+		return longSize(int64(len(v))) + int64(len(v))
+	case []byte:
+		return longSize(int64(len(v))) + int64(len(v))
+	case bool:
+		return 1
+	case int:
+		return longSize(int64(v))
+	case int32:
+		return longSize(int64(v))
+	case int64:
+		return longSize(v)
+	case float32:
+		return 4
+	case float64:
+		if f.NonNullType() == "float" {
+			return 4
+		}
+		return 8
+	}
+	return 0
+}
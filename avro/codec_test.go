@@ -0,0 +1,217 @@
+package avro
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/hamba/avro/ocf"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Writes the records to an uncompressed container file with blockLength
+// records in each block and extra metadata in the header
+func writeOCF(t *testing.T, records []map[string]interface{}, blockLength int) []byte {
+	t.Helper()
+	sch := testSchema()
+	schemaBytes, err := sch.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc, err := ocf.NewEncoder(string(schemaBytes), &buf, ocf.WithBlockLength(blockLength), ocf.WithMetadata(map[string][]byte{"jtb.test": []byte("kept")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testSchema() *Schema {
+	sch := NewSchema("events.avro", "events.avsc")
+	sch.Fields = []Field{
+		{Name: "id", FieldType: []string{"long", "null"}},
+		{Name: "name", FieldType: []string{"string", "null"}},
+	}
+	return sch
+}
+
+func testRecords(n int) []map[string]interface{} {
+	records := make([]map[string]interface{}, n)
+	for i := range records {
+		records[i] = map[string]interface{}{"id": int64(i), "name": "record"}
+	}
+	return records
+}
+
+// Decodes a container file with the hamba/avro reader, checking the header
+// metadata is still there
+func decodeOCF(t *testing.T, avroBytes []byte) []map[string]interface{} {
+	t.Helper()
+	dec, err := ocf.NewDecoder(bytes.NewReader(avroBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := dec.Metadata()
+	if string(meta["jtb.test"]) != "kept" || len(meta["avro.schema"]) == 0 {
+		t.Errorf("expected the header metadata to be kept, got %v", meta)
+	}
+	var records []map[string]interface{}
+	for dec.HasNext() {
+		record := make(map[string]interface{})
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err := dec.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// Returns the data of every block in a container file
+func fileBlocks(t *testing.T, avroBytes []byte) [][]byte {
+	t.Helper()
+	r := &ocfReader{b: avroBytes}
+	if _, err := r.header(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.fixed(16); err != nil {
+		t.Fatal(err)
+	}
+	var blocks [][]byte
+	for r.pos < len(r.b) {
+		if _, err := r.long(); err != nil {
+			t.Fatal(err)
+		}
+		block, err := r.bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.fixed(16); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestTranscodeKeepsBlocksAndMetadata(t *testing.T) {
+	original := writeOCF(t, testRecords(25), 10)
+	if blocks := fileBlocks(t, original); len(blocks) != 3 {
+		t.Fatalf("expected the test file to have 3 blocks, got %v", len(blocks))
+	}
+
+	// A FILE REWRITTEN WITHOUT CHANGING THE BLOCKS IS STILL READABLE
+	copied, err := transcode(original, "null", func(block []byte) ([]byte, error) { return block, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := decodeOCF(t, copied); len(records) != 25 || records[24]["id"] != int64(24) {
+		t.Errorf("expected every record to be read back, got %v", records)
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	original := writeOCF(t, testRecords(25), 10)
+	compressed, err := zstdCompress(original, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec, err := fileCodec(compressed); err != nil || codec != zstandard {
+		t.Fatalf("expected the codec to be %v, got %v, %v", zstandard, codec, err)
+	}
+
+	// EVERY BLOCK IS A ZSTD FRAME ON ITS OWN, AS OTHER AVRO READERS EXPECT
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	originalBlocks, compressedBlocks := fileBlocks(t, original), fileBlocks(t, compressed)
+	if len(compressedBlocks) != len(originalBlocks) {
+		t.Fatalf("expected %v blocks, got %v", len(originalBlocks), len(compressedBlocks))
+	}
+	for i, block := range compressedBlocks {
+		decompressed, err := dec.DecodeAll(block, nil)
+		if err != nil || !bytes.Equal(decompressed, originalBlocks[i]) {
+			t.Errorf("expected block %v to decompress to the original, got %v", i, err)
+		}
+	}
+
+	decompressed, err := zstdDecompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec, _ := fileCodec(decompressed); codec != "null" {
+		t.Errorf("expected the codec to be set back to null, got %v", codec)
+	}
+	records := decodeOCF(t, decompressed)
+	if len(records) != 25 {
+		t.Fatalf("expected 25 records, got %v", len(records))
+	}
+	for i, record := range records {
+		if record["id"] != int64(i) || record["name"] != "record" {
+			t.Errorf("unexpected record %v: %v", i, record)
+		}
+	}
+}
+
+func TestZstdRoundTripEmptyFile(t *testing.T) {
+	// A CONTAINER FILE WITH A HEADER AND NO BLOCKS, CUT FROM ONE WITH A RECORD
+	// AS THE ENCODER WRITES NOTHING WITHOUT ANY
+	withRecord := writeOCF(t, testRecords(1), 10)
+	r := &ocfReader{b: withRecord}
+	if _, err := r.header(); err != nil {
+		t.Fatal(err)
+	}
+	original := withRecord[:r.pos+16]
+
+	compressed, err := zstdCompress(original, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := fileBlocks(t, compressed); len(blocks) != 0 {
+		t.Errorf("expected no blocks, got %v", len(blocks))
+	}
+	decompressed, err := zstdDecompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := decodeOCF(t, decompressed); len(records) != 0 {
+		t.Errorf("expected no records, got %v", records)
+	}
+}
+
+func TestReadRecordsWithZstd(t *testing.T) {
+	avroBytes, err := testSchema().WriteRecords(testRecords(5), data.JTBCompression{Codec: zstandard, BlockLength: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadRecords(avroBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || records[4]["id"] != int64(4) {
+		t.Errorf("expected the records written with zstd to be read back, got %v", records)
+	}
+}
+
+func TestWriteAndReadNoRecordsWithZstd(t *testing.T) {
+	avroBytes, err := testSchema().WriteRecords(nil, data.JTBCompression{Codec: zstandard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := ReadRecords(avroBytes)
+	if err != nil || len(records) != 0 {
+		t.Errorf("expected no records, got %v, %v", records, err)
+	}
+}
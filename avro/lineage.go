@@ -0,0 +1,64 @@
+package avro
+
+import (
+	"strings"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Returns the lineage fields added to every row, or nothing if the lineage
+// columns are turned off
+func lineageFields() []Field {
+	if !data.LineageColumns {
+		return nil
+	}
+	return []Field{
+		newLogicalField(SanitizeName(data.LineageIngestedAtColumn), "long", TimestampMicros),
+		*NewField(SanitizeName(data.LineageRequestIDColumn), "string"),
+		*NewField(SanitizeName(data.LineageSourceColumn), "string"),
+		*NewField(SanitizeName(data.LineageRecordIndexColumn), "long"),
+		*NewField(SanitizeName(data.LineageSchemaVersionColumn), "long"),
+	}
+}
+
+// Returns true if the field is one of the lineage fields, ignoring case
+func isLineageField(name string) bool {
+	for _, field := range lineageFields() {
+		if strings.EqualFold(name, field.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddLineageFields Adds the lineage fields to the schema, returns the names
+// of the fields that were not already in it
+func (s *Schema) AddLineageFields() []string {
+	var added []string
+	for _, field := range lineageFields() {
+		if !s.hasField(field.Name) {
+			added = append(added, field.Name)
+		}
+		s.addField(field)
+	}
+	return added
+}
+
+// Writes the lineage values to the records, the indexes are in the same
+// order as the records
+func (s Schema) setLineage(records []map[string]interface{}, indexes []interface{}, request *data.JTBRequest, ingestedAt time.Time) {
+	fields := lineageFields()
+	if len(fields) == 0 {
+		return
+	}
+	for i, record := range records {
+		record[fields[0].Name] = ingestedAt
+		record[fields[1].Name] = request.RequestID
+		record[fields[2].Name] = request.Caller
+		if indexes[i] != nil {
+			record[fields[3].Name] = indexes[i]
+		}
+		record[fields[4].Name] = int64(s.Version)
+	}
+}
@@ -0,0 +1,152 @@
+package avro
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxNameLength The longest column name BigQuery allows
+const MaxNameLength = 300
+
+// Column name prefixes BigQuery reserves for itself, they are checked without
+// case
+var reservedPrefixes = []string{"_TABLE_", "_FILE_", "_PARTITION", "_ROW_TIMESTAMP", "__ROOT__", "_COLIDENTIFIER"}
+
+// SanitizeName Returns a name that is valid in both avro and BigQuery for a
+// flattened JSON key. Accents are removed from letters, anything other than a
+// letter, digit or underscore becomes an underscore, and names that start with
+// a digit or a reserved prefix get a prefix of their own
+func SanitizeName(raw string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(raw) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// DROP THE ACCENTS LEFT OVER FROM THE DECOMPOSED LETTERS
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'):
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	name := b.String()
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	upper := strings.ToUpper(name)
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			name = "f" + name
+			break
+		}
+	}
+	if len(name) > MaxNameLength {
+		name = name[:MaxNameLength]
+	}
+	return name
+}
+
+// Returns true if the name is already a valid column name
+func isValidName(name string) bool {
+	return SanitizeName(name) == name
+}
+
+// Returns true if the field is written by the service rather than taken from
+// the records, the check ignores case like BigQuery does
+func (s Schema) isSystemField(name string) bool {
+	return strings.EqualFold(name, OverflowField) || (s.RawField != "" && strings.EqualFold(name, s.RawField)) || isLineageField(name)
+}
+
+// Maps the flattened keys in the records to column names, the keys are
+// renamed in place. Keys that are already valid and dont collide keep their
+// name, everything else is sanitized, and a name that collides with another
+// column, ignoring case, gets the lowest free _2, _3... suffix. Renamed keys
+// are saved in the schema so a key always maps to the same column, the
+// columns of all the keys in the records are returned
+func (s *Schema) renameFields(records []map[string]interface{}) map[string]string {
+	if s.FieldNames == nil {
+		s.FieldNames = make(map[string]string)
+	}
+	// EVERY COLUMN NAME THAT IS ALREADY OWNED BY A FIELD, A RENAMED KEY OR THE
+	// SERVICE ITSELF
+	taken := map[string]bool{strings.ToLower(OverflowField): true, strings.ToLower(s.RawField): s.RawField != ""}
+	for _, field := range lineageFields() {
+		taken[strings.ToLower(field.Name)] = true
+	}
+	renamedTo := make(map[string]bool)
+	for _, column := range s.FieldNames {
+		taken[strings.ToLower(column)] = true
+		renamedTo[strings.ToLower(column)] = true
+	}
+	fieldNames := make(map[string]bool)
+	for _, field := range s.Fields {
+		taken[strings.ToLower(field.Name)] = true
+		fieldNames[field.Name] = true
+	}
+
+	// SORT THE KEYS SO COLLISIONS IN THE SAME REQUEST ARE RESOLVED THE SAME WAY
+	// EVERY TIME, KEYS THAT ARE ALREADY VALID GO FIRST SO THEY KEEP THEIR NAMES
+	var keys []string
+	seen := make(map[string]bool)
+	for _, record := range records {
+		for recordKey := range record {
+			if !seen[recordKey] {
+				seen[recordKey] = true
+				keys = append(keys, recordKey)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if isValidName(keys[i]) != isValidName(keys[j]) {
+			return isValidName(keys[i])
+		}
+		return keys[i] < keys[j]
+	})
+
+	columns := make(map[string]string)
+	for _, key := range keys {
+		if column, ok := s.FieldNames[key]; ok {
+			columns[key] = column
+			continue
+		}
+		// A VALID KEY OWNS THE FIELD OF THE SAME NAME UNLESS A RENAMED KEY OR THE
+		// SERVICE HAS IT
+		if isValidName(key) && fieldNames[key] && !renamedTo[strings.ToLower(key)] && !s.isSystemField(key) {
+			columns[key] = key
+			continue
+		}
+		column := SanitizeName(key)
+		for n := 2; taken[strings.ToLower(column)]; n++ {
+			suffix := fmt.Sprintf("_%v", n)
+			base := SanitizeName(key)
+			if len(base)+len(suffix) > MaxNameLength {
+				base = base[:MaxNameLength-len(suffix)]
+			}
+			column = base + suffix
+		}
+		taken[strings.ToLower(column)] = true
+		columns[key] = column
+		if column != key {
+			s.FieldNames[key] = column
+		}
+	}
+
+	// MOVE ALL THE VALUES OUT BEFORE ANY ARE PUT BACK, A KEY CAN BE RENAMED TO
+	// THE NAME OF ANOTHER KEY THAT IS ALSO BEING RENAMED
+	for _, record := range records {
+		renamed := make(map[string]interface{})
+		for _, key := range keys {
+			if value, ok := record[key]; ok && columns[key] != key {
+				renamed[columns[key]] = value
+				delete(record, key)
+			}
+		}
+		for column, value := range renamed {
+			record[column] = value
+		}
+	}
+	return columns
+}
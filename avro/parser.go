@@ -3,27 +3,36 @@ package avro
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pool"
 )
 
-// ParseRequest Parses the request object, maps schema, returns formatted
-// records, a slice of all the timestamp fields and listMappings
-func ParseRequest(request *data.JTBRequest) (Schema, []map[string]interface{}, []map[string]interface{}, []string, error) {
+// The keys the index and raw JSON of a record in the request data are kept
+// under while the record is parsed, decoded JSON keys are always valid UTF-8
+// so they cant clash with one
+const (
+	recordIndexKey = "\xffrecordIndex"
+	rawRecordKey   = "\xffraw"
+)
+
+// ParseRequest Parses the request object, maps schema on top of the existing
+// avsc data if there is any, returns formatted records, listMappings and how
+// the schema policy changed the schema. The schema version is bumped whenever
+// its fields change, and the lineage columns are added to the records and
+// listMappings if they are turned on
+func ParseRequest(request *data.JTBRequest, avscData []byte) (Schema, []map[string]interface{}, []map[string]interface{}, *data.SchemaChanges, error) {
 	// GENERATE VARS
 	var (
-		parseWg      sync.WaitGroup
 		formWg       sync.WaitGroup
 		listWg       sync.WaitGroup
 		ParsedRecs   []map[string]interface{}
 		ListMappings []map[string]interface{}
 		fChan        = make(chan map[string]interface{})
-		rawChan      = make(chan map[string]interface{})
 		listChan     = make(chan map[string]interface{})
 	)
 
@@ -32,21 +41,14 @@ func ParseRequest(request *data.JTBRequest) (Schema, []map[string]interface{}, [
 	avroNameSpace := fmt.Sprintf("%v.avsc", avroName)
 	schema := NewSchema(avroName, avroNameSpace)
 
-	// TRY TO LOAD AVSC FILE
-	avscData, err := ioutil.ReadFile(fmt.Sprintf("%v/%v.avsc", request.DatasetName, request.TableName))
-	if err != nil {
-		if _, ok := err.(*os.PathError); !ok {
-			log.Printf("ERROR READING AVSC FILE: %v", err.Error())
-			return Schema{}, nil, nil, nil, err
-		}
-	} else {
-		err = json.Unmarshal(avscData, schema)
+	// LOAD THE EXISTING AVSC IF THERE IS ONE
+	if len(avscData) > 0 {
+		err := json.Unmarshal(avscData, schema)
 		if err != nil {
 			log.Printf("ERROR READING AVSC BYTES TO STRUCT: %v", err.Error())
 			return Schema{}, nil, nil, nil, err
-		} else {
-			log.Printf("LOADED SCHEMA FROM GCS: %#v", schema)
 		}
+		log.Printf("LOADED EXISTING SCHEMA: %#v", schema)
 	}
 
 	log.Printf("Starting to parse %v records", len(request.Data))
@@ -67,25 +69,22 @@ func ParseRequest(request *data.JTBRequest) (Schema, []map[string]interface{}, [
 		}
 	}()
 
-	for i := 0; i < 100; i++ {
-		parseWg.Add(1)
-		go func() {
-			defer parseWg.Done()
-			for rec := range rawChan {
-				idField := rec[request.IdField]
-				formattedRec := make(map[string]interface{})
-				ParseRecord(rec, "", formattedRec, fChan, request.TableName, fmt.Sprintf("%v", idField), listChan)
+	// PARSE EACH RECORD ON THE SHARED WORKER POOL, THIS BLOCKS UNTIL THEY ARE ALL DONE
+	pool.Workers.Each(len(request.Data), func(i int) {
+		rec := request.Data[i]
+		idField := rec[request.IdField]
+		formattedRec := make(map[string]interface{})
+		if data.LineageColumns {
+			formattedRec[recordIndexKey] = int64(i)
+		}
+		if request.KeepRaw {
+			if rawJSON, err := json.Marshal(rec); err == nil {
+				formattedRec[rawRecordKey] = string(rawJSON)
 			}
-		}()
-	}
-	// ITERATE OVER RECS AND SEND THEM ON CHAN
-	for _, v := range request.Data {
-		rawChan <- v
-	}
-	// CLOSE CHANNEL OF RAW, WAIT FOR FORMATTING TO FINISH, THEN CLOSE FORMATTING CHANNEL AND WAIT
-	// FOR THAT GO ROUTINE TO COMPLETE ADDING TO LIST
-	close(rawChan)
-	parseWg.Wait()
+		}
+		ParseRecord(rec, "", formattedRec, fChan, request.TableName, fmt.Sprintf("%v", idField), listChan)
+	})
+	// CLOSE THE FORMATTING CHANNELS AND WAIT FOR THOSE GO ROUTINES TO COMPLETE ADDING TO LIST
 	close(listChan)
 	listWg.Wait()
 	close(fChan)
@@ -93,11 +92,43 @@ func ParseRequest(request *data.JTBRequest) (Schema, []map[string]interface{}, [
 
 	// ADD THE SLICE OF FORMATTED RECORDS TO THE SCHEMA STRUCT FOR EASIER METHOD ACCESS LATER
 	log.Println("Finished parsing all records.")
-	timestampFields := schema.GenerateSchemaFields(ParsedRecs, request.TimestampFormat)
+	recordIndexes := takeStashed(ParsedRecs, recordIndexKey)
+	listIndexes := takeStashed(ListMappings, recordIndexKey)
+	rawRecords := takeStashed(ParsedRecs, rawRecordKey)
+	if request.KeepRaw {
+		schema.reserveRawField()
+	}
+	changes, err := schema.GenerateSchemaFields(ParsedRecs, request.TimestampFormat, request.DecimalFields, request.SchemaPolicy, request.TypeChangeStrategy)
+	if err != nil {
+		log.Printf("ERROR GENERATING SCHEMA: %v", err.Error())
+		return Schema{}, nil, nil, nil, err
+	}
+	if request.KeepRaw {
+		changes.AddedFields = append(changes.AddedFields, schema.setRaw(ParsedRecs, rawRecords)...)
+	}
+	changes.AddedFields = append(changes.AddedFields, schema.AddLineageFields()...)
+	if schema.Version == 0 || len(changes.AddedFields) > 0 || len(changes.TypeChanges) > 0 {
+		schema.Version++
+	}
+	ingestedAt := time.Now().UTC()
+	schema.setLineage(ParsedRecs, recordIndexes, request, ingestedAt)
+	schema.setLineage(ListMappings, listIndexes, request, ingestedAt)
 	ParsedRecsWithNulls := schema.AddNulls(ParsedRecs)
 	log.Printf("PARSED RECS WITH NULLS: %v", ParsedRecsWithNulls)
 	log.Printf("FULL SCHEMA: %#v", schema)
-	return *schema, ParsedRecsWithNulls, ListMappings, timestampFields, nil
+	return *schema, ParsedRecsWithNulls, ListMappings, changes, nil
+}
+
+// Removes the values stashed under the key from the records, returning them
+// in the same order. A record that appears twice is the same map so only the
+// first gets the value
+func takeStashed(records []map[string]interface{}, key string) []interface{} {
+	values := make([]interface{}, len(records))
+	for i, record := range records {
+		values[i] = record[key]
+		delete(record, key)
+	}
+	return values
 }
 
 // ParseRecord Recursivly parses a record flattening nested dics and parsing out
@@ -120,7 +151,11 @@ func ParseRecord(rec map[string]interface{}, fullKey string, formattedRec map[st
 		// IF IT IS AN ARRAY THEN PARSE IT INTO THE LIST MAPPINGS SCHEMA
 		case reflect.Array, reflect.Slice:
 			for _, lv := range v.([]interface{}) {
-				ListMapChan <- map[string]interface{}{"tableName": TableName, "idField": IdField, "Key": k, "Value": lv}
+				mapping := map[string]interface{}{"tableName": TableName, "idField": IdField, "Key": k, "Value": lv}
+				if index, ok := formattedRec[recordIndexKey]; ok {
+					mapping[recordIndexKey] = index
+				}
+				ListMapChan <- mapping
 			}
 
 		default:
@@ -0,0 +1,142 @@
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Schema evolution policies, these decide what happens to fields that are not
+// already in the schema of an existing table
+const (
+	// PolicyAdditive Adds new fields to the table, this is the default
+	PolicyAdditive = "additive"
+	// PolicyStrict Rejects the records if any of them have new fields
+	PolicyStrict = "strict"
+	// PolicyIgnoreNew Drops new fields from the records
+	PolicyIgnoreNew = "ignore-new"
+	// PolicyQuarantineNew Moves new fields into the overflow field as JSON
+	PolicyQuarantineNew = "quarantine-new"
+)
+
+// OverflowField The string field that fields quarantined by the
+// quarantine-new policy are written to, as a JSON object
+const OverflowField = "_jtb_overflow"
+
+// PolicyError Returned when the schema policy doesnt allow fields that are
+// not in the table
+type PolicyError struct {
+	Policy string
+	Table  string
+	Fields []string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("the %v schema policy for %v doesn't allow new fields: %v", e.Policy, e.Table, strings.Join(e.Fields, ", "))
+}
+
+// Returns the policy, using additive if it is blank
+func policyOrDefault(policy string) string {
+	if policy == "" {
+		return PolicyAdditive
+	}
+	return policy
+}
+
+// Applies the policy to the records before their types are inferred, fields
+// that are not already in the schema are dropped or quarantined, or the
+// records are rejected. A schema with no fields belongs to a new table so
+// every field is allowed
+func (s *Schema) applyPolicy(records []map[string]interface{}, policy string) (*data.SchemaChanges, error) {
+	changes := &data.SchemaChanges{Policy: policyOrDefault(policy)}
+	known := make(map[string]bool)
+	for _, field := range s.Fields {
+		known[field.Name] = true
+	}
+	if changes.Policy == PolicyAdditive || len(s.Fields) == 0 {
+		return changes, nil
+	}
+
+	// FIND ALL THE FIELDS THAT ARENT IN THE SCHEMA
+	unknown := make(map[string]bool)
+	for _, record := range records {
+		for recordKey := range record {
+			if !known[recordKey] {
+				unknown[recordKey] = true
+			}
+		}
+	}
+	if len(unknown) == 0 {
+		return changes, nil
+	}
+	newFields := make([]string, 0, len(unknown))
+	for name := range unknown {
+		newFields = append(newFields, name)
+	}
+	sort.Strings(newFields)
+
+	switch changes.Policy {
+	case PolicyStrict:
+		return nil, &PolicyError{Policy: changes.Policy, Table: s.Name, Fields: newFields}
+	case PolicyIgnoreNew:
+		for _, record := range records {
+			for name := range unknown {
+				delete(record, name)
+			}
+		}
+		changes.IgnoredFields = newFields
+	case PolicyQuarantineNew:
+		for _, record := range records {
+			overflow := make(map[string]interface{})
+			for name := range unknown {
+				if value, ok := record[name]; ok {
+					overflow[name] = value
+					delete(record, name)
+				}
+			}
+			if len(overflow) == 0 {
+				continue
+			}
+			overflowJSON, err := json.Marshal(overflow)
+			if err != nil {
+				return nil, err
+			}
+			record[OverflowField] = string(overflowJSON)
+		}
+		s.AddField(OverflowField, "string")
+		changes.QuarantinedFields = newFields
+	default:
+		return nil, fmt.Errorf("unknown schema policy: %v", changes.Policy)
+	}
+	return changes, nil
+}
+
+// CheckPolicy Checks the schema can be applied to a table with the columns
+// passed, only the additive policy can add columns to a table that already has
+// some, apart from the overflow column for the quarantine-new policy, the
+// sibling columns made by the type change strategy, the raw column and the
+// lineage columns
+func (s Schema) CheckPolicy(policy, table string, columns []string) error {
+	policy = policyOrDefault(policy)
+	if policy == PolicyAdditive || len(columns) == 0 {
+		return nil
+	}
+	existing := make(map[string]bool)
+	for _, column := range columns {
+		existing[column] = true
+	}
+	var newFields []string
+	for _, field := range s.Fields {
+		if existing[field.Name] || isSibling(field.Name, existing) || (policy == PolicyQuarantineNew && field.Name == OverflowField) || field.Name == s.RawField || isLineageField(field.Name) {
+			continue
+		}
+		newFields = append(newFields, field.Name)
+	}
+	if len(newFields) > 0 {
+		return &PolicyError{Policy: policy, Table: table, Fields: newFields}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package avro
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Picks the field the raw records are kept in the first time a request asks
+// for them, the name is only suffixed if the table already has a field with
+// it, after that the same field is always used
+func (s *Schema) reserveRawField() {
+	if s.RawField != "" {
+		return
+	}
+	taken := make(map[string]bool)
+	for _, field := range s.Fields {
+		taken[strings.ToLower(field.Name)] = true
+	}
+	for _, column := range s.FieldNames {
+		taken[strings.ToLower(column)] = true
+	}
+	base := SanitizeName(data.RawColumn)
+	name := base
+	for n := 2; taken[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%v_%v", base, n)
+	}
+	s.RawField = name
+}
+
+// Adds the raw field to the schema and writes the raw JSON of each record to
+// it, returns the name of the field if it is new. The parquet writer cant
+// write JSON columns so the field is a plain string when staging parquet
+func (s *Schema) setRaw(records []map[string]interface{}, rawRecords []interface{}) []string {
+	field := *NewField(s.RawField, "string")
+	if data.RawColumnType == JSON && data.StagingFormat != "parquet" {
+		field.LogicalType = JSON
+	}
+	var added []string
+	if !s.hasField(field.Name) {
+		added = append(added, field.Name)
+	}
+	s.addField(field)
+	for i, record := range records {
+		if rawRecords[i] != nil {
+			record[s.RawField] = rawRecords[i]
+		}
+	}
+	return added
+}
+
+// Returns true if the schema has a field with the name
+func (s Schema) hasField(name string) bool {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
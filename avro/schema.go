@@ -3,30 +3,28 @@ package avro
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
-	"reflect"
 	"sync"
-	"time"
 
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pool"
 	"github.com/hamba/avro/ocf"
 )
 
-// Field a field object, includes name of field and type of field
-type Field struct {
-	Name      string   `json:"name"`
-	FieldType []string `json:"type"`
-}
-
-// Schema a schema obejct, represents avro schema
+// Schema a schema obejct, represents avro schema. FieldNames maps the JSON
+// keys that had to be renamed to be valid column names to their fields,
+// Version counts the changes to the fields and RawField is the field the raw
+// records are kept in once a request has asked for them
 type Schema struct {
-	Type      string  `json:"type"`
-	Name      string  `json:"name"`
-	Namespace string  `json:"namespace"`
-	Fields    []Field `json:"fields"`
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Namespace  string            `json:"namespace"`
+	Fields     []Field           `json:"fields"`
+	FieldNames map[string]string `json:"fieldNames,omitempty"`
+	Version    int               `json:"version,omitempty"`
+	RawField   string            `json:"rawField,omitempty"`
 }
 
 // NewSchema Returns a blank schema object
@@ -42,25 +40,39 @@ func NewField(name string, fieldType string) *Field {
 
 // AddField Adds a field to the schema, allowing it to be nulled
 func (s *Schema) AddField(FieldName, Type string) {
+	s.addField(*NewField(FieldName, Type))
+}
+
+// Adds the field to the schema, if there is already a field with the same name
+// and a different type it is changed to a string
+func (s *Schema) addField(nf Field) {
 	for i, field := range s.Fields {
-		if field.Name == FieldName {
-			for _, fieldValue := range field.FieldType {
-				if fieldValue == "null" {
-					continue
-				}
-				if fieldValue != Type {
-					s.Fields[i] = *NewField(FieldName, "string")
-					return
-				} else {
-					return
-				}
-			}
+		if field.Name == nf.Name {
+			s.Fields[i] = mergeFields(field, nf)
+			return
 		}
 	}
-
-	nf := NewField(FieldName, Type)
 	log.Printf("New Field Added to %v : %#v", s.Namespace, nf)
-	s.Fields = append(s.Fields, *nf)
+	s.Fields = append(s.Fields, nf)
+}
+
+// Returns the field that can hold the values of both fields
+func mergeFields(field, nf Field) Field {
+	switch {
+	case field.sameType(nf):
+		return field
+	case upgradesField(field, nf):
+		return nf
+	default:
+		return *NewField(nf.Name, "string")
+	}
+}
+
+// Returns true if the new field is a deliberate upgrade of the field rather
+// than a change of type, schemas saved before logical types have timestamps
+// as plain longs which are upgraded to timestamp-micros
+func upgradesField(field, nf Field) bool {
+	return field.NonNullType() == "long" && field.LogicalType == "" && nf.LogicalType == TimestampMicros
 }
 
 // CHECKS IF A FLOAT IS AN INTEGER, THIS IS BECAUSE THE GOLAND
@@ -70,48 +82,87 @@ func isFloatInt(floatValue float64) bool {
 }
 
 // GenerateSchemaFields Iterates over the records and generates schema, this
-// also ensures that schema is up to date if new cols are added to the data
-func (s *Schema) GenerateSchemaFields(FormattedRecords []map[string]interface{}, timestampFormat string) []string {
+// also ensures that schema is up to date if new cols are added to the data.
+// The keys are renamed to valid column names first, then fields that are not
+// in the schema are handled by the schema policy, and fields already in the
+// schema that get values of another type are handled by the type change
+// strategy. Once the types are settled the values are converted to match
+// their fields, so timestamps become time.Time and a field that fell back to
+// string only gets strings
+func (s *Schema) GenerateSchemaFields(FormattedRecords []map[string]interface{}, timestampFormat string, decimalFields []string, policy, typeChange string) (*data.SchemaChanges, error) {
 	log.Printf("GOT TIMESTAMP FORMAT: %v", timestampFormat)
-	timestampFields := make([]string, len(FormattedRecords))
+	existing := make(map[string]Field)
+	for _, field := range s.Fields {
+		existing[field.Name] = field
+	}
+	columns := s.renameFields(FormattedRecords)
+	changes, err := s.applyPolicy(FormattedRecords, policy)
+	if err != nil {
+		return nil, err
+	}
+	typeChange = typeChangeOrDefault(typeChange)
+	isDecimal := make(map[string]bool)
+	for _, name := range decimalFields {
+		if column, ok := columns[name]; ok {
+			name = column
+		}
+		isDecimal[name] = true
+	}
+	reported := make(map[string]bool)
 	for _, record := range FormattedRecords {
+		siblings := make(map[string]string)
 		for recordKey, recordValue := range record {
-			switch reflect.ValueOf(recordValue).Kind() {
-			case reflect.Int64:
-				s.AddField(recordKey, "long")
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
-				s.AddField(recordKey, "int")
-			case reflect.Bool:
-				s.AddField(recordKey, "boolean")
-			case reflect.Float32:
-				s.AddField(recordKey, "float")
-			case reflect.Float64:
-				// CHECK IF FLOAT IS ACTUALLY AN INT BECAUSE JSON UNMARSHALLS ALL NUMBERS AS FLOAT64
-				// IF IT IS, EDIT THE VALUE SO IT IS AN INT AND THEN USE INT SCHEMA
-				isInt := isFloatInt(recordValue.(float64))
-				if !isInt {
-					s.AddField(recordKey, "double")
-				} else {
-					newValue := int(recordValue.(float64))
-					record[recordKey] = newValue
-					s.AddField(recordKey, "int")
+			field, ok := inferField(recordKey, recordValue, timestampFormat, isDecimal[recordKey])
+			if !ok {
+				continue
+			}
+			// A STRING THAT FITS THE DATE, TIME OR UUID FIELD ALREADY IN THE SCHEMA KEEPS ITS TYPE
+			if old, ok := existing[recordKey]; ok && field.LogicalType == "" && field.NonNullType() == "string" {
+				if stringValue, isString := recordValue.(string); isString && old.matchesString(stringValue) {
+					field = old
 				}
-			case reflect.String:
-				// ATTEMPT TO CONVERT STRINGS TO time.Time objects, IF IT FAILS THEN ITS JUST STRING, ELSE MAKE IT A TIMESTAMP
-				newValue, _ := recordValue.(string)
-				timeValue, err := time.Parse(timestampFormat, newValue)
-				if err == nil {
-					// BIGQUERY TAKES UNIX MICROS SO WE GET NANO AND DIVIDE BY 1000
-					record[recordKey] = timeValue.UnixNano() / 1000
-					timestampFields = append(timestampFields, recordKey)
-					s.AddField(recordKey, "long")
-				} else {
-					s.AddField(recordKey, "string")
+			}
+			// THE FIELD IS ALREADY IN THE TABLE AND THIS VALUE WONT FIT IN ITS COLUMN
+			if old, ok := existing[recordKey]; ok && !mergeFields(old, field).sameType(old) && !upgradesField(old, field) {
+				change := data.TypeChange{Field: recordKey, From: old.typeName(), To: field.typeName(), Column: recordKey}
+				switch typeChange {
+				case TypeChangeSibling:
+					change.Column = siblingName(recordKey, field)
+					siblings[recordKey] = change.Column
+					field.Name = change.Column
+				case TypeChangeRewrite:
+					change.To = "string"
+				}
+				if key := change.Field + "|" + change.To; !reported[key] {
+					reported[key] = true
+					changes.TypeChanges = append(changes.TypeChanges, change)
 				}
 			}
+			s.addField(field)
+		}
+		for name, sibling := range siblings {
+			record[sibling] = record[name]
+			delete(record, name)
 		}
 	}
-	return timestampFields
+	if typeChange == TypeChangeReject && len(changes.TypeChanges) > 0 {
+		return nil, &TypeConflictError{Table: s.Name, Conflicts: changes.TypeChanges}
+	}
+
+	fields := make(map[string]Field)
+	for _, field := range s.Fields {
+		fields[field.Name] = field
+		if _, ok := existing[field.Name]; !ok {
+			changes.AddedFields = append(changes.AddedFields, field.Name)
+		}
+	}
+	pool.Workers.Each(len(FormattedRecords), func(i int) {
+		record := FormattedRecords[i]
+		for recordKey, recordValue := range record {
+			record[recordKey] = fields[recordKey].convert(recordValue, timestampFormat)
+		}
+	})
+	return changes, nil
 }
 
 // AddNulls This function will add nulls of the missing values that are in the
@@ -119,46 +170,55 @@ func (s *Schema) GenerateSchemaFields(FormattedRecords []map[string]interface{},
 // schema matching each object
 func (s *Schema) AddNulls(FormattedRecords []map[string]interface{}) []map[string]interface{} {
 	var (
-		rawRecordWaitGroup    sync.WaitGroup
 		mutex                 sync.Mutex
-		resultsChan           = make(chan map[string]interface{}, len(FormattedRecords))
 		FormattedRecordsNulls []map[string]interface{}
 	)
-	for i := 0; i < 100; i++ {
-		rawRecordWaitGroup.Add(1)
-		go func() {
-			defer rawRecordWaitGroup.Done()
-			for record := range resultsChan {
-				for _, field := range s.Fields {
-					exists := false
-					for recordKey := range record {
-						// IF SCHEMA KEY IS IN RECORD THEN BREAK, ELSE KEEP LOOKING IN REC
-						if recordKey == field.Name {
-							exists = true
-							break
-						} else {
-							continue
-						}
-					}
-					if !exists {
-						record[field.Name] = nil
-					}
+	pool.Workers.Each(len(FormattedRecords), func(i int) {
+		record := FormattedRecords[i]
+		for _, field := range s.Fields {
+			exists := false
+			for recordKey := range record {
+				// IF SCHEMA KEY IS IN RECORD THEN BREAK, ELSE KEEP LOOKING IN REC
+				if recordKey == field.Name {
+					exists = true
+					break
+				} else {
+					continue
 				}
-				mutex.Lock()
-				FormattedRecordsNulls = append(FormattedRecordsNulls, record)
-				mutex.Unlock()
 			}
-		}()
-	}
-	for _, v := range FormattedRecords {
-		resultsChan <- v
-	}
-	close(resultsChan)
-	rawRecordWaitGroup.Wait()
+			if !exists {
+				record[field.Name] = nil
+			}
+		}
+		mutex.Lock()
+		FormattedRecordsNulls = append(FormattedRecordsNulls, record)
+		mutex.Unlock()
+	})
 	log.Println("Added all nulls to data.")
 	return FormattedRecordsNulls
 }
 
+// ColumnName Returns the column a JSON key is written to
+func (s Schema) ColumnName(key string) string {
+	if column, ok := s.FieldNames[key]; ok {
+		return column
+	}
+	return key
+}
+
+// ColumnMetadata Returns the metadata for each column, the columns in the
+// metadata can be named by their JSON key or their column name
+func (s Schema) ColumnMetadata(metadata *data.JTBFieldMetadata) map[string]data.JTBColumnMetadata {
+	columns := make(map[string]data.JTBColumnMetadata)
+	if metadata == nil {
+		return columns
+	}
+	for name, column := range metadata.Columns {
+		columns[s.ColumnName(name)] = column
+	}
+	return columns
+}
+
 // ToJSON Returns the schema struct in a JSON byte slice
 func (s *Schema) ToJSON() ([]byte, error) {
 	return json.Marshal(s)
@@ -169,29 +229,27 @@ func (s *Schema) FromJSON(fileReader io.Reader) error {
 	return json.NewDecoder(fileReader).Decode(&s)
 }
 
-// ToFile Dumps the schema to json then writes that to a file
-func (s *Schema) ToFile(dataset string) error {
-	jsonBytes, err := s.ToJSON()
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(fmt.Sprintf("%v/%v", dataset, s.Namespace), jsonBytes, 0644)
-	if err != nil {
-		return err
-	}
-	return nil
+// WriteRecords This function writes the records passed to the an avro file
+// using the schema, compressed with the codec, level and block length passed.
+func (s *Schema) WriteRecords(records []map[string]interface{}, compression data.JTBCompression) (avroBytes []byte, err error) {
+	// ENCODE ON THE SHARED WORKER POOL SO CONCURRENT REQUESTS ARE BOUNDED
+	pool.Workers.Do(func() {
+		avroBytes, err = s.writeRecords(records, compression)
+	})
+	return avroBytes, err
 }
 
-// WriteRecords This function writes the records passed to the an avro file
-// using the schema.
-func (s *Schema) WriteRecords(records []map[string]interface{}) ([]byte, error) {
+func (s *Schema) writeRecords(records []map[string]interface{}, compression data.JTBCompression) ([]byte, error) {
 	bytesBuffer := &bytes.Buffer{}
 	schemaBytes, err := s.ToJSON()
 	if err != nil {
 		return nil, err
 	}
-	ocf.WithCodec(ocf.Snappy)
-	enc, err := ocf.NewEncoder(string(schemaBytes), bytesBuffer)
+	opts, err := encoderOptions(compression)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := ocf.NewEncoder(string(schemaBytes), bytesBuffer, opts...)
 	if err != nil {
 		log.Printf("ERROR CREATING ENCODER: %v", err.Error())
 		return nil, err
@@ -205,5 +263,38 @@ func (s *Schema) WriteRecords(records []map[string]interface{}) ([]byte, error)
 	if err = enc.Flush(); err != nil {
 		return nil, err
 	}
+	if compression.Codec == zstandard {
+		return zstdCompress(bytesBuffer.Bytes(), compression.Level)
+	}
 	return bytesBuffer.Bytes(), nil
 }
+
+// ReadRecords Decodes the records in an avro file written by WriteRecords
+func ReadRecords(avroBytes []byte) ([]map[string]interface{}, error) {
+	// A FILE WRITTEN WITHOUT ANY RECORDS IS EMPTY
+	if len(avroBytes) == 0 {
+		return nil, nil
+	}
+	codec, err := fileCodec(avroBytes)
+	if err != nil {
+		return nil, err
+	}
+	if codec == zstandard {
+		if avroBytes, err = zstdDecompress(avroBytes); err != nil {
+			return nil, err
+		}
+	}
+	dec, err := ocf.NewDecoder(bytes.NewReader(avroBytes))
+	if err != nil {
+		return nil, err
+	}
+	var records []map[string]interface{}
+	for dec.HasNext() {
+		record := make(map[string]interface{})
+		if err = dec.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, dec.Error()
+}
@@ -0,0 +1,114 @@
+package avro
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Generates the fields for a single record with the default policy and type
+// change strategy
+func generate(s *Schema, record map[string]interface{}) error {
+	_, err := s.GenerateSchemaFields([]map[string]interface{}{record}, time.RFC3339, nil, "", "")
+	return err
+}
+
+func fieldNamed(s *Schema, name string) Field {
+	for _, field := range s.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return Field{}
+}
+
+func TestStringTypesAreNotInferredByDefault(t *testing.T) {
+	defer func(infer bool) { data.InferStringTypes = infer }(data.InferStringTypes)
+	data.InferStringTypes = false
+
+	s := NewSchema("events.avro", "events.avsc")
+	if err := generate(s, map[string]interface{}{"code": "2021-02-03", "ref": "0d6b6b5c-3c8f-4a4e-9d5a-7f3f7f1c2b11"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"code", "ref"} {
+		if field := fieldNamed(s, name); field.LogicalType != "" || field.NonNullType() != "string" {
+			t.Errorf("expected %v to be a plain string, got %+v", name, field)
+		}
+	}
+	if err := generate(s, map[string]interface{}{"code": "not a date", "ref": "free text"}); err != nil {
+		t.Errorf("expected a plain string to load into the same fields, got %v", err)
+	}
+}
+
+func TestInferredStringTypes(t *testing.T) {
+	defer func(infer bool) { data.InferStringTypes = infer }(data.InferStringTypes)
+	data.InferStringTypes = true
+
+	s := NewSchema("events.avro", "events.avsc")
+	if err := generate(s, map[string]interface{}{"day": "2021-02-03", "at": "10:11:12", "ref": "0d6b6b5c-3c8f-4a4e-9d5a-7f3f7f1c2b11"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, logicalType := range map[string]string{"day": Date, "at": TimeMicros, "ref": UUID} {
+		if field := fieldNamed(s, name); field.LogicalType != logicalType {
+			t.Errorf("expected %v to be a %v, got %+v", name, logicalType, field)
+		}
+	}
+
+	// A VALUE THAT DOESNT MATCH IS A TYPE CHANGE THE DEFAULT STRATEGY REJECTS
+	err := generate(s, map[string]interface{}{"day": "tomorrow"})
+	var conflict *TypeConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("expected a type conflict, got %v", err)
+	}
+}
+
+func TestExistingStringTypesKeepTheirType(t *testing.T) {
+	defer func(infer bool) { data.InferStringTypes = infer }(data.InferStringTypes)
+	data.InferStringTypes = false
+
+	s := NewSchema("events.avro", "events.avsc")
+	s.Fields = append(s.Fields, newLogicalField("day", "int", Date))
+	record := map[string]interface{}{"day": "2021-02-03"}
+	if err := generate(s, record); err != nil {
+		t.Fatal(err)
+	}
+	if field := fieldNamed(s, "day"); field.LogicalType != Date {
+		t.Errorf("expected day to stay a date, got %+v", field)
+	}
+	if _, ok := record["day"].(time.Time); !ok {
+		t.Errorf("expected the value to be converted to a date, got %#v", record["day"])
+	}
+}
+
+func TestLegacyLongTimestampsAreUpgraded(t *testing.T) {
+	// AN AVSC SAVED BEFORE LOGICAL TYPES, WITH THE TIMESTAMP AS A PLAIN LONG
+	s := NewSchema("events.avro", "events.avsc")
+	avsc := `{"name": "events.avro", "namespace": "events.avsc", "type": "record", "fields": [
+		{"name": "id", "type": ["int", "null"]},
+		{"name": "at", "type": ["long", "null"]}
+	]}`
+	if err := json.Unmarshal([]byte(avsc), s); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typeChange := range []string{TypeChangeReject, TypeChangeRewrite} {
+		s := &Schema{Name: s.Name, Namespace: s.Namespace, Type: s.Type, Fields: append([]Field{}, s.Fields...)}
+		records := []map[string]interface{}{{"id": float64(1), "at": "2021-02-03T04:05:06Z"}}
+		changes, err := s.GenerateSchemaFields(records, time.RFC3339, nil, "", typeChange)
+		if err != nil {
+			t.Fatalf("%v: expected the timestamp to load, got %v", typeChange, err)
+		}
+		if len(changes.TypeChanges) != 0 {
+			t.Errorf("%v: expected no type changes, got %+v", typeChange, changes.TypeChanges)
+		}
+		if field := fieldNamed(s, "at"); field.LogicalType != TimestampMicros {
+			t.Errorf("%v: expected at to be upgraded to a timestamp, got %+v", typeChange, field)
+		}
+		if _, ok := records[0]["at"].(time.Time); !ok {
+			t.Errorf("%v: expected the value to be converted to a timestamp, got %#v", typeChange, records[0]["at"])
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package avro
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Type change strategies, these decide what happens when a field that is
+// already in the schema of a table gets values of a different type
+const (
+	// TypeChangeSibling Writes the values to a new column named after the
+	// field and the new type, such as amount__string
+	TypeChangeSibling = "sibling"
+	// TypeChangeRewrite Widens the field to a string and rewrites the table
+	// with the column cast to the new type, after taking a snapshot of it
+	TypeChangeRewrite = "rewrite"
+	// TypeChangeReject Rejects the records, this is the default
+	TypeChangeReject = "reject"
+)
+
+// The suffixes sibling columns can have, one for each type a value can be
+// inferred as
+var siblingSuffixes = map[string]bool{
+	"string": true, "int": true, "long": true, "float": true, "double": true, "boolean": true,
+	"timestamp": true, "date": true, "time": true, "decimal": true, "uuid": true,
+}
+
+// TypeConflictError Returned when fields change type and the strategy
+// doesnt allow it, or the table has columns that dont match the schema
+type TypeConflictError struct {
+	Table     string
+	Conflicts []data.TypeChange
+}
+
+func (e *TypeConflictError) Error() string {
+	var conflicts []string
+	for _, conflict := range e.Conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%v is %v but got %v", conflict.Field, conflict.From, conflict.To))
+	}
+	return fmt.Sprintf("fields in %v changed type: %v", e.Table, strings.Join(conflicts, ", "))
+}
+
+// Returns the strategy, using reject if it is blank
+func typeChangeOrDefault(strategy string) string {
+	if strategy == "" {
+		return TypeChangeReject
+	}
+	return strategy
+}
+
+// Returns the name of the type of the field, logical types are used without
+// their precision so they can be used in sibling column names
+func (f Field) typeName() string {
+	if f.LogicalType != "" {
+		return strings.TrimSuffix(f.LogicalType, "-micros")
+	}
+	return f.NonNullType()
+}
+
+// Returns true if both fields have the same type
+func (f Field) sameType(other Field) bool {
+	return f.NonNullType() == other.NonNullType() && f.LogicalType == other.LogicalType
+}
+
+// Returns the name of the column values of the field with a new type are
+// written to by the sibling strategy
+func siblingName(name string, nf Field) string {
+	return fmt.Sprintf("%v__%v", name, nf.typeName())
+}
+
+// Returns true if the field is a sibling column of one of the columns
+func isSibling(name string, columns map[string]bool) bool {
+	i := strings.LastIndex(name, "__")
+	return i > 0 && columns[name[:i]] && siblingSuffixes[name[i+2:]]
+}
+
+// WidenedColumns Returns the string fields in the schema whose columns in the
+// table have another type, these are the columns the rewrite strategy has to
+// cast to a string. columnTypes maps each column to its type in the table
+func (s Schema) WidenedColumns(columnTypes map[string]string, isString func(columnType string) bool) []data.TypeChange {
+	var changes []data.TypeChange
+	for _, field := range s.Fields {
+		columnType, ok := columnTypes[field.Name]
+		if !ok || field.LogicalType != "" || field.NonNullType() != "string" || isString(columnType) {
+			continue
+		}
+		changes = append(changes, data.TypeChange{Field: field.Name, From: columnType, To: "string", Column: field.Name})
+	}
+	return changes
+}
+
+// CheckTypeChanges Returns a TypeConflictError if there are columns that
+// changed type and the strategy is not rewrite
+func CheckTypeChanges(strategy, table string, changes []data.TypeChange) error {
+	if len(changes) == 0 || typeChangeOrDefault(strategy) == TypeChangeRewrite {
+		return nil
+	}
+	return &TypeConflictError{Table: table, Conflicts: changes}
+}
@@ -0,0 +1,267 @@
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	hamba "github.com/hamba/avro"
+)
+
+// The logical types fields can have, they are applied to the non null type in
+// the fields union
+const (
+	TimestampMicros = "timestamp-micros"
+	Date            = "date"
+	TimeMicros      = "time-micros"
+	Decimal         = "decimal"
+	UUID            = "uuid"
+	// JSON Strings holding a JSON document, loaded into a BigQuery JSON
+	// column
+	JSON = "json"
+
+	// DecimalPrecision The precision of decimal fields, this matches a
+	// BigQuery NUMERIC
+	DecimalPrecision = 38
+	// DecimalScale The scale of decimal fields, this matches a BigQuery
+	// NUMERIC
+	DecimalScale = 9
+)
+
+var (
+	dateFormat       = "2006-01-02"
+	timeOfDayFormats = []string{"15:04:05", "15:04:05.999999"}
+	uuidPattern      = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+func init() {
+	// THE ENCODER ONLY KNOWS WHICH UNION BRANCH A STRING GOES IN IF UUID IS REGISTERED
+	hamba.Register(string(hamba.String)+"."+string(hamba.UUID), "")
+}
+
+// Field a field object, includes name of field and type of field, the logical
+// type applies to the non null type
+type Field struct {
+	Name        string
+	FieldType   []string
+	LogicalType string
+	Precision   int
+	Scale       int
+}
+
+// The JSON representation of a type with a logical type
+type logicalTypeJSON struct {
+	Type        string `json:"type"`
+	LogicalType string `json:"logicalType"`
+	Precision   int    `json:"precision,omitempty"`
+	Scale       int    `json:"scale,omitempty"`
+	SQLType     string `json:"sqlType,omitempty"`
+}
+
+type fieldJSON struct {
+	Name string            `json:"name"`
+	Type []json.RawMessage `json:"type"`
+}
+
+// MarshalJSON Writes the field as an avro field, the non null type is written
+// as an object if there is a logical type
+func (f Field) MarshalJSON() ([]byte, error) {
+	fj := fieldJSON{Name: f.Name}
+	for _, fieldType := range f.FieldType {
+		var (
+			typeJSON []byte
+			err      error
+		)
+		if fieldType != "null" && f.LogicalType != "" {
+			logical := logicalTypeJSON{Type: fieldType, LogicalType: f.LogicalType, Precision: f.Precision, Scale: f.Scale}
+			// BIGQUERY ONLY LOADS AVRO STRINGS INTO A JSON COLUMN WITH THIS ANNOTATION
+			if f.LogicalType == JSON {
+				logical.SQLType = "JSON"
+			}
+			typeJSON, err = json.Marshal(logical)
+		} else {
+			typeJSON, err = json.Marshal(fieldType)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fj.Type = append(fj.Type, typeJSON)
+	}
+	return json.Marshal(fj)
+}
+
+// UnmarshalJSON Reads an avro field, the types in the union can be names or
+// objects with a logical type
+func (f *Field) UnmarshalJSON(b []byte) error {
+	var fj fieldJSON
+	if err := json.Unmarshal(b, &fj); err != nil {
+		return err
+	}
+	*f = Field{Name: fj.Name}
+	for _, typeJSON := range fj.Type {
+		var name string
+		if err := json.Unmarshal(typeJSON, &name); err == nil {
+			f.FieldType = append(f.FieldType, name)
+			continue
+		}
+		var logical logicalTypeJSON
+		if err := json.Unmarshal(typeJSON, &logical); err != nil {
+			return fmt.Errorf("field %v has an invalid type: %v", fj.Name, string(typeJSON))
+		}
+		f.FieldType = append(f.FieldType, logical.Type)
+		f.LogicalType, f.Precision, f.Scale = logical.LogicalType, logical.Precision, logical.Scale
+	}
+	return nil
+}
+
+// NonNullType Returns the type in the union that isnt null
+func (f Field) NonNullType() string {
+	fieldType := ""
+	for _, v := range f.FieldType {
+		if v != "null" {
+			fieldType = v
+		}
+	}
+	return fieldType
+}
+
+// Returns a nullable field with a logical type
+func newLogicalField(name, fieldType, logicalType string) Field {
+	field := Field{Name: name, FieldType: []string{fieldType, "null"}, LogicalType: logicalType}
+	if logicalType == Decimal {
+		field.Precision, field.Scale = DecimalPrecision, DecimalScale
+	}
+	return field
+}
+
+// Returns the field a value would need, strings are checked for timestamps
+// in the timestamp format, and for dates, times of day and uuids when
+// InferStringTypes is on, nils have no type
+func inferField(name string, value interface{}, timestampFormat string, decimal bool) (Field, bool) {
+	if decimal {
+		if _, ok := parseDecimal(value); ok {
+			return newLogicalField(name, "bytes", Decimal), true
+		}
+	}
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Int64:
+		return *NewField(name, "long"), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return *NewField(name, "int"), true
+	case reflect.Bool:
+		return *NewField(name, "boolean"), true
+	case reflect.Float32:
+		return *NewField(name, "float"), true
+	case reflect.Float64:
+		// CHECK IF FLOAT IS ACTUALLY AN INT BECAUSE JSON UNMARSHALLS ALL NUMBERS AS FLOAT64
+		if isFloatInt(value.(float64)) {
+			return *NewField(name, "int"), true
+		}
+		return *NewField(name, "double"), true
+	case reflect.String:
+		stringValue := value.(string)
+		if _, err := time.Parse(timestampFormat, stringValue); err == nil {
+			return newLogicalField(name, "long", TimestampMicros), true
+		}
+		if data.InferStringTypes {
+			for _, field := range []Field{
+				newLogicalField(name, "int", Date),
+				newLogicalField(name, "long", TimeMicros),
+				newLogicalField(name, "string", UUID),
+			} {
+				if field.matchesString(stringValue) {
+					return field, true
+				}
+			}
+		}
+		return *NewField(name, "string"), true
+	}
+	return Field{}, false
+}
+
+// Returns true if the string is a date, time of day or uuid and the field has
+// that logical type
+func (f Field) matchesString(value string) bool {
+	switch f.LogicalType {
+	case Date:
+		_, err := time.Parse(dateFormat, value)
+		return err == nil
+	case TimeMicros:
+		_, ok := parseTimeOfDay(value)
+		return ok
+	case UUID:
+		return uuidPattern.MatchString(value)
+	}
+	return false
+}
+
+// Converts a parsed JSON value to the go type the encoder expects for the
+// field, values that cant be converted are returned as they are
+func (f Field) convert(value interface{}, timestampFormat string) interface{} {
+	if value == nil {
+		return nil
+	}
+	stringValue, isString := value.(string)
+	switch f.LogicalType {
+	case TimestampMicros:
+		if t, err := time.Parse(timestampFormat, stringValue); isString && err == nil {
+			return t.UTC()
+		}
+	case Date:
+		if t, err := time.Parse(dateFormat, stringValue); isString && err == nil {
+			return t
+		}
+	case TimeMicros:
+		if d, ok := parseTimeOfDay(stringValue); isString && ok {
+			return d
+		}
+	case Decimal:
+		if r, ok := parseDecimal(value); ok {
+			return r
+		}
+	}
+	switch f.NonNullType() {
+	case "int":
+		if v, ok := value.(float64); ok {
+			return int(v)
+		}
+	case "long":
+		if v, ok := value.(float64); ok {
+			return int64(v)
+		}
+	case "string":
+		if !isString {
+			return fmt.Sprint(value)
+		}
+	}
+	return value
+}
+
+// Parses a time of day into the duration since midnight
+func parseTimeOfDay(value string) (time.Duration, bool) {
+	for _, layout := range timeOfDayFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)), true
+		}
+	}
+	return 0, false
+}
+
+// Parses a JSON number or numeric string into a decimal
+func parseDecimal(value interface{}) (*big.Rat, bool) {
+	var text string
+	switch v := value.(type) {
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		text = v
+	default:
+		return nil, false
+	}
+	return new(big.Rat).SetString(text)
+}
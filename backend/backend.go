@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// ErrObjectNotExist Returned by an ObjectStore when the object being
+// downloaded does not exist
+var ErrObjectNotExist = errors.New("object doesn't exist")
+
+// ObjectInfo The name of an object relative to the folder it was listed in,
+// with its size and when it was last written
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	Updated time.Time
+	// Archived Whether the object has been moved to an archive storage class
+	Archived bool
+}
+
+// ObjectStore Where the staging files for a table are kept, objects are keyed
+// by dataset and file name
+type ObjectStore interface {
+	// Prepare Creates the bucket or folder the objects are kept in if it
+	// doesnt already exist
+	Prepare(projectID string) error
+	// Download Returns the contents of an object, or ErrObjectNotExist
+	Download(dataset, fileName string) ([]byte, error)
+	// Upload Creates or overwrites an object
+	Upload(dataset, fileName string, data []byte) error
+	// URI Returns the URI of an object for a warehouse to load from
+	URI(dataset, fileName string) string
+	// List Returns every object under the dataset folder, including the ones
+	// in folders below it
+	List(dataset string) ([]ObjectInfo, error)
+	// Delete Removes an object, an object that doesnt exist is not an error
+	Delete(dataset, fileName string) error
+	// Close Closes any connections held by the store
+	Close() error
+}
+
+// Archiver An ObjectStore that can move objects to a cheaper storage class
+// instead of deleting them
+type Archiver interface {
+	// Archive Moves an object to the archive storage class, an object that
+	// doesnt exist is not an error
+	Archive(dataset, fileName string) error
+}
+
+// TableOptions How PrepareTable is allowed to change the columns of a table
+// that already has some
+type TableOptions struct {
+	// SchemaPolicy Whether new fields can be added as columns
+	SchemaPolicy string
+	// TypeChangeStrategy How a column is migrated when its field is widened to
+	// a string, only the rewrite strategy changes the column
+	TypeChangeStrategy string
+	// FieldMetadata Descriptions, labels and policy tags to set on the table
+	// and its columns, if the warehouse supports them
+	FieldMetadata *data.JTBFieldMetadata
+}
+
+// TableCopy A table whose rows are appended to another table in the same
+// dataset, the columns of the source are copied by name
+type TableCopy struct {
+	Source      string
+	Destination string
+}
+
+// Warehouse Where the tables are kept, the schema of each table is kept up to
+// date with the avro schema before the staged files are loaded into it
+type Warehouse interface {
+	// PrepareTable Creates the dataset and table if they dont exist, then adds
+	// any new fields in the schema to the table if the schema policy allows it,
+	// and migrates any columns that changed type
+	PrepareTable(datasetID, tableID string, sch avro.Schema, opts TableOptions) error
+	// LoadFile Appends the rows in a staged avro or parquet file to the table,
+	// the format is taken from the file extension, returns the ID of the load
+	// job if the warehouse has them
+	LoadFile(objects ObjectStore, datasetID, tableID, fileName string) (string, error)
+	// InsertRows Appends a few rows to a table without staging them first,
+	// the table has to be prepared already
+	InsertRows(datasetID, tableID string, rows []map[string]interface{}) error
+	// ExecuteQueries Runs the statements in order, returning the results of
+	// every statement that was ran, requestID keeps the job IDs the same when a
+	// request is ran again and is blank for statements that arent from a request
+	ExecuteQueries(datasetID, requestID string, statements []data.JTBQuery) ([]data.QueryResult, error)
+	// AppendTables Appends the rows of each source table to its destination
+	// in one transaction, either every destination gets its rows or none do
+	AppendTables(datasetID string, copies []TableCopy) error
+	// DropTable Deletes a table, a table that doesnt exist is not an error
+	DropTable(datasetID, tableID string) error
+	// DeduplicateTable Removes any rows that have the same values in the key
+	// columns as another row in the table, keeping one of them, no key columns
+	// removes rows that are exact duplicates
+	DeduplicateTable(projectID, datasetID, tableID string, keyColumns []string) error
+	// Close Closes any connections held by the warehouse
+	Close() error
+}
+
+// SnapshotName Returns the name of a snapshot of the table taken now, the
+// snapshot is kept in the same dataset as the table. The time goes down to the
+// nanosecond so two rewrites of a table in the same second dont collide
+func SnapshotName(tableID string) string {
+	now := time.Now().UTC()
+	return fmt.Sprintf("%v__snapshot_%v%09d", tableID, now.Format("20060102150405"), now.Nanosecond())
+}
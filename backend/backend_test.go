@@ -0,0 +1,16 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSnapshotName(t *testing.T) {
+	first, second := SnapshotName("events"), SnapshotName("events")
+	if !strings.HasPrefix(first, "events__snapshot_") || len(first) != len("events__snapshot_")+23 {
+		t.Errorf("unexpected snapshot name %v", first)
+	}
+	if first == second {
+		t.Errorf("expected snapshots taken in the same second to get different names, got %v twice", first)
+	}
+}
@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStore An ObjectStore that keeps objects on the local filesystem under a
+// root folder, using the same dataset/file layout as the GCS bucket
+type FileStore struct {
+	Root string
+}
+
+// NewFileStore Constructor func, returns a store rooted at the folder
+func NewFileStore(root string) *FileStore {
+	return &FileStore{Root: root}
+}
+
+// Returns the path of a file, the dataset and file name come from requests so
+// a path that would end up outside of the root, like ../../etc, is rejected
+func (f *FileStore) path(dataset, fileName string) (string, error) {
+	target := filepath.Join(f.Root, dataset, fileName)
+	rel, err := filepath.Rel(filepath.Clean(f.Root), target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("%v is outside of the file store root", filepath.Join(dataset, fileName))
+	}
+	return target, nil
+}
+
+// Prepare Creates the root folder if it doesnt already exist
+func (f *FileStore) Prepare(projectID string) error {
+	return os.MkdirAll(f.Root, os.ModePerm)
+}
+
+// Download Returns the contents of a file, or ErrObjectNotExist
+func (f *FileStore) Download(dataset, fileName string) ([]byte, error) {
+	target, err := f.path(dataset, fileName)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(target)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotExist
+	}
+	return contents, err
+}
+
+// Upload Writes the file, creating the dataset folder if needed, the file is
+// written to a temp file first so readers never see half of it
+func (f *FileStore) Upload(dataset, fileName string, data []byte) error {
+	target, err := f.path(dataset, fileName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// URI Returns the file URI of an object, or a blank string if the path would
+// be outside of the root
+func (f *FileStore) URI(dataset, fileName string) string {
+	target, err := f.path(dataset, fileName)
+	if err != nil {
+		return ""
+	}
+	if abs, err := filepath.Abs(target); err == nil {
+		target = abs
+	}
+	return "file://" + filepath.ToSlash(target)
+}
+
+// List Walks the dataset folder, files that are still being written are left
+// out
+func (f *FileStore) List(dataset string) ([]ObjectInfo, error) {
+	root, err := f.path(dataset, "")
+	if err != nil {
+		return nil, err
+	}
+	var objects []ObjectInfo
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Name: filepath.ToSlash(name), Size: info.Size(), Updated: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+// Delete Removes the file
+func (f *FileStore) Delete(dataset, fileName string) error {
+	target, err := f.path(dataset, fileName)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// SweepTempFiles Removes the temp files of uploads that never finished and
+// were last written before the time, then any folders that are left empty and
+// havent changed since then either, returns how many files were removed
+func (f *FileStore) SweepTempFiles(before time.Time) (int, error) {
+	var (
+		removed int
+		folders []string
+	)
+	err := filepath.Walk(f.Root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != f.Root && info.ModTime().Before(before) {
+				folders = append(folders, path)
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") && info.ModTime().Before(before) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	// THE DEEPEST FOLDERS ARE REMOVED FIRST SO THEIR PARENTS CAN BE EMPTY TOO,
+	// REMOVE FAILS ON ANY FOLDER THAT STILL HAS FILES IN IT
+	for i := len(folders) - 1; i >= 0; i-- {
+		os.Remove(folders[i])
+	}
+	return removed, nil
+}
+
+// Close Does nothing as there is no connection to close
+func (f *FileStore) Close() error {
+	return nil
+}
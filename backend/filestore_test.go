@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreRejectsPathsOutsideRoot(t *testing.T) {
+	parent := t.TempDir()
+	f := NewFileStore(filepath.Join(parent, "staging"))
+	if err := f.Prepare("project"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(parent, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range [][2]string{
+		{"..", "secret.txt"},
+		{"dataset", "../../secret.txt"},
+		{"../staging_other", "events.avro"},
+	} {
+		if _, err := f.Download(name[0], name[1]); err == nil {
+			t.Errorf("expected downloading %v/%v to be rejected", name[0], name[1])
+		}
+		if err := f.Upload(name[0], name[1], []byte("{}")); err == nil {
+			t.Errorf("expected uploading %v/%v to be rejected", name[0], name[1])
+		}
+		if err := f.Delete(name[0], name[1]); err == nil {
+			t.Errorf("expected deleting %v/%v to be rejected", name[0], name[1])
+		}
+	}
+	if _, err := f.List(".."); err == nil {
+		t.Error("expected listing the parent of the root to be rejected")
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(parent, "secret.txt")); err != nil || string(contents) != "secret" {
+		t.Errorf("expected the file outside the root to be untouched, got %q, %v", contents, err)
+	}
+
+	// NAMES THAT STAY INSIDE THE ROOT STILL WORK
+	if err := f.Upload("dataset", "nested/../events.avro", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Download("dataset", "events.avro"); err != nil {
+		t.Errorf("expected the file to be inside the dataset folder, got %v", err)
+	}
+}
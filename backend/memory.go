@@ -0,0 +1,277 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Column A column in a MemoryWarehouse table, the type is the avro type of the
+// field, or its logical type if it has one
+type Column struct {
+	Name        string
+	Type        string
+	Description string
+	PolicyTags  []string
+}
+
+// MemoryTable A table held in a MemoryWarehouse
+type MemoryTable struct {
+	Columns     []Column
+	Rows        []map[string]interface{}
+	Description string
+	Labels      map[string]string
+}
+
+// MemoryWarehouse A Warehouse that keeps tables in memory, it tracks the table
+// schemas, loaded rows and executed queries so the pipeline can be ran end to
+// end without google cloud
+type MemoryWarehouse struct {
+	mu      sync.Mutex
+	tables  map[string]*MemoryTable
+	queries []data.JTBQuery
+}
+
+// NewMemoryWarehouse Constructor func, returns an empty warehouse
+func NewMemoryWarehouse() *MemoryWarehouse {
+	return &MemoryWarehouse{tables: make(map[string]*MemoryTable)}
+}
+
+func tableKey(datasetID, tableID string) string {
+	return fmt.Sprintf("%v.%v", datasetID, tableID)
+}
+
+// PrepareTable Creates the table if it doesnt exist and adds any new fields
+// the schema policy allows, columns widened to a string are rewritten after
+// the table is copied to a snapshot, then the field metadata is applied
+func (m *MemoryWarehouse) PrepareTable(datasetID, tableID string, sch avro.Schema, opts TableOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := tableKey(datasetID, tableID)
+	table, ok := m.tables[key]
+	if !ok {
+		table = &MemoryTable{}
+		m.tables[key] = table
+	}
+	var columns []string
+	columnTypes := make(map[string]string)
+	for _, column := range table.Columns {
+		columns = append(columns, column.Name)
+		columnTypes[column.Name] = column.Type
+	}
+	if err := sch.CheckPolicy(opts.SchemaPolicy, tableID, columns); err != nil {
+		return err
+	}
+	changes := sch.WidenedColumns(columnTypes, func(columnType string) bool { return columnType == "string" })
+	if err := avro.CheckTypeChanges(opts.TypeChangeStrategy, tableID, changes); err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		m.tables[tableKey(datasetID, SnapshotName(tableID))] = table.copy()
+		table.rewriteColumns(changes)
+	}
+	for _, field := range sch.Fields {
+		exists := false
+		for _, column := range table.Columns {
+			if column.Name == field.Name {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+		column := Column{Name: field.Name, Type: field.NonNullType()}
+		if field.LogicalType != "" {
+			column.Type = field.LogicalType
+		}
+		table.Columns = append(table.Columns, column)
+	}
+	table.applyMetadata(sch, opts.FieldMetadata)
+	return nil
+}
+
+// Sets the descriptions, labels and policy tags that are in the metadata
+func (t *MemoryTable) applyMetadata(sch avro.Schema, metadata *data.JTBFieldMetadata) {
+	if metadata == nil {
+		return
+	}
+	if metadata.TableDescription != "" {
+		t.Description = metadata.TableDescription
+	}
+	for key, value := range metadata.Labels {
+		if t.Labels == nil {
+			t.Labels = make(map[string]string)
+		}
+		t.Labels[key] = value
+	}
+	columnMetadata := sch.ColumnMetadata(metadata)
+	for i, column := range t.Columns {
+		columnMeta, ok := columnMetadata[column.Name]
+		if !ok {
+			continue
+		}
+		if columnMeta.Description != "" {
+			t.Columns[i].Description = columnMeta.Description
+		}
+		if len(columnMeta.PolicyTags) > 0 {
+			t.Columns[i].PolicyTags = columnMeta.PolicyTags
+		}
+	}
+}
+
+// Returns a copy of the table
+func (t *MemoryTable) copy() *MemoryTable {
+	snapshot := &MemoryTable{Columns: append([]Column(nil), t.Columns...), Description: t.Description}
+	for key, value := range t.Labels {
+		if snapshot.Labels == nil {
+			snapshot.Labels = make(map[string]string)
+		}
+		snapshot.Labels[key] = value
+	}
+	for _, row := range t.Rows {
+		copied := make(map[string]interface{}, len(row))
+		for k, v := range row {
+			copied[k] = v
+		}
+		snapshot.Rows = append(snapshot.Rows, copied)
+	}
+	return snapshot
+}
+
+// Changes the columns to strings and formats their values as strings
+func (t *MemoryTable) rewriteColumns(changes []data.TypeChange) {
+	for _, change := range changes {
+		for i, column := range t.Columns {
+			if column.Name == change.Column {
+				t.Columns[i].Type = change.To
+			}
+		}
+		for _, row := range t.Rows {
+			if value := row[change.Column]; value != nil {
+				row[change.Column] = fmt.Sprint(value)
+			}
+		}
+	}
+}
+
+// LoadFile Decodes the staged file and appends its rows to the table
+func (m *MemoryWarehouse) LoadFile(objects ObjectStore, datasetID, tableID, fileName string) (string, error) {
+	fileBytes, err := objects.Download(datasetID, fileName)
+	if err != nil {
+		return "", err
+	}
+	rows, err := ReadRecords(fileName, fileBytes)
+	if err != nil {
+		return "", err
+	}
+	return "", m.InsertRows(datasetID, tableID, rows)
+}
+
+// InsertRows Appends the rows to the table
+func (m *MemoryWarehouse) InsertRows(datasetID, tableID string, rows []map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, ok := m.tables[tableKey(datasetID, tableID)]
+	if !ok {
+		return fmt.Errorf("table %v.%v does not exist", datasetID, tableID)
+	}
+	table.Rows = append(table.Rows, rows...)
+	return nil
+}
+
+// ExecuteQueries Records the statements without running them
+func (m *MemoryWarehouse) ExecuteQueries(datasetID, requestID string, statements []data.JTBQuery) ([]data.QueryResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var results []data.QueryResult
+	for _, statement := range statements {
+		m.queries = append(m.queries, statement)
+		results = append(results, data.QueryResult{SQL: statement.SQL, JobID: fmt.Sprintf("memory_query_%v", len(m.queries))})
+	}
+	return results, nil
+}
+
+// AppendTables Appends the rows of each source table to its destination, every
+// table is checked before any rows are appended
+func (m *MemoryWarehouse) AppendTables(datasetID string, copies []TableCopy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range copies {
+		for _, tableID := range []string{c.Source, c.Destination} {
+			if _, ok := m.tables[tableKey(datasetID, tableID)]; !ok {
+				return fmt.Errorf("table %v.%v does not exist", datasetID, tableID)
+			}
+		}
+	}
+	for _, c := range copies {
+		destination := m.tables[tableKey(datasetID, c.Destination)]
+		destination.Rows = append(destination.Rows, m.tables[tableKey(datasetID, c.Source)].Rows...)
+	}
+	return nil
+}
+
+// DropTable Deletes the table
+func (m *MemoryWarehouse) DropTable(datasetID, tableID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tables, tableKey(datasetID, tableID))
+	return nil
+}
+
+// DeduplicateTable Removes rows that have the same key columns as an earlier
+// row, or that are exact duplicates of one if there are no key columns
+func (m *MemoryWarehouse) DeduplicateTable(projectID, datasetID, tableID string, keyColumns []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, ok := m.tables[tableKey(datasetID, tableID)]
+	if !ok {
+		return fmt.Errorf("table %v.%v does not exist", datasetID, tableID)
+	}
+	var (
+		seen = make(map[string]bool)
+		rows []map[string]interface{}
+	)
+	for _, row := range table.Rows {
+		// FMT PRINTS MAPS WITH SORTED KEYS SO THIS IS STABLE
+		key := fmt.Sprint(row)
+		if len(keyColumns) > 0 {
+			keyValues := make([]interface{}, len(keyColumns))
+			for i, column := range keyColumns {
+				keyValues[i] = row[column]
+			}
+			key = fmt.Sprint(keyValues)
+		}
+		if !seen[key] {
+			seen[key] = true
+			rows = append(rows, row)
+		}
+	}
+	table.Rows = rows
+	return nil
+}
+
+// Table Returns a copy of a table, or false if it doesnt exist
+func (m *MemoryWarehouse) Table(datasetID, tableID string) (MemoryTable, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, ok := m.tables[tableKey(datasetID, tableID)]
+	if !ok {
+		return MemoryTable{}, false
+	}
+	return *table.copy(), true
+}
+
+// Queries Returns every statement that has been executed
+func (m *MemoryWarehouse) Queries() []data.JTBQuery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]data.JTBQuery(nil), m.queries...)
+}
+
+// Close Does nothing as there is no connection to close
+func (m *MemoryWarehouse) Close() error {
+	return nil
+}
@@ -0,0 +1,22 @@
+package backend
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/parquet"
+)
+
+// ReadRecords Decodes the rows of a staged file, the format is taken from the
+// file extension, .avro or .parquet
+func ReadRecords(fileName string, fileBytes []byte) ([]map[string]interface{}, error) {
+	switch path.Ext(fileName) {
+	case ".avro":
+		return avro.ReadRecords(fileBytes)
+	case ".parquet":
+		return parquet.ReadRecords(fileBytes)
+	default:
+		return nil, fmt.Errorf("unknown staging format for file: %v", fileName)
+	}
+}
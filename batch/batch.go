@@ -0,0 +1,389 @@
+package batch
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+// States a batch moves through
+const (
+	StatePending  = "pending"
+	StateFlushing = "flushing"
+	StateFlushed  = "flushed"
+	StateFailed   = "failed"
+)
+
+// How long the status of a finished batch is kept for callers to look up
+const statusRetention = time.Hour
+
+// Buffers The process wide micro batching buffers
+var Buffers = NewManager(data.BatchSpoolDir, data.BatchMaxRows, data.BatchMaxBytes, time.Duration(data.BatchMaxWaitSeconds)*time.Second)
+
+// Manager Buffers records per target table and flushes them through the
+// pipeline as a single load when a row, byte or time threshold is reached
+type Manager struct {
+	mu       sync.Mutex
+	spoolDir string
+	maxRows  int
+	maxBytes int64
+	maxWait  time.Duration
+	buffers  map[string]*buffer
+	statuses map[string]*data.BatchStatus
+	// RetryBackoff How long to wait before flushing a batch that failed with a
+	// server error again, doubled after every failure up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// Run is used to flush a merged batch, defaults to pipeline.Run
+	Run func(*data.JTBRequest) (*pipeline.Result, error)
+}
+
+// buffer The batch currently filling up for a table, flushLock stops two
+// batches for the same table being flushed at once
+type buffer struct {
+	current   *batch
+	flushLock sync.Mutex
+}
+
+// One line of a spool file, the caller is kept next to the request as it is
+// never read from a request body
+type spooledRequest struct {
+	*data.JTBRequest
+	SpoolCaller string `json:"SpoolCaller,omitempty"`
+}
+
+// batch A set of requests for the same table that will be loaded together
+type batch struct {
+	status    *data.BatchStatus
+	requests  []*data.JTBRequest
+	bytes     int64
+	spool     *os.File
+	spoolPath string
+	timer     *time.Timer
+}
+
+// NewManager Constructor func, returns a manager that spools to spoolDir
+func NewManager(spoolDir string, maxRows int, maxBytes int64, maxWait time.Duration) *Manager {
+	return &Manager{
+		spoolDir: spoolDir,
+		maxRows:  maxRows,
+		maxBytes: maxBytes,
+		maxWait:  maxWait,
+		buffers:  make(map[string]*buffer),
+		statuses: make(map[string]*data.BatchStatus),
+		Run:      pipeline.Run,
+
+		RetryBackoff:    time.Duration(data.BatchRetryBackoffSeconds) * time.Second,
+		MaxRetryBackoff: time.Duration(data.BatchMaxRetryBackoffSeconds) * time.Second,
+	}
+}
+
+// Returns the key requests have to share to be loaded in the same batch, they
+// need the same target table and options
+func batchKey(request *data.JTBRequest) string {
+	statements, _ := json.Marshal(request.Statements())
+	compression, _ := json.Marshal(request.Compression)
+	metadata, _ := json.Marshal(request.FieldMetadata)
+	routing, _ := json.Marshal(request.Routing)
+	return strings.Join([]string{request.ProjectID, request.DatasetName, request.TableName, request.IdField, request.TimestampFormat, string(statements), string(compression), strings.Join(request.DecimalFields, ","), request.SchemaPolicy, request.TypeChangeStrategy, string(metadata), strconv.FormatBool(request.KeepRaw), string(routing)}, "|")
+}
+
+func newBatchID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Add Buffers the records in the request, persisting them to the spool before
+// returning the status of the batch they were added to. A request without an
+// ID is given one so it can be found in the ingestion log row of its batch
+func (m *Manager) Add(request *data.JTBRequest) (data.BatchStatus, error) {
+	if request.RequestID == "" {
+		request.RequestID = data.NewRequestID()
+	}
+	line, err := json.Marshal(spooledRequest{JTBRequest: request, SpoolCaller: request.Caller})
+	if err != nil {
+		return data.BatchStatus{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneStatuses()
+
+	key := batchKey(request)
+	buf, ok := m.buffers[key]
+	if !ok {
+		buf = &buffer{}
+		m.buffers[key] = buf
+	}
+	if buf.current == nil {
+		b, err := m.newBatch(request)
+		if err != nil {
+			return data.BatchStatus{}, err
+		}
+		buf.current = b
+		b.timer = time.AfterFunc(m.maxWait, func() { m.flushIfCurrent(key, b) })
+	}
+	b := buf.current
+
+	// PERSIST TO THE SPOOL BEFORE ACKNOWLEDGING SO A CRASH DOESNT LOSE THE RECORDS
+	if _, err := b.spool.Write(append(line, '\n')); err != nil {
+		return data.BatchStatus{}, err
+	}
+	if err := b.spool.Sync(); err != nil {
+		return data.BatchStatus{}, err
+	}
+	b.requests = append(b.requests, request)
+	b.bytes += int64(len(line))
+	b.status.Requests++
+	b.status.Rows += len(request.Data)
+
+	if (m.maxRows > 0 && b.status.Rows >= m.maxRows) || (m.maxBytes > 0 && b.bytes >= m.maxBytes) {
+		m.detach(key, b)
+		go m.flush(buf, b)
+	}
+	return *b.status, nil
+}
+
+// Creates a new batch and its spool file, must be called holding the lock
+func (m *Manager) newBatch(request *data.JTBRequest) (*batch, error) {
+	if err := os.MkdirAll(m.spoolDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	id := newBatchID()
+	spoolPath := filepath.Join(m.spoolDir, fmt.Sprintf("%v.spool", id))
+	spool, err := os.OpenFile(spoolPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	status := &data.BatchStatus{
+		BatchID:   id,
+		Table:     fmt.Sprintf("%v.%v.%v", request.ProjectID, request.DatasetName, request.TableName),
+		State:     StatePending,
+		CreatedAt: time.Now(),
+	}
+	m.statuses[id] = status
+	return &batch{status: status, spool: spool, spoolPath: spoolPath}, nil
+}
+
+// Removes the batch from its buffer so new records start a new batch, must be
+// called holding the lock
+func (m *Manager) detach(key string, b *batch) {
+	if buf, ok := m.buffers[key]; ok && buf.current == b {
+		buf.current = nil
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.status.State = StateFlushing
+}
+
+// Called by the batch timer, flushes the batch if it hasnt already been
+// flushed for hitting a size threshold
+func (m *Manager) flushIfCurrent(key string, b *batch) {
+	m.mu.Lock()
+	buf, ok := m.buffers[key]
+	if !ok || buf.current != b {
+		m.mu.Unlock()
+		return
+	}
+	m.detach(key, b)
+	m.mu.Unlock()
+	m.flush(buf, b)
+}
+
+// Merges the requests in the batch into one and runs it through the pipeline,
+// the spool file is only removed once the load succeeds. A server error is
+// retried with backoff until the batch loads, as the requests in it have
+// already been acknowledged. Any other error would fail the same way again, so
+// the spool file is renamed to .failed to keep it out of Recover
+func (m *Manager) flush(buf *buffer, b *batch) {
+	buf.flushLock.Lock()
+	defer buf.flushLock.Unlock()
+	b.spool.Close()
+
+	// THE BATCH IS LOGGED AS ONE INGESTION UNDER ITS OWN ID, ALONG WITH THE IDS
+	// OF THE REQUESTS IN IT
+	merged := *b.requests[0]
+	merged.Data = nil
+	merged.RequestID = b.status.BatchID
+	merged.MergedRequestIDs = nil
+	var callers []string
+	seenCallers := make(map[string]bool)
+	for _, request := range b.requests {
+		merged.Data = append(merged.Data, request.Data...)
+		if request.RequestID != "" {
+			merged.MergedRequestIDs = append(merged.MergedRequestIDs, request.RequestID)
+		}
+		if request.Caller != "" && !seenCallers[request.Caller] {
+			seenCallers[request.Caller] = true
+			callers = append(callers, request.Caller)
+		}
+	}
+	merged.Caller = strings.Join(callers, ",")
+	if merged.Caller == "" {
+		merged.Caller = "batch"
+	}
+	log.Printf("FLUSHING BATCH %v: %v ROWS FROM %v REQUESTS INTO %v", b.status.BatchID, len(merged.Data), len(b.requests), b.status.Table)
+	backoff := m.RetryBackoff
+	for {
+		// THE MERGED REQUEST KEEPS THE BATCH ID ACROSS ATTEMPTS, SO A LOAD JOB
+		// THAT WENT THROUGH BEFORE THE FAILURE IS PICKED UP INSTEAD OF RAN AGAIN
+		_, err := m.Run(&merged)
+
+		m.mu.Lock()
+		b.status.Attempts++
+		if err == nil {
+			now := time.Now()
+			b.status.FlushedAt = &now
+			b.status.State = StateFlushed
+			b.status.Error = ""
+			m.mu.Unlock()
+			if err := os.Remove(b.spoolPath); err != nil {
+				log.Printf("ERROR REMOVING SPOOL FILE %v: %v", b.spoolPath, err.Error())
+			}
+			return
+		}
+		b.status.Error = err.Error()
+		var pipelineErr *pipeline.Error
+		if errors.As(err, &pipelineErr) && pipelineErr.StatusCode < 500 {
+			now := time.Now()
+			b.status.FlushedAt = &now
+			b.status.State = StateFailed
+			m.mu.Unlock()
+			failedPath := strings.TrimSuffix(b.spoolPath, ".spool") + ".failed"
+			log.Printf("ERROR FLUSHING BATCH %v, MOVING SPOOL FILE TO %v: %v", b.status.BatchID, failedPath, err.Error())
+			if err := os.Rename(b.spoolPath, failedPath); err != nil {
+				log.Printf("ERROR MOVING SPOOL FILE %v: %v", b.spoolPath, err.Error())
+			}
+			return
+		}
+		m.mu.Unlock()
+
+		log.Printf("ERROR FLUSHING BATCH %v, RETRYING IN %v: %v", b.status.BatchID, backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > m.MaxRetryBackoff {
+			backoff = m.MaxRetryBackoff
+		}
+	}
+}
+
+// Drops the status of batches that finished longer ago than the retention,
+// must be called holding the lock
+func (m *Manager) pruneStatuses() {
+	for id, status := range m.statuses {
+		if status.FlushedAt != nil && time.Since(*status.FlushedAt) > statusRetention {
+			delete(m.statuses, id)
+		}
+	}
+}
+
+// Status Returns the status of a batch by its ID
+func (m *Manager) Status(batchID string) (data.BatchStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status, ok := m.statuses[batchID]
+	if !ok {
+		return data.BatchStatus{}, false
+	}
+	return *status, true
+}
+
+// Recover Flushes any batches left in the spool by a previous run of the
+// service, this should be called once at start up
+func (m *Manager) Recover() error {
+	files, err := ioutil.ReadDir(m.spoolDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".spool" {
+			continue
+		}
+		spoolPath := filepath.Join(m.spoolDir, f.Name())
+		requests, err := readSpool(spoolPath)
+		if err != nil {
+			log.Printf("ERROR READING SPOOL FILE %v: %v", spoolPath, err.Error())
+			continue
+		}
+		if len(requests) == 0 {
+			os.Remove(spoolPath)
+			continue
+		}
+		m.mu.Lock()
+		id := strings.TrimSuffix(f.Name(), ".spool")
+		status := &data.BatchStatus{
+			BatchID:   id,
+			Table:     fmt.Sprintf("%v.%v.%v", requests[0].ProjectID, requests[0].DatasetName, requests[0].TableName),
+			State:     StateFlushing,
+			Requests:  len(requests),
+			CreatedAt: f.ModTime(),
+		}
+		for _, request := range requests {
+			status.Rows += len(request.Data)
+		}
+		m.statuses[id] = status
+		key := batchKey(requests[0])
+		buf, ok := m.buffers[key]
+		if !ok {
+			buf = &buffer{}
+			m.buffers[key] = buf
+		}
+		m.mu.Unlock()
+
+		// THE SPOOL IS REOPENED SO FLUSH HAS SOMETHING TO CLOSE
+		spool, err := os.Open(spoolPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("RECOVERED BATCH %v FROM SPOOL WITH %v ROWS", id, status.Rows)
+		go m.flush(buf, &batch{status: status, requests: requests, spool: spool, spoolPath: spoolPath})
+	}
+	return nil
+}
+
+// Reads every request persisted to a spool file, a partially written last
+// line from a crash is skipped
+func readSpool(spoolPath string) ([]*data.JTBRequest, error) {
+	f, err := os.Open(spoolPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var requests []*data.JTBRequest
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			spooled := spooledRequest{JTBRequest: data.NewJTB()}
+			if jsonErr := json.Unmarshal(line, &spooled); jsonErr != nil {
+				log.Printf("SKIPPING INVALID SPOOL LINE IN %v: %v", spoolPath, jsonErr.Error())
+			} else {
+				spooled.Caller = spooled.SpoolCaller
+				requests = append(requests, spooled.JTBRequest)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return requests, nil
+}
@@ -0,0 +1,202 @@
+package batch
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+// Records the merged requests a manager flushes, failing with the errors in
+// order before it starts loading them
+type recordingRun struct {
+	mu     sync.Mutex
+	errs   []error
+	loaded []*data.JTBRequest
+}
+
+func (r *recordingRun) run(request *data.JTBRequest) (*pipeline.Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return nil, err
+	}
+	r.loaded = append(r.loaded, request)
+	return &pipeline.Result{Rows: len(request.Data)}, nil
+}
+
+func newTestManager(spoolDir string, maxRows int, maxWait time.Duration, run *recordingRun) *Manager {
+	m := NewManager(spoolDir, maxRows, 0, maxWait)
+	m.RetryBackoff, m.MaxRetryBackoff = time.Millisecond, 5*time.Millisecond
+	m.Run = run.run
+	return m
+}
+
+func testRequest(requestID string, records ...map[string]interface{}) *data.JTBRequest {
+	jtb := data.NewJTB()
+	jtb.RequestID, jtb.ProjectID, jtb.DatasetName, jtb.TableName, jtb.IdField = requestID, "project", "dataset", "events", "id"
+	jtb.Data = records
+	return jtb
+}
+
+// Waits for the batch to reach the state, failing the test if it takes too long
+func waitForState(t *testing.T, m *Manager, batchID, state string) data.BatchStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, ok := m.Status(batchID)
+		if ok && status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected batch %v to be %v, got %+v", batchID, state, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func spoolFiles(t *testing.T, spoolDir, pattern string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(spoolDir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFlushByRows(t *testing.T) {
+	run := &recordingRun{}
+	spoolDir := t.TempDir()
+	m := newTestManager(spoolDir, 3, time.Hour, run)
+
+	first, err := m.Add(testRequest("req-1", map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.State != StatePending || len(spoolFiles(t, spoolDir, "*.spool")) != 1 {
+		t.Fatalf("expected the request to be spooled and pending, got %+v", first)
+	}
+	second, err := m.Add(testRequest("req-2", map[string]interface{}{"id": 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.BatchID != first.BatchID {
+		t.Fatalf("expected both requests in the same batch, got %v and %v", first.BatchID, second.BatchID)
+	}
+
+	status := waitForState(t, m, first.BatchID, StateFlushed)
+	if status.Rows != 3 || status.Requests != 2 || status.Attempts != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if len(run.loaded) != 1 || len(run.loaded[0].Data) != 3 || run.loaded[0].RequestID != first.BatchID {
+		t.Fatalf("expected one merged request with every record, got %+v", run.loaded)
+	}
+	if ids := run.loaded[0].MergedRequestIDs; len(ids) != 2 || ids[0] != "req-1" || ids[1] != "req-2" {
+		t.Errorf("expected the merged request IDs, got %v", ids)
+	}
+	if files := spoolFiles(t, spoolDir, "*.spool"); len(files) != 0 {
+		t.Errorf("expected the spool file to be removed, got %v", files)
+	}
+}
+
+func TestFlushByAge(t *testing.T) {
+	run := &recordingRun{}
+	m := newTestManager(t.TempDir(), 100, 10*time.Millisecond, run)
+
+	status, err := m.Add(testRequest("req-1", map[string]interface{}{"id": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, m, status.BatchID, StateFlushed)
+
+	// THE NEXT REQUEST STARTS A NEW BATCH
+	next, err := m.Add(testRequest("req-2", map[string]interface{}{"id": 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.BatchID == status.BatchID {
+		t.Error("expected a new batch after the flush")
+	}
+	waitForState(t, m, next.BatchID, StateFlushed)
+}
+
+func TestFlushRetriesServerErrors(t *testing.T) {
+	run := &recordingRun{errs: []error{
+		&pipeline.Error{StatusCode: http.StatusInternalServerError, Err: errors.New("backend error")},
+		errors.New("connection reset"),
+	}}
+	spoolDir := t.TempDir()
+	m := newTestManager(spoolDir, 1, time.Hour, run)
+
+	status, err := m.Add(testRequest("req-1", map[string]interface{}{"id": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = waitForState(t, m, status.BatchID, StateFlushed)
+	if status.Attempts != 3 || status.Error != "" {
+		t.Errorf("expected the batch to load on the third attempt, got %+v", status)
+	}
+	if files := spoolFiles(t, spoolDir, "*"); len(files) != 0 {
+		t.Errorf("expected the spool file to be removed, got %v", files)
+	}
+}
+
+func TestFlushFailsOnClientErrors(t *testing.T) {
+	run := &recordingRun{errs: []error{&pipeline.Error{StatusCode: http.StatusConflict, Err: errors.New("type conflict")}}}
+	spoolDir := t.TempDir()
+	m := newTestManager(spoolDir, 1, time.Hour, run)
+
+	status, err := m.Add(testRequest("req-1", map[string]interface{}{"id": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = waitForState(t, m, status.BatchID, StateFailed)
+	if status.Attempts != 1 || status.Error == "" {
+		t.Errorf("expected the batch to fail without a retry, got %+v", status)
+	}
+	if files := spoolFiles(t, spoolDir, "*.spool"); len(files) != 0 {
+		t.Errorf("expected the failed batch to be left out of recovery, got %v", files)
+	}
+	if files := spoolFiles(t, spoolDir, status.BatchID+".failed"); len(files) != 1 {
+		t.Errorf("expected the spool file to be kept as .failed, got %v", files)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	spoolDir := t.TempDir()
+	m := newTestManager(spoolDir, 100, time.Hour, &recordingRun{})
+	status, err := m.Add(testRequest("req-1", map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A PARTIALLY WRITTEN LINE FROM A CRASH IS SKIPPED
+	f, err := os.OpenFile(filepath.Join(spoolDir, status.BatchID+".spool"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"RequestID": "req-2"`)
+	f.Close()
+
+	// A NEW MANAGER ON THE SAME SPOOL PICKS THE BATCH UP AS IF THE SERVICE RESTARTED
+	run := &recordingRun{}
+	recovered := newTestManager(spoolDir, 100, time.Hour, run)
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, recovered, status.BatchID, StateFlushed)
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if len(run.loaded) != 1 || len(run.loaded[0].Data) != 2 || run.loaded[0].MergedRequestIDs[0] != "req-1" {
+		t.Errorf("expected the spooled request to be loaded, got %+v", run.loaded)
+	}
+}
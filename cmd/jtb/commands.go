@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+// checkpoint The progress of a load, saved after every chunk so a failed
+// load can carry on from where it stopped
+type checkpoint struct {
+	Files   []string `json:"files"`
+	Records int      `json:"records"`
+}
+
+// Checks the required flags are set before any input is read
+func (r *requestFlags) check() error {
+	_, err := r.newRequest([]map[string]interface{}{{}})
+	return err
+}
+
+func (r *requestFlags) compression() data.JTBCompression {
+	return data.JTBCompression{Codec: r.codec, Level: r.compressionLevel, BlockLength: r.blockLength}
+}
+
+func (r *requestFlags) decimalFields() []string {
+	if r.decimals == "" {
+		return nil
+	}
+	return strings.Split(r.decimals, ",")
+}
+
+// Reads the field metadata from its file, if one was given
+func (r *requestFlags) fieldMetadata() (*data.JTBFieldMetadata, error) {
+	if r.fieldMetadataFile == "" {
+		return nil, nil
+	}
+	metadataJSON, err := ioutil.ReadFile(r.fieldMetadataFile)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &data.JTBFieldMetadata{}
+	if err = json.Unmarshal(metadataJSON, metadata); err != nil {
+		return nil, fmt.Errorf("invalid field metadata %v: %v", r.fieldMetadataFile, err.Error())
+	}
+	return metadata, nil
+}
+
+// Returns the caller recorded in the ingestion log for loads from the command
+// line
+func caller() string {
+	if current, err := user.Current(); err == nil {
+		return fmt.Sprintf("jtb:%v", current.Username)
+	}
+	return "jtb"
+}
+
+// Builds the request for a chunk of records from the flags and checks it the
+// same way the service would
+func (r *requestFlags) newRequest(records []map[string]interface{}) (*data.JTBRequest, error) {
+	fieldMetadata, err := r.fieldMetadata()
+	if err != nil {
+		return nil, err
+	}
+	jtb := &data.JTBRequest{
+		ProjectID:          r.projectID,
+		DatasetName:        r.datasetName,
+		TableName:          r.tableName,
+		IdField:            r.idField,
+		Query:              r.query,
+		TimestampFormat:    r.timestampFormat,
+		Compression:        r.compression(),
+		DecimalFields:      r.decimalFields(),
+		SchemaPolicy:       r.schemaPolicy,
+		TypeChangeStrategy: r.typeChangeStrategy,
+		FieldMetadata:      fieldMetadata,
+		KeepRaw:            r.keepRaw,
+		Data:               records,
+		Caller:             caller(),
+	}
+	if jtb.TimestampFormat == "" {
+		jtb.TimestampFormat = time.RFC3339
+	}
+	if err := jtb.Validate(); err != nil {
+		return nil, err
+	}
+	if err := jtb.CheckLimits(data.RequestLimits); err != nil {
+		return nil, err
+	}
+	return jtb, nil
+}
+
+func runLoad(args []string) error {
+	var (
+		req            requestFlags
+		chunkSize      int
+		checkpointPath string
+		fs             = flag.NewFlagSet("load", flag.ExitOnError)
+	)
+	req.register(fs)
+	fs.IntVar(&chunkSize, "chunk-size", 10000, "number of records loaded per load job")
+	fs.StringVar(&checkpointPath, "checkpoint", "", "file used to save progress so a failed load can be resumed, defaults to <first file>.checkpoint, stdin is only resumable if this is set")
+	fs.Parse(args)
+	if err := req.check(); err != nil {
+		return err
+	}
+	files := fs.Args()
+	if checkpointPath == "" && len(files) > 0 {
+		checkpointPath = files[0] + ".checkpoint"
+	}
+
+	// PICK UP FROM THE LAST SAVED CHUNK IF THERE IS A CHECKPOINT
+	progress := checkpoint{Files: files}
+	if checkpointPath != "" {
+		if saved, err := ioutil.ReadFile(checkpointPath); err == nil {
+			if err := json.Unmarshal(saved, &progress); err != nil {
+				return fmt.Errorf("invalid checkpoint %v: %v", checkpointPath, err.Error())
+			}
+			fmt.Fprintf(os.Stderr, "resuming from checkpoint %v, skipping %v records\n", checkpointPath, progress.Records)
+		}
+	}
+
+	reader := newRecordReader(files)
+	defer reader.Close()
+	for skipped := 0; skipped < progress.Records; skipped++ {
+		if _, err := reader.Next(); err != nil {
+			return fmt.Errorf("input is shorter than the checkpoint: %v", err)
+		}
+	}
+
+	clients, err := pipeline.NewClients(req.projectID)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	start := time.Now()
+	for chunkNumber := 1; ; chunkNumber++ {
+		records, err := reader.ReadChunk(chunkSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		jtb, err := req.newRequest(records)
+		if err != nil {
+			return fmt.Errorf("chunk %v starting at record %v: %v", chunkNumber, progress.Records, err)
+		}
+		result, err := pipeline.RunWithClients(clients, jtb)
+		if err != nil {
+			return fmt.Errorf("chunk %v starting at record %v: %v", chunkNumber, progress.Records, err)
+		}
+		progress.Records += len(records)
+		if checkpointPath != "" {
+			saved, _ := json.Marshal(progress)
+			if err := ioutil.WriteFile(checkpointPath, saved, 0644); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "chunk %v: loaded %v rows as request %v, %v rows total, %v elapsed\n", chunkNumber, result.Rows, jtb.RequestID, progress.Records, time.Since(start).Round(time.Second))
+		if result.Schema != nil && len(result.Schema.IgnoredFields)+len(result.Schema.QuarantinedFields) > 0 {
+			fmt.Fprintf(os.Stderr, "chunk %v: %v policy ignored %v, quarantined %v\n", chunkNumber, result.Schema.Policy, result.Schema.IgnoredFields, result.Schema.QuarantinedFields)
+		}
+		if result.Schema != nil {
+			for _, change := range result.Schema.TypeChanges {
+				fmt.Fprintf(os.Stderr, "chunk %v: %v changed from %v to %v, written to %v\n", chunkNumber, change.Field, change.From, change.To, change.Column)
+			}
+		}
+	}
+
+	// THE LOAD FINISHED SO THE CHECKPOINT IS NO LONGER NEEDED
+	if checkpointPath != "" {
+		os.Remove(checkpointPath)
+	}
+	fmt.Fprintf(os.Stderr, "loaded %v rows into %v.%v.%v\n", progress.Records, req.projectID, req.datasetName, req.tableName)
+	return nil
+}
+
+// Parses every record in the input the same way the service does, without
+// touching google cloud
+func parseInput(fs *flag.FlagSet, req *requestFlags, args []string) (avro.Schema, []map[string]interface{}, []map[string]interface{}, error) {
+	fs.Parse(args)
+	if err := req.check(); err != nil {
+		return avro.Schema{}, nil, nil, err
+	}
+	reader := newRecordReader(fs.Args())
+	defer reader.Close()
+	records, err := reader.ReadAll()
+	if err != nil {
+		return avro.Schema{}, nil, nil, err
+	}
+	if len(records) == 0 {
+		return avro.Schema{}, nil, nil, errors.New("no records in input")
+	}
+	jtb, err := req.newRequest(records)
+	if err != nil {
+		return avro.Schema{}, nil, nil, err
+	}
+	// THERE IS NO EXISTING SCHEMA SO THE POLICY LEAVES THE RECORDS AS THEY ARE
+	s, formattedData, listMappings, _, err := avro.ParseRequest(jtb, nil)
+	return s, formattedData, listMappings, err
+}
+
+func runInferSchema(args []string) error {
+	var (
+		req requestFlags
+		fs  = flag.NewFlagSet("infer-schema", flag.ExitOnError)
+	)
+	req.register(fs)
+	// THE SCHEMA CAN BE INFERRED WITHOUT A REAL PROJECT OR DATASET
+	req.projectID, req.datasetName = "local", "local"
+	s, _, _, err := parseInput(fs, &req, args)
+	if err != nil {
+		return err
+	}
+	schemaJSON, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(schemaJSON))
+	return nil
+}
+
+func runDryRun(args []string) error {
+	var (
+		req requestFlags
+		fs  = flag.NewFlagSet("dry-run", flag.ExitOnError)
+	)
+	req.register(fs)
+	s, formattedData, listMappings, err := parseInput(fs, &req, args)
+	if err != nil {
+		return err
+	}
+	staged, err := pipeline.StageRecords(req.tableName, s, formattedData, req.compression())
+	if err != nil {
+		return err
+	}
+	var logicalFields []string
+	for _, field := range s.Fields {
+		if field.LogicalType != "" {
+			logicalFields = append(logicalFields, fmt.Sprintf("%v:%v", field.Name, field.LogicalType))
+		}
+	}
+	fmt.Printf("table:            %v.%v.%v\n", req.projectID, req.datasetName, req.tableName)
+	fmt.Printf("rows:             %v\n", len(formattedData))
+	fmt.Printf("fields:           %v\n", len(s.Fields))
+	fmt.Printf("list mappings:    %v\n", len(listMappings))
+	fmt.Printf("staged file:      %v\n", staged.Name)
+	fmt.Printf("staged bytes:     %v\n", len(staged.Bytes))
+	if staged.Compression != nil {
+		fmt.Printf("compression:      %v %.2fx\n", staged.Compression.Codec, staged.Compression.Ratio)
+	}
+	fmt.Printf("logical fields:   %v\n", logicalFields)
+	fmt.Printf("renamed fields:   %v\n", s.FieldNames)
+	return nil
+}
+
+func runReplay(args []string) error {
+	var (
+		replay     data.ReplayRequest
+		from, to   string
+		requestIDs string
+		fs         = flag.NewFlagSet("replay", flag.ExitOnError)
+	)
+	fs.StringVar(&replay.ProjectID, "project", "", "GCP project the archived requests were loaded into (ProjectID)")
+	fs.StringVar(&replay.DatasetName, "dataset", "", "only replay requests that were loaded into this dataset (DatasetName)")
+	fs.StringVar(&replay.TableName, "table", "", "only replay requests that were loaded into this table (TableName)")
+	fs.StringVar(&from, "from", "", "RFC3339 time, only replay requests archived at or after it (From)")
+	fs.StringVar(&to, "to", "", "RFC3339 time, only replay requests archived at or before it (To)")
+	fs.StringVar(&requestIDs, "request-ids", "", "comma separated request IDs to replay (RequestIDs)")
+	fs.StringVar(&replay.TargetDatasetName, "target-dataset", "", "dataset to load the replayed requests into instead (TargetDatasetName)")
+	fs.StringVar(&replay.TargetTableName, "target-table", "", "table to load the replayed requests into instead (TargetTableName)")
+	fs.Parse(args)
+
+	var err error
+	if from != "" {
+		if replay.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return fmt.Errorf("invalid -from: %v", err)
+		}
+	}
+	if to != "" {
+		if replay.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return fmt.Errorf("invalid -to: %v", err)
+		}
+	}
+	if requestIDs != "" {
+		replay.RequestIDs = strings.Split(requestIDs, ",")
+	}
+	if err := replay.Validate(); err != nil {
+		return err
+	}
+
+	clients, err := pipeline.NewClients(replay.ProjectID)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	results, err := pipeline.Replay(clients, &replay)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Status != "success" {
+			failed++
+			fmt.Fprintf(os.Stderr, "request %v archived at %v: failed: %v\n", result.RequestID, result.ArchivedAt.Format(time.RFC3339), result.Error)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "request %v archived at %v: loaded %v rows into %v as request %v\n", result.RequestID, result.ArchivedAt.Format(time.RFC3339), result.Rows, result.Table, result.ReplayRequestID)
+	}
+	fmt.Fprintf(os.Stderr, "replayed %v archived requests, %v failed\n", len(results), failed)
+	if failed > 0 {
+		return fmt.Errorf("%v of %v replayed requests failed", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Command jtb loads local JSON or NDJSON files into BigQuery using the same
+// parsing, schema and gcp code paths as the HTTP service.
+//
+// Usage:
+//
+//	jtb load -project p -dataset d -table t -id-field id [flags] [file ...]
+//	jtb infer-schema -table t -id-field id [flags] [file ...]
+//	jtb dry-run -project p -dataset d -table t -id-field id [flags] [file ...]
+//	jtb replay -project p [-from t] [-to t] [-request-ids ids] [flags]
+//
+// With no files the records are read from stdin. Replay loads requests from
+// the payload archive again.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "load":
+		err = runLoad(os.Args[2:])
+	case "infer-schema":
+		err = runInferSchema(os.Args[2:])
+	case "dry-run":
+		err = runDryRun(os.Args[2:])
+	case "replay":
+		err = runReplay(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: jtb <command> [flags] [file ...]
+
+commands:
+  load          parse the records and load them into BigQuery in chunks
+  infer-schema  print the avro schema that would be generated for the records
+  dry-run       parse and encode the records without touching Google Cloud
+  replay        load archived requests again, by time range or request ID
+
+Files can be a JSON list of objects or newline delimited JSON, with no files
+the records are read from stdin. Run jtb <command> -h for the flags.`)
+}
+
+// requestFlags The flags that mirror the JTBRequest fields
+type requestFlags struct {
+	projectID          string
+	datasetName        string
+	tableName          string
+	idField            string
+	query              string
+	timestampFormat    string
+	codec              string
+	compressionLevel   int
+	blockLength        int
+	decimals           string
+	schemaPolicy       string
+	typeChangeStrategy string
+	fieldMetadataFile  string
+	keepRaw            bool
+}
+
+func (r *requestFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&r.projectID, "project", "", "GCP project that contains the BigQuery enviroment (ProjectID)")
+	fs.StringVar(&r.datasetName, "dataset", "", "dataset to load into, created if it does not exist (DatasetName)")
+	fs.StringVar(&r.tableName, "table", "", "table to load into, created if it does not exist (TableName)")
+	fs.StringVar(&r.idField, "id-field", "", "field that represents the id of each record (IdField)")
+	fs.StringVar(&r.query, "query", "", "query to run after each chunk is loaded (Query)")
+	fs.StringVar(&r.timestampFormat, "timestamp-format", "", "go time layout used to detect timestamps, defaults to RFC3339 (TimestampFormat)")
+	fs.StringVar(&r.codec, "codec", "", "codec the staged avro files are compressed with, null, deflate, snappy or zstd (Compression.Codec)")
+	fs.IntVar(&r.compressionLevel, "compression-level", 0, "compression level for the codec, 0 uses the default (Compression.Level)")
+	fs.IntVar(&r.blockLength, "block-length", 0, "number of records in each avro block, 0 uses the default (Compression.BlockLength)")
+	fs.StringVar(&r.decimals, "decimal-fields", "", "comma separated fields to load as NUMERIC decimals (DecimalFields)")
+	fs.StringVar(&r.schemaPolicy, "schema-policy", "", "how fields that are not in the table are handled, additive, strict, ignore-new or quarantine-new (SchemaPolicy)")
+	fs.StringVar(&r.typeChangeStrategy, "type-change-strategy", "", "how fields that change type are migrated, sibling, rewrite or reject (TypeChangeStrategy)")
+	fs.StringVar(&r.fieldMetadataFile, "field-metadata", "", "JSON file with the table description, labels and column descriptions and policy tags (FieldMetadata)")
+	fs.BoolVar(&r.keepRaw, "keep-raw", false, "keep the raw JSON of each record in the raw column (KeepRaw)")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// recordReader Streams records from a list of files, or stdin if there are
+// none, each file can be a JSON list of objects or newline delimited JSON
+type recordReader struct {
+	files   []string
+	current int
+	file    *os.File
+	dec     *json.Decoder
+	inList  bool
+}
+
+func newRecordReader(files []string) *recordReader {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	return &recordReader{files: files, current: -1}
+}
+
+// Opens the next file and works out if it is a JSON list or NDJSON
+func (r *recordReader) openNext() error {
+	if r.file != nil && r.file != os.Stdin {
+		r.file.Close()
+	}
+	r.current++
+	if r.current >= len(r.files) {
+		return io.EOF
+	}
+	name := r.files[r.current]
+	if name == "-" {
+		r.file = os.Stdin
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		r.file = f
+	}
+	buffered := bufio.NewReaderSize(r.file, 1<<20)
+	r.dec = json.NewDecoder(buffered)
+	r.inList = false
+	first, err := peekNonSpace(buffered)
+	if err == io.EOF {
+		return r.openNext()
+	}
+	if err != nil {
+		return err
+	}
+	if first == '[' {
+		if _, err := r.dec.Token(); err != nil {
+			return err
+		}
+		r.inList = true
+	}
+	return nil
+}
+
+// Returns the first non whitespace byte without consuming it
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// Next Returns the next record, or io.EOF once every file has been read
+func (r *recordReader) Next() (map[string]interface{}, error) {
+	for {
+		if r.dec == nil {
+			if err := r.openNext(); err != nil {
+				return nil, err
+			}
+		}
+		if r.inList && !r.dec.More() {
+			r.dec = nil
+			continue
+		}
+		rec := make(map[string]interface{})
+		err := r.dec.Decode(&rec)
+		if err == io.EOF {
+			r.dec = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", r.files[r.current], err.Error())
+		}
+		return rec, nil
+	}
+}
+
+// ReadChunk Returns up to size records, fewer means the input has run out
+func (r *recordReader) ReadChunk(size int) ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	for len(records) < size {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// ReadAll Returns every record left in the input
+func (r *recordReader) ReadAll() ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// Close Closes the file currently being read
+func (r *recordReader) Close() {
+	if r.file != nil && r.file != os.Stdin {
+		r.file.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Limits The limits applied to each request to stop a single payload from
+// exhausting memory or the stack, a limit of 0 or less disables that check
+type Limits struct {
+	MaxBodyBytes     int64
+	MaxRecords       int
+	MaxKeysPerRecord int
+	MaxDepth         int
+	MaxArrayLength   int
+	MaxStringLength  int
+}
+
+// RequestLimits The limits applied to every request, loaded from the env with
+// sensible defaults
+var RequestLimits = Limits{
+	MaxBodyBytes:     EnvInt64("JTB_MAX_BODY_BYTES", 32<<20),
+	MaxRecords:       int(EnvInt64("JTB_MAX_RECORDS", 100000)),
+	MaxKeysPerRecord: int(EnvInt64("JTB_MAX_KEYS_PER_RECORD", 10000)),
+	MaxDepth:         int(EnvInt64("JTB_MAX_DEPTH", 32)),
+	MaxArrayLength:   int(EnvInt64("JTB_MAX_ARRAY_LENGTH", 10000)),
+	MaxStringLength:  int(EnvInt64("JTB_MAX_STRING_LENGTH", 1<<20)),
+}
+
+// LimitError Returned when a request breaks one of the limits, includes the
+// index of the record and the path within it that caused it
+type LimitError struct {
+	RecordIndex int
+	Path        string
+	Message     string
+	StatusCode  int
+}
+
+func (e *LimitError) Error() string {
+	if e.RecordIndex < 0 {
+		return e.Message
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("record %v: %v", e.RecordIndex, e.Message)
+	}
+	return fmt.Sprintf("record %v at %v: %v", e.RecordIndex, e.Path, e.Message)
+}
+
+// CheckLimits Walks every record in the request and returns a LimitError for
+// the first record that breaks one of the limits
+func (j *JTBRequest) CheckLimits(limits Limits) error {
+	if limits.MaxRecords > 0 && len(j.Data) > limits.MaxRecords {
+		return &LimitError{
+			RecordIndex: -1,
+			Message:     fmt.Sprintf("request contains %v records, the limit is %v", len(j.Data), limits.MaxRecords),
+			StatusCode:  http.StatusRequestEntityTooLarge,
+		}
+	}
+	for i, rec := range j.Data {
+		keyCount := 0
+		if err := checkValue(rec, "", 1, &keyCount, limits); err != nil {
+			err.RecordIndex = i
+			return err
+		}
+	}
+	return nil
+}
+
+// Recursivly checks a value against the limits, counting keys as it goes
+func checkValue(value interface{}, path string, depth int, keyCount *int, limits Limits) *LimitError {
+	if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+		return &LimitError{Path: path, Message: fmt.Sprintf("nesting is deeper than the limit of %v", limits.MaxDepth), StatusCode: http.StatusBadRequest}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, nested := range v {
+			*keyCount++
+			nestedPath := k
+			if path != "" {
+				nestedPath = fmt.Sprintf("%v.%v", path, k)
+			}
+			if limits.MaxKeysPerRecord > 0 && *keyCount > limits.MaxKeysPerRecord {
+				return &LimitError{Path: nestedPath, Message: fmt.Sprintf("record has more than the limit of %v keys", limits.MaxKeysPerRecord), StatusCode: http.StatusBadRequest}
+			}
+			if err := checkValue(nested, nestedPath, depth+1, keyCount, limits); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if limits.MaxArrayLength > 0 && len(v) > limits.MaxArrayLength {
+			return &LimitError{Path: path, Message: fmt.Sprintf("array has %v items, the limit is %v", len(v), limits.MaxArrayLength), StatusCode: http.StatusBadRequest}
+		}
+		for i, nested := range v {
+			if err := checkValue(nested, fmt.Sprintf("%v[%v]", path, i), depth+1, keyCount, limits); err != nil {
+				return err
+			}
+		}
+	case string:
+		if limits.MaxStringLength > 0 && len(v) > limits.MaxStringLength {
+			return &LimitError{Path: path, Message: fmt.Sprintf("string is %v bytes, the limit is %v", len(v), limits.MaxStringLength), StatusCode: http.StatusBadRequest}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-playground/validator"
+)
+
+// JTBMultiRequest Request object for POST /multi, loads records into several
+// tables in the same project and dataset at once. Each table is ran as its own
+// request with its own request ID, AllOrNothing either loads every table or
+// none of them.
+type JTBMultiRequest struct {
+	RequestID    string          `json:"RequestID"`
+	Caller       string          `json:"-"`
+	ProjectID    string          `json:"ProjectID" validate:"required"`
+	DatasetName  string          `json:"DatasetName" validate:"required"`
+	AllOrNothing bool            `json:"AllOrNothing"`
+	Tables       []JTBTableEntry `json:"Tables" validate:"required,min=1,dive"`
+}
+
+// JTBTableEntry One of the tables in a JTBMultiRequest, the fields are the
+// same as a JTBRequest without the project and dataset
+type JTBTableEntry struct {
+	TableName          string                   `json:"TableName" validate:"required"`
+	IdField            string                   `json:"IdField" validate:"required"`
+	Query              string                   `json:"Query"`
+	Queries            []JTBQuery               `json:"Queries" validate:"dive"`
+	TimestampFormat    string                   `json:"TimestampFormat"`
+	Compression        JTBCompression           `json:"Compression"`
+	DecimalFields      []string                 `json:"DecimalFields"`
+	SchemaPolicy       string                   `json:"SchemaPolicy" validate:"omitempty,oneof=additive strict ignore-new quarantine-new"`
+	TypeChangeStrategy string                   `json:"TypeChangeStrategy" validate:"omitempty,oneof=sibling rewrite reject"`
+	FieldMetadata      *JTBFieldMetadata        `json:"FieldMetadata"`
+	KeepRaw            bool                     `json:"KeepRaw"`
+	Data               []map[string]interface{} `json:"Data" validate:"required"`
+}
+
+// Validate Validates using the tags on the struct, a table can only be in the
+// request once as the tables are loaded at the same time
+func (m *JTBMultiRequest) Validate() error {
+	if err := validator.New().Struct(m); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, entry := range m.Tables {
+		if seen[entry.TableName] {
+			return fmt.Errorf("TableName %v is in the request more than once", entry.TableName)
+		}
+		seen[entry.TableName] = true
+	}
+	return nil
+}
+
+// Requests Returns a JTBRequest for each table, the request IDs are the
+// request ID of the envelope followed by the table name
+func (m *JTBMultiRequest) Requests() []*JTBRequest {
+	requests := make([]*JTBRequest, 0, len(m.Tables))
+	for _, entry := range m.Tables {
+		requests = append(requests, &JTBRequest{
+			RequestID:          fmt.Sprintf("%v.%v", m.RequestID, entry.TableName),
+			Caller:             m.Caller,
+			ProjectID:          m.ProjectID,
+			DatasetName:        m.DatasetName,
+			TableName:          entry.TableName,
+			IdField:            entry.IdField,
+			Query:              entry.Query,
+			Queries:            entry.Queries,
+			TimestampFormat:    entry.TimestampFormat,
+			Compression:        entry.Compression,
+			DecimalFields:      entry.DecimalFields,
+			SchemaPolicy:       entry.SchemaPolicy,
+			TypeChangeStrategy: entry.TypeChangeStrategy,
+			FieldMetadata:      entry.FieldMetadata,
+			KeepRaw:            entry.KeepRaw,
+			Data:               entry.Data,
+		})
+	}
+	return requests
+}
+
+// LoadFromJSON Loads the struct values from a http.request body
+func (m *JTBMultiRequest) LoadFromJSON(r *http.Request) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(m)
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-playground/validator"
+)
+
+// ReplayRequest Request object for POST /replay, picks the archived requests
+// for the project to load again by time range, request ID and original table.
+// Target fields that are set replace the dataset or table the requests are
+// loaded into.
+type ReplayRequest struct {
+	ProjectID         string    `json:"ProjectID" validate:"required"`
+	DatasetName       string    `json:"DatasetName"`
+	TableName         string    `json:"TableName"`
+	From              time.Time `json:"From"`
+	To                time.Time `json:"To"`
+	RequestIDs        []string  `json:"RequestIDs"`
+	TargetDatasetName string    `json:"TargetDatasetName"`
+	TargetTableName   string    `json:"TargetTableName"`
+}
+
+// Validate Validates using the tags on the struct, then checks the archive is
+// narrowed down by time or request ID
+func (r *ReplayRequest) Validate() error {
+	if err := validator.New().Struct(r); err != nil {
+		return err
+	}
+	if r.From.IsZero() && r.To.IsZero() && len(r.RequestIDs) == 0 {
+		return errors.New("a From and To time range or a list of RequestIDs is required")
+	}
+	if !r.From.IsZero() && !r.To.IsZero() && r.To.Before(r.From) {
+		return errors.New("To is before From")
+	}
+	return nil
+}
+
+// Matches Returns true if a request archived at the time is one of the ones
+// being replayed
+func (r *ReplayRequest) Matches(projectID, datasetName, tableName, requestID string, archivedAt time.Time) bool {
+	if projectID != r.ProjectID || (r.DatasetName != "" && datasetName != r.DatasetName) || (r.TableName != "" && tableName != r.TableName) {
+		return false
+	}
+	if (!r.From.IsZero() && archivedAt.Before(r.From)) || (!r.To.IsZero() && archivedAt.After(r.To)) {
+		return false
+	}
+	if len(r.RequestIDs) == 0 {
+		return true
+	}
+	for _, id := range r.RequestIDs {
+		if id == requestID {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFromJSON Loads the struct values from a http.request body
+func (r *ReplayRequest) LoadFromJSON(req *http.Request) error {
+	defer req.Body.Close()
+	return json.NewDecoder(req.Body).Decode(r)
+}
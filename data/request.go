@@ -1,51 +1,120 @@
 package data
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/go-playground/validator"
 )
 
 // JTBRequest Request object, represents the request that you parse to this
 // service, validate:"required" tags mean the value has to be present in the
-// body.
+// body. RequestID identifies the request in the ingestion log and is generated
+// if it is blank, Caller is set by whatever received the request.
+// MergedRequestIDs are the IDs of the buffered requests a micro batch was
+// merged from.
 type JTBRequest struct {
-	ProjectID       string                   `json:"ProjectID" validate:"required"`
-	DatasetName     string                   `json:"DatasetName" validate:"required"`
-	TableName       string                   `json:"TableName" validate:"required"`
-	IdField         string                   `json:"IdField" validate:"required"`
-	Query           string                   `json:"Query"`
-	TimestampFormat string                   `json:"TimestampFormat"`
-	Data            []map[string]interface{} `json:"Data" validate:"required"`
+	RequestID          string                   `json:"RequestID"`
+	Caller             string                   `json:"-"`
+	MergedRequestIDs   []string                 `json:"-"`
+	ProjectID          string                   `json:"ProjectID" validate:"required"`
+	DatasetName        string                   `json:"DatasetName" validate:"required"`
+	TableName          string                   `json:"TableName" validate:"required"`
+	IdField            string                   `json:"IdField" validate:"required"`
+	Query              string                   `json:"Query"`
+	Queries            []JTBQuery               `json:"Queries" validate:"dive"`
+	TimestampFormat    string                   `json:"TimestampFormat"`
+	Buffer             bool                     `json:"Buffer"`
+	Compression        JTBCompression           `json:"Compression"`
+	DecimalFields      []string                 `json:"DecimalFields"`
+	SchemaPolicy       string                   `json:"SchemaPolicy" validate:"omitempty,oneof=additive strict ignore-new quarantine-new"`
+	TypeChangeStrategy string                   `json:"TypeChangeStrategy" validate:"omitempty,oneof=sibling rewrite reject"`
+	FieldMetadata      *JTBFieldMetadata        `json:"FieldMetadata"`
+	KeepRaw            bool                     `json:"KeepRaw"`
+	Routing            *JTBRouting              `json:"Routing"`
+	Data               []map[string]interface{} `json:"Data" validate:"required"`
 }
 
-// ExecuteQuery Executes the query in the request assuming it is not blank
-func (j *JTBRequest) ExecuteQuery() error {
-	if j.Query != "" {
-		ctx := context.Background()
-		defer ctx.Done()
-		client, err := bigquery.NewClient(ctx, j.ProjectID)
-		defer client.Close()
-		if err != nil {
-			return err
-		}
-		q := client.Query(j.Query)
-		q.Location = "US"
-		job, err := q.Run(ctx)
-		if err != nil {
-			return err
-		}
-		_, err = job.Wait(ctx)
-		if err != nil {
-			return err
+// JTBQuery A single statement to run after the load, along with the job
+// options used to run it.
+type JTBQuery struct {
+	SQL                string `json:"SQL" validate:"required"`
+	MaximumBytesBilled int64  `json:"MaximumBytesBilled" validate:"min=0"`
+	MaxDryRunBytes     int64  `json:"MaxDryRunBytes" validate:"min=0"`
+	Priority           string `json:"Priority" validate:"omitempty,oneof=BATCH INTERACTIVE"`
+	DestinationTable   string `json:"DestinationTable"`
+	ContinueOnError    bool   `json:"ContinueOnError"`
+}
+
+// JTBFieldMetadata Governance metadata for the table and its columns, only
+// the parts that are set are applied, so columns that arent mentioned are left
+// as they are
+type JTBFieldMetadata struct {
+	TableDescription string                       `json:"TableDescription"`
+	Labels           map[string]string            `json:"Labels"`
+	Columns          map[string]JTBColumnMetadata `json:"Columns"`
+}
+
+// JTBColumnMetadata The description and policy tags for a column, keyed by
+// the JSON key or the column name in JTBFieldMetadata
+type JTBColumnMetadata struct {
+	Description string   `json:"Description"`
+	PolicyTags  []string `json:"PolicyTags"`
+}
+
+// JTBCompression How the staged avro files for the table are compressed, blank
+// values use the defaults from the env
+type JTBCompression struct {
+	Codec       string `json:"Codec" validate:"omitempty,oneof=null deflate snappy zstd zstandard"`
+	Level       int    `json:"Level" validate:"min=0,max=22"`
+	BlockLength int    `json:"BlockLength" validate:"min=0"`
+}
+
+// WithDefaults Returns the compression with any blank values filled in from
+// the env, the default level is only used with the default codec
+func (c JTBCompression) WithDefaults() JTBCompression {
+	if c.Codec == "" {
+		c.Codec = AvroCodec
+		if c.Level == 0 {
+			c.Level = int(AvroCompressionLevel)
 		}
-		return nil
-	} else {
-		return nil
 	}
+	if c.Codec == "zstd" {
+		c.Codec = "zstandard"
+	}
+	if c.BlockLength == 0 {
+		c.BlockLength = int(AvroBlockLength)
+	}
+	return c
+}
+
+// Checks the level is valid for the codec, the tags only check the widest
+// range
+func (c JTBCompression) checkLevel() error {
+	if (c.Codec == "deflate" && c.Level > 9) || ((c.Codec == "null" || c.Codec == "snappy") && c.Level != 0) {
+		return fmt.Errorf("compression level %v is not valid for the %v codec", c.Level, c.Codec)
+	}
+	return nil
+}
+
+// Statements Returns the ordered list of statements to run after the load, the
+// legacy Query field is ran first with default settings if it is not blank
+func (j *JTBRequest) Statements() []JTBQuery {
+	var statements []JTBQuery
+	if j.Query != "" {
+		statements = append(statements, JTBQuery{SQL: j.Query})
+	}
+	return append(statements, j.Queries...)
+}
+
+// NewRequestID Returns a random ID for a request that wasnt sent with one
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 // NewJTB Constructor function, returns blank JTBRequest to have json loaded into it
@@ -56,7 +125,15 @@ func NewJTB() *JTBRequest {
 // Validate Validates using the tags on the struct
 func (j *JTBRequest) Validate() error {
 	v := validator.New()
-	return v.Struct(j)
+	if err := v.Struct(j); err != nil {
+		return err
+	}
+	if j.Routing != nil {
+		if err := j.Routing.Validate(); err != nil {
+			return err
+		}
+	}
+	return j.Compression.checkLevel()
 }
 
 // LoadFromJSON Loads the struct values from a http.request body
@@ -4,12 +4,98 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 )
 
 // Response represents a basic http json response
 type Response struct {
-	Status  string `json:"status"`
-	Content string `json:"content"`
+	Status      string            `json:"status"`
+	Content     string            `json:"content"`
+	RequestID   string            `json:"requestId,omitempty"`
+	Queries     []QueryResult     `json:"queries,omitempty"`
+	Batch       *BatchStatus      `json:"batch,omitempty"`
+	Compression *CompressionStats `json:"compression,omitempty"`
+	Schema      *SchemaChanges    `json:"schema,omitempty"`
+	Replays     []ReplayResult    `json:"replays,omitempty"`
+	Tables      []TableResult     `json:"tables,omitempty"`
+}
+
+// SchemaChanges represents how the schema policy for the table handled fields
+// in the records, new fields are either added, ignored or quarantined, and
+// how fields that changed type were migrated
+type SchemaChanges struct {
+	Policy            string       `json:"policy"`
+	AddedFields       []string     `json:"addedFields,omitempty"`
+	IgnoredFields     []string     `json:"ignoredFields,omitempty"`
+	QuarantinedFields []string     `json:"quarantinedFields,omitempty"`
+	TypeChanges       []TypeChange `json:"typeChanges,omitempty"`
+}
+
+// TypeChange represents a field that got values of a different type to its
+// column, and the column the values were written to
+type TypeChange struct {
+	Field  string `json:"field"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Column string `json:"column"`
+}
+
+// CompressionStats represents how well the staged avro file compressed, the
+// uncompressed size is the size of the avro encoded records
+type CompressionStats struct {
+	Codec             string  `json:"codec"`
+	UncompressedBytes int64   `json:"uncompressedBytes"`
+	CompressedBytes   int64   `json:"compressedBytes"`
+	Ratio             float64 `json:"ratio"`
+}
+
+// BatchStatus represents the state of a micro batch that buffered records are
+// waiting in
+type BatchStatus struct {
+	BatchID   string     `json:"batchId"`
+	Table     string     `json:"table"`
+	State     string     `json:"state"`
+	Requests  int        `json:"requests"`
+	Rows      int        `json:"rows"`
+	CreatedAt time.Time  `json:"createdAt"`
+	FlushedAt *time.Time `json:"flushedAt,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// TableResult represents the outcome of loading one of the tables in a multi
+// table request, the status code is the one it would have got on its own
+type TableResult struct {
+	Table       string            `json:"table"`
+	RequestID   string            `json:"requestId"`
+	Status      string            `json:"status"`
+	StatusCode  int               `json:"statusCode"`
+	Rows        int               `json:"rows"`
+	Error       string            `json:"error,omitempty"`
+	Queries     []QueryResult     `json:"queries,omitempty"`
+	Compression *CompressionStats `json:"compression,omitempty"`
+	Schema      *SchemaChanges    `json:"schema,omitempty"`
+}
+
+// ReplayResult represents the outcome of loading one archived request again,
+// the new request ID is the one it was logged under in the ingestion log
+type ReplayResult struct {
+	RequestID       string    `json:"requestId"`
+	ReplayRequestID string    `json:"replayRequestId"`
+	ArchivedAt      time.Time `json:"archivedAt"`
+	Table           string    `json:"table"`
+	Rows            int       `json:"rows"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// QueryResult represents the outcome of one of the post load statements
+type QueryResult struct {
+	SQL            string `json:"sql"`
+	JobID          string `json:"jobId,omitempty"`
+	DryRunBytes    int64  `json:"dryRunBytes,omitempty"`
+	BytesProcessed int64  `json:"bytesProcessed"`
+	Error          string `json:"error,omitempty"`
 }
 
 // NewResponse is a contstructor func to return a new response object
@@ -25,7 +111,12 @@ func (r *Response) ToJSON() ([]byte, error) {
 // RespondWithJSON Takes a responseWriter, status, message, and error code, and
 // responds to the http call.
 func RespondWithJSON(w http.ResponseWriter, status, message string, httpErrorCode int) {
-	r := NewResponse(status, message)
+	NewResponse(status, message).Respond(w, httpErrorCode)
+}
+
+// Respond Writes the response struct to the responseWriter with the passed
+// error code
+func (r *Response) Respond(w http.ResponseWriter, httpErrorCode int) {
 	responseJSON, err := r.ToJSON()
 	if err != nil {
 		log.Fatalf("Could not marshal JSON: %#v", r)
@@ -0,0 +1,89 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// Route The target table for records that arrive without a JTBRequest around
+// them, such as messages from a Pub/Sub subscription or a Kafka topic
+type Route struct {
+	ProjectID          string            `json:"ProjectID"`
+	DatasetName        string            `json:"DatasetName"`
+	TableName          string            `json:"TableName"`
+	IdField            string            `json:"IdField"`
+	TimestampFormat    string            `json:"TimestampFormat"`
+	Buffer             bool              `json:"Buffer"`
+	Compression        JTBCompression    `json:"Compression"`
+	DecimalFields      []string          `json:"DecimalFields"`
+	SchemaPolicy       string            `json:"SchemaPolicy"`
+	TypeChangeStrategy string            `json:"TypeChangeStrategy"`
+	FieldMetadata      *JTBFieldMetadata `json:"FieldMetadata"`
+	KeepRaw            bool              `json:"KeepRaw"`
+	Routing            *JTBRouting       `json:"Routing"`
+}
+
+// LoadRoutes Loads routes keyed by name from a JSON file, a blank file name
+// returns no routes
+func LoadRoutes(routesFile string) map[string]Route {
+	routes := make(map[string]Route)
+	if routesFile == "" {
+		return routes
+	}
+	routesData, err := ioutil.ReadFile(routesFile)
+	if err != nil {
+		log.Printf("ERROR READING ROUTES FILE %v: %v", routesFile, err.Error())
+		return routes
+	}
+	if err = json.Unmarshal(routesData, &routes); err != nil {
+		log.Printf("ERROR PARSING ROUTES FILE %v: %v", routesFile, err.Error())
+	}
+	return routes
+}
+
+// NewRequest Returns a JTBRequest for the routes table with the records as
+// its data
+func (r Route) NewRequest(records []map[string]interface{}) *JTBRequest {
+	return &JTBRequest{
+		ProjectID:          r.ProjectID,
+		DatasetName:        r.DatasetName,
+		TableName:          r.TableName,
+		IdField:            r.IdField,
+		TimestampFormat:    r.TimestampFormat,
+		Buffer:             r.Buffer,
+		Compression:        r.Compression,
+		DecimalFields:      r.DecimalFields,
+		SchemaPolicy:       r.SchemaPolicy,
+		TypeChangeStrategy: r.TypeChangeStrategy,
+		FieldMetadata:      r.FieldMetadata,
+		KeepRaw:            r.KeepRaw,
+		Routing:            r.Routing,
+		Data:               records,
+	}
+}
+
+// DecodeRecords Decodes a message body that is either a single JSON object or
+// a list of JSON objects into records
+func DecodeRecords(body []byte) ([]map[string]interface{}, error) {
+	trimmed := strings.TrimSpace(string(body))
+	switch {
+	case strings.HasPrefix(trimmed, "["):
+		var records []map[string]interface{}
+		if err := json.Unmarshal(body, &records); err != nil {
+			return nil, fmt.Errorf("message data is invalid: %v", err.Error())
+		}
+		return records, nil
+	case strings.HasPrefix(trimmed, "{"):
+		rec := make(map[string]interface{})
+		if err := json.Unmarshal(body, &rec); err != nil {
+			return nil, fmt.Errorf("message data is invalid: %v", err.Error())
+		}
+		return []map[string]interface{}{rec}, nil
+	default:
+		return nil, errors.New("message data must be a JSON object or list of objects")
+	}
+}
@@ -0,0 +1,188 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Characters that cant be used in a table name
+var invalidTableNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// The longest table name BigQuery allows
+const maxTableNameLength = 1024
+
+// Returns true if the table is one the service writes to itself, the
+// ListMappings table, the _jtb_ tables such as the ingestion log and the
+// snapshots taken before a column is rewritten, records cant be routed to them
+func reservedTableName(table string) bool {
+	return strings.EqualFold(table, "ListMappings") || strings.HasPrefix(strings.ToLower(table), "_jtb_") || strings.Contains(table, "__snapshot_")
+}
+
+// JTBRouting Picks the table each record is loaded into from its contents,
+// the rules are tried in order and the first one that matches the record
+// decides the table. Records that no rule matches go to Default, or the
+// TableName of the request if that is blank. AllOrNothing either loads every
+// table or none of them.
+type JTBRouting struct {
+	Rules        []JTBRoutingRule `json:"Rules" validate:"dive"`
+	Default      string           `json:"Default"`
+	AllOrNothing bool             `json:"AllOrNothing"`
+}
+
+// JTBRoutingRule One routing rule, it matches records that have the Field,
+// and if Values is set only the records where the field is one of them. The
+// table is Table if it is set, otherwise the Template rendered with the
+// record, such as events_{{.event_type}}, otherwise the value of the field.
+type JTBRoutingRule struct {
+	Field    string   `json:"Field"`
+	Values   []string `json:"Values"`
+	Table    string   `json:"Table"`
+	Template string   `json:"Template"`
+}
+
+// Validate Checks every rule can match a record, every template parses and
+// no table set in the routing is reserved or too long
+func (r *JTBRouting) Validate() error {
+	if reservedTableName(r.Default) {
+		return fmt.Errorf("routing Default %v is a reserved table name", r.Default)
+	}
+	if len(r.Default) > maxTableNameLength {
+		return fmt.Errorf("routing Default is longer than the limit of %v characters", maxTableNameLength)
+	}
+	for i, rule := range r.Rules {
+		if reservedTableName(rule.Table) {
+			return fmt.Errorf("routing rule %v has the reserved table name %v", i+1, rule.Table)
+		}
+		if len(rule.Table) > maxTableNameLength {
+			return fmt.Errorf("routing rule %v has a Table longer than the limit of %v characters", i+1, maxTableNameLength)
+		}
+		if rule.Field == "" && rule.Template == "" {
+			return fmt.Errorf("routing rule %v needs a Field or a Template", i+1)
+		}
+		if len(rule.Values) > 0 && rule.Field == "" {
+			return fmt.Errorf("routing rule %v has Values but no Field", i+1)
+		}
+		if _, err := rule.template(); err != nil {
+			return fmt.Errorf("routing rule %v has an invalid Template: %v", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// Parses the template of the rule, a missing key is an error so the rule
+// doesnt match records without it
+func (r JTBRoutingRule) template() (*template.Template, error) {
+	if r.Template == "" {
+		return nil, nil
+	}
+	return template.New("table").Option("missingkey=error").Parse(r.Template)
+}
+
+// Returns the table the rule routes the record to, or false if it doesnt
+// match the record
+func (r JTBRoutingRule) route(tmpl *template.Template, record map[string]interface{}) (string, bool) {
+	var value interface{}
+	if r.Field != "" {
+		var ok bool
+		if value, ok = record[r.Field]; !ok || value == nil {
+			return "", false
+		}
+		if len(r.Values) > 0 && !containsValue(r.Values, fmt.Sprint(value)) {
+			return "", false
+		}
+	}
+	var table string
+	switch {
+	case r.Table != "":
+		table = r.Table
+	case tmpl != nil:
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, record); err != nil {
+			return "", false
+		}
+		table = b.String()
+	default:
+		table = fmt.Sprint(value)
+	}
+	table = invalidTableNameChars.ReplaceAllString(table, "_")
+	return table, table != ""
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteRecords Splits the request into a request per table the records are
+// routed to, in the order each table was first routed to. Each request keeps
+// the settings of this one apart from the post load statements, which should
+// be ran once after all of them, and gets the request ID of this one followed
+// by its table name. A record routed to a reserved table name, a name longer
+// than BigQuery allows or more tables than MaxRoutedTables fails the whole
+// request
+func (j *JTBRequest) RouteRecords() ([]*JTBRequest, error) {
+	if j.Routing == nil {
+		return nil, errors.New("request has no routing")
+	}
+	templates := make([]*template.Template, len(j.Routing.Rules))
+	for i, rule := range j.Routing.Rules {
+		tmpl, err := rule.template()
+		if err != nil {
+			return nil, err
+		}
+		templates[i] = tmpl
+	}
+	defaultTable := j.Routing.Default
+	if defaultTable == "" {
+		defaultTable = j.TableName
+	}
+	maxTables := MaxRoutedTables
+	if maxTables <= 0 {
+		maxTables = defaultMaxRoutedTables
+	}
+
+	var (
+		requests []*JTBRequest
+		byTable  = make(map[string]*JTBRequest)
+	)
+	for _, record := range j.Data {
+		table := defaultTable
+		for i, rule := range j.Routing.Rules {
+			if routed, ok := rule.route(templates[i], record); ok {
+				table = routed
+				break
+			}
+		}
+		request, ok := byTable[table]
+		if !ok {
+			if reservedTableName(table) {
+				return nil, fmt.Errorf("records are routed to the reserved table name %v", table)
+			}
+			if len(table) > maxTableNameLength {
+				return nil, fmt.Errorf("records are routed to a table name longer than the limit of %v characters", maxTableNameLength)
+			}
+			if len(requests) == maxTables {
+				return nil, fmt.Errorf("records are routed to more than the limit of %v tables", maxTables)
+			}
+			routed := *j
+			routed.RequestID = fmt.Sprintf("%v.%v", j.RequestID, table)
+			routed.TableName = table
+			routed.Query, routed.Queries = "", nil
+			routed.Routing = nil
+			routed.Data = nil
+			request = &routed
+			byTable[table] = request
+			requests = append(requests, request)
+		}
+		request.Data = append(request.Data, record)
+	}
+	return requests, nil
+}
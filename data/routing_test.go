@@ -0,0 +1,102 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func routedRequest(routing *JTBRouting, records ...map[string]interface{}) *JTBRequest {
+	return &JTBRequest{RequestID: "req", ProjectID: "project", DatasetName: "dataset", TableName: "events", IdField: "id", Routing: routing, Data: records}
+}
+
+func TestRouteRecords(t *testing.T) {
+	routing := &JTBRouting{Rules: []JTBRoutingRule{
+		{Field: "priority", Values: []string{"high"}, Table: "events_priority"},
+		{Template: "events_{{.type}}"},
+	}}
+	requests, err := routedRequest(routing,
+		map[string]interface{}{"id": 1, "priority": "high", "type": "click"},
+		map[string]interface{}{"id": 2, "type": "page view"},
+		map[string]interface{}{"id": 3},
+		map[string]interface{}{"id": 4, "type": "page view"},
+	).RouteRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"events_priority": 1, "events_page_view": 2, "events": 1}
+	if len(requests) != len(want) {
+		t.Fatalf("expected %v tables, got %v", len(want), len(requests))
+	}
+	for _, request := range requests {
+		if len(request.Data) != want[request.TableName] {
+			t.Errorf("expected %v records in %v, got %v", want[request.TableName], request.TableName, len(request.Data))
+		}
+		if request.RequestID != "req."+request.TableName || request.Routing != nil {
+			t.Errorf("unexpected request for %v: %+v", request.TableName, request)
+		}
+	}
+}
+
+func TestRouteRecordsRejectsReservedTables(t *testing.T) {
+	for _, table := range []string{"ListMappings", "listmappings", "_jtb_ingestion_log", "events__snapshot_20210101000000"} {
+		_, err := routedRequest(&JTBRouting{Rules: []JTBRoutingRule{{Field: "table"}}}, map[string]interface{}{"id": 1, "table": table}).RouteRecords()
+		if err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Errorf("expected records routed to %v to be rejected, got %v", table, err)
+		}
+	}
+
+	for _, routing := range []*JTBRouting{
+		{Default: "ListMappings"},
+		{Rules: []JTBRoutingRule{{Field: "type", Table: "_jtb_ingestion_log"}}},
+	} {
+		if err := routing.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", routing)
+		}
+	}
+}
+
+func TestRouteRecordsRejectsLongTableNames(t *testing.T) {
+	long := strings.Repeat("t", maxTableNameLength+1)
+	_, err := routedRequest(&JTBRouting{Rules: []JTBRoutingRule{{Field: "table"}}}, map[string]interface{}{"id": 1, "table": long}).RouteRecords()
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("expected records routed to a table name over the limit to be rejected, got %v", err)
+	}
+	if _, err := routedRequest(&JTBRouting{Rules: []JTBRoutingRule{{Field: "table"}}}, map[string]interface{}{"id": 1, "table": long[1:]}).RouteRecords(); err != nil {
+		t.Errorf("expected a table name at the limit to be routed, got %v", err)
+	}
+
+	for _, routing := range []*JTBRouting{
+		{Default: long},
+		{Rules: []JTBRoutingRule{{Field: "type", Table: long}}},
+	} {
+		if err := routing.Validate(); err == nil {
+			t.Errorf("expected a routing with a table name over the limit to be invalid")
+		}
+	}
+}
+
+func TestRouteRecordsLimitsTables(t *testing.T) {
+	maxRoutedTables := MaxRoutedTables
+	defer func() { MaxRoutedTables = maxRoutedTables }()
+
+	// THERE IS ALWAYS A LIMIT, 0 USES THE DEFAULT
+	for _, limit := range []int{2, 0} {
+		MaxRoutedTables = limit
+		want := limit
+		if want == 0 {
+			want = defaultMaxRoutedTables
+		}
+		var records []map[string]interface{}
+		for i := 0; i <= want; i++ {
+			records = append(records, map[string]interface{}{"id": i, "table": fmt.Sprintf("events_%v", i)})
+		}
+		routing := &JTBRouting{Rules: []JTBRoutingRule{{Field: "table"}}}
+		if _, err := routedRequest(routing, records...).RouteRecords(); err == nil || !strings.Contains(err.Error(), "limit") {
+			t.Errorf("expected %v tables to go over a limit of %v, got %v", len(records), limit, err)
+		}
+		if requests, err := routedRequest(routing, records[:want]...).RouteRecords(); err != nil || len(requests) != want {
+			t.Errorf("expected %v tables to be routed with a limit of %v, got %v tables, %v", want, limit, len(requests), err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package data
 
 import (
+	"log"
 	"os"
+	"strconv"
 )
 
 // Static global variables
@@ -10,4 +12,214 @@ var (
 	BucketName = "jtb-source-structures"
 	// CredsFilePath Gets the file path for the key.json from the env
 	CredsFilePath = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	// StagingBackend Where the staged files are kept, either gcs for the
+	// BucketName bucket or local for StagingRoot on the local filesystem
+	StagingBackend = EnvString("JTB_STAGING_BACKEND", "gcs")
+	// StagingRoot The folder staged files are kept under when StagingBackend is
+	// local
+	StagingRoot = EnvString("JTB_STAGING_ROOT", "staging")
+	// StagingFormat The format records are staged and loaded in, either avro
+	// or parquet
+	StagingFormat = EnvString("JTB_STAGING_FORMAT", "avro")
+	// AvroCodec The codec staged avro files are compressed with when the
+	// request doesnt set one, null, deflate, snappy or zstandard
+	AvroCodec = EnvString("JTB_AVRO_CODEC", "snappy")
+	// AvroCompressionLevel The compression level used with AvroCodec, 0 uses
+	// the codecs default level
+	AvroCompressionLevel = EnvInt64("JTB_AVRO_COMPRESSION_LEVEL", 0)
+	// AvroBlockLength The number of records in each block of a staged avro
+	// file
+	AvroBlockLength = EnvInt64("JTB_AVRO_BLOCK_LENGTH", 100)
+	// WarehouseBackend Where the records are loaded, either bigquery, sqlite
+	// or postgres
+	WarehouseBackend = EnvString("JTB_WAREHOUSE", "bigquery")
+	// WarehouseDSN The data source name used to open the sqlite or postgres
+	// warehouse
+	WarehouseDSN = EnvString("JTB_WAREHOUSE_DSN", "")
 )
+
+// Worker pool and admission control settings, loaded from the env
+var (
+	// WorkerPoolSize The number of workers shared by every request for parsing
+	// and encoding records
+	WorkerPoolSize = int(EnvInt64("JTB_WORKER_POOL_SIZE", 100))
+	// MaxConcurrentRequests The number of requests allowed to be processed at
+	// once, anything over this is queued
+	MaxConcurrentRequests = int(EnvInt64("JTB_MAX_CONCURRENT_REQUESTS", 8))
+	// MaxQueuedRequests The number of requests allowed to wait for a slot
+	// before new ones are turned away with a 429
+	MaxQueuedRequests = int(EnvInt64("JTB_MAX_QUEUED_REQUESTS", 64))
+	// QueueTimeoutSeconds How long a queued request waits for a slot before it
+	// is turned away with a 429
+	QueueTimeoutSeconds = int(EnvInt64("JTB_QUEUE_TIMEOUT_SECONDS", 30))
+)
+
+// Micro batching settings, loaded from the env
+var (
+	// BatchMaxRows The number of buffered rows for a table that triggers a flush
+	BatchMaxRows = int(EnvInt64("JTB_BATCH_MAX_ROWS", 10000))
+	// BatchMaxBytes The size in bytes of the buffered records for a table that
+	// triggers a flush
+	BatchMaxBytes = EnvInt64("JTB_BATCH_MAX_BYTES", 10<<20)
+	// BatchMaxWaitSeconds How long records are buffered before they are flushed
+	// regardless of size
+	BatchMaxWaitSeconds = int(EnvInt64("JTB_BATCH_MAX_WAIT_SECONDS", 60))
+	// BatchSpoolDir The local folder buffered records are persisted to so they
+	// survive a crash
+	BatchSpoolDir = EnvString("JTB_BATCH_SPOOL_DIR", "spool")
+	// BatchRetryBackoffSeconds How long to wait before flushing a batch that
+	// failed with a server error again, doubled after every failure
+	BatchRetryBackoffSeconds = int(EnvInt64("JTB_BATCH_RETRY_BACKOFF_SECONDS", 5))
+	// BatchMaxRetryBackoffSeconds The longest wait between flushes of a failing
+	// batch
+	BatchMaxRetryBackoffSeconds = int(EnvInt64("JTB_BATCH_MAX_RETRY_BACKOFF_SECONDS", 300))
+)
+
+// Source consumer settings, loaded from the env
+var (
+	// SourceMaxRecords The number of records fetched for a topic that triggers
+	// a load
+	SourceMaxRecords = int(EnvInt64("JTB_SOURCE_MAX_RECORDS", 10000))
+	// SourceMaxWaitSeconds How long records fetched for a topic wait before
+	// they are loaded regardless of size
+	SourceMaxWaitSeconds = int(EnvInt64("JTB_SOURCE_MAX_WAIT_SECONDS", 30))
+	// SourceMaxRetries How many times a batch that fails with a server error is
+	// retried before the consumer stops without committing it, 0 retries it
+	// until it loads
+	SourceMaxRetries = int(EnvInt64("JTB_SOURCE_MAX_RETRIES", 0))
+	// SourceMaxRetryBackoffSeconds The longest wait between loads of a batch
+	// that keeps failing with a server error
+	SourceMaxRetryBackoffSeconds = int(EnvInt64("JTB_SOURCE_MAX_RETRY_BACKOFF_SECONDS", 300))
+	// SourceDeadLetterDir The local folder messages that can never be loaded
+	// are written to before they are committed
+	SourceDeadLetterDir = EnvString("JTB_SOURCE_DEAD_LETTER_DIR", "deadletter")
+	// KafkaBrokers Comma separated Kafka brokers to consume from, the consumer
+	// only runs if this is set
+	KafkaBrokers = EnvString("JTB_KAFKA_BROKERS", "")
+	// KafkaGroupID The consumer group offsets are committed to
+	KafkaGroupID = EnvString("JTB_KAFKA_GROUP_ID", "json-to-bigquery")
+	// KafkaRoutesFile JSON file of the table each topic is loaded into, keyed
+	// by topic
+	KafkaRoutesFile = EnvString("JTB_KAFKA_ROUTES_FILE", "")
+)
+
+// Ingestion log settings, loaded from the env
+var (
+	// IngestionLog Writes a row to the ingestion log table for every request
+	// run through the pipeline
+	IngestionLog = EnvBool("JTB_INGESTION_LOG", true)
+	// IngestionLogDataset The dataset the ingestion log table is kept in, when
+	// blank each request is logged in its own dataset
+	IngestionLogDataset = EnvString("JTB_INGESTION_LOG_DATASET", "")
+)
+
+// The limit on routed tables used when JTB_ROUTING_MAX_TABLES is 0 or less
+const defaultMaxRoutedTables = 50
+
+// MaxRoutedTables The most tables the records in one request can be routed to,
+// there is always a limit so 0 or less uses the default
+var MaxRoutedTables = int(EnvInt64("JTB_ROUTING_MAX_TABLES", defaultMaxRoutedTables))
+
+// InferStringTypes Infers date, time and uuid fields from string values, off
+// by default as a later value that doesnt match would change the fields type
+var InferStringTypes = EnvBool("JTB_INFER_STRING_TYPES", false)
+
+// Staging cleanup settings, loaded from the env
+var (
+	// StagingCleanup What happens to the staged files for a request once they
+	// are loaded, delete, archive to move them to the archive storage class, or
+	// keep
+	StagingCleanup = EnvString("JTB_STAGING_CLEANUP", "delete")
+	// StagingArchiveRetentionDays How many days staged files in the archive
+	// storage class are kept for by the bucket lifecycle policy, 0 keeps them
+	// forever
+	StagingArchiveRetentionDays = int(EnvInt64("JTB_STAGING_ARCHIVE_RETENTION_DAYS", 90))
+	// StagingMaxAgeHours How old a staged file has to be before the sweeper
+	// treats it as orphaned and deletes it, 0 turns off the sweeper
+	StagingMaxAgeHours = int(EnvInt64("JTB_STAGING_MAX_AGE_HOURS", 24))
+	// StagingSweepIntervalMinutes How often the sweeper runs
+	StagingSweepIntervalMinutes = int(EnvInt64("JTB_STAGING_SWEEP_INTERVAL_MINUTES", 60))
+)
+
+// Payload archive settings, loaded from the env
+var (
+	// Archive Keeps a copy of every request run through the pipeline so it can
+	// be replayed later
+	Archive = EnvBool("JTB_ARCHIVE", true)
+	// ArchivePrefix The folder archived requests are kept under in the staging
+	// store, partitioned by day
+	ArchivePrefix = EnvString("JTB_ARCHIVE_PREFIX", "_archive")
+	// ArchiveRetentionDays How many days of archived requests are kept, 0
+	// keeps them forever
+	ArchiveRetentionDays = int(EnvInt64("JTB_ARCHIVE_RETENTION_DAYS", 30))
+)
+
+// Raw record settings, loaded from the env
+var (
+	// RawColumn The column the raw JSON of each record is kept in for requests
+	// with KeepRaw set
+	RawColumn = EnvString("JTB_RAW_COLUMN", "_raw")
+	// RawColumnType The type of the raw column, json for a BigQuery JSON
+	// column or string for a STRING column
+	RawColumnType = EnvString("JTB_RAW_COLUMN_TYPE", "json")
+)
+
+// Lineage column settings, loaded from the env
+var (
+	// LineageColumns Adds the lineage columns to every loaded row and
+	// ListMappings row
+	LineageColumns = EnvBool("JTB_LINEAGE_COLUMNS", false)
+	// LineageIngestedAtColumn The column the time the request was parsed is
+	// written to
+	LineageIngestedAtColumn = EnvString("JTB_LINEAGE_INGESTED_AT_COLUMN", "_jtb_ingested_at")
+	// LineageRequestIDColumn The column the request ID is written to
+	LineageRequestIDColumn = EnvString("JTB_LINEAGE_REQUEST_ID_COLUMN", "_jtb_request_id")
+	// LineageSourceColumn The column the caller or source of the request is
+	// written to
+	LineageSourceColumn = EnvString("JTB_LINEAGE_SOURCE_COLUMN", "_jtb_source")
+	// LineageRecordIndexColumn The column the index of the record in the
+	// request data is written to
+	LineageRecordIndexColumn = EnvString("JTB_LINEAGE_RECORD_INDEX_COLUMN", "_jtb_record_index")
+	// LineageSchemaVersionColumn The column the version of the table schema
+	// the row was loaded with is written to
+	LineageSchemaVersionColumn = EnvString("JTB_LINEAGE_SCHEMA_VERSION_COLUMN", "_jtb_schema_version")
+)
+
+// EnvString Reads a string from the env, falling back to the default if it is
+// missing
+func EnvString(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// EnvInt64 Reads an int64 from the env, falling back to the default if it is
+// missing or invalid
+func EnvInt64(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("INVALID VALUE FOR %v: %v, USING DEFAULT %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// EnvBool Reads a bool from the env, falling back to the default if it is
+// missing or invalid
+func EnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("INVALID VALUE FOR %v: %v, USING DEFAULT %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
@@ -1,12 +1,17 @@
 package gcp
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
+	"path"
+	"strings"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
@@ -21,8 +26,27 @@ var (
 		"double":  bigquery.FloatFieldType,
 		"boolean": bigquery.BooleanFieldType,
 	}
+	// Map of avro logical types to bigquery field types, these take priority
+	// over the type they are applied to
+	bqLogicalSchemaMap = map[string]bigquery.FieldType{
+		avro.TimestampMicros: bigquery.TimestampFieldType,
+		avro.Date:            bigquery.DateFieldType,
+		avro.TimeMicros:      bigquery.TimeFieldType,
+		avro.Decimal:         bigquery.NumericFieldType,
+		avro.UUID:            bigquery.StringFieldType,
+		// THIS VERSION OF THE CLIENT HAS NO CONSTANT FOR JSON COLUMNS
+		avro.JSON: bigquery.FieldType("JSON"),
+	}
 )
 
+// Returns the bigquery type for an avro field
+func bqFieldType(field avro.Field) bigquery.FieldType {
+	if fieldType, ok := bqLogicalSchemaMap[field.LogicalType]; ok {
+		return fieldType
+	}
+	return bqSchemaMap[field.NonNullType()]
+}
+
 // GetBQClient Constructor func returns a Bigquery Client
 func GetBQClient(credsPath string, projectID string) (*bigquery.Client, error) {
 	ctx := context.Background()
@@ -35,8 +59,17 @@ func GetBQClient(credsPath string, projectID string) (*bigquery.Client, error) {
 	return client, nil
 }
 
-// Takes schema and updates a table to ensure the schema is up to date
-func updateTableSchema(client *bigquery.Client, datasetID, tableID string, timestampFields []string, sch avro.Schema) error {
+// Takes schema and updates a table to ensure the schema is up to date, retrying
+// if the table was changed by someone else between reading and updating it.
+// Only the additive schema policy can add columns to a table that has some,
+// the field metadata is applied to the table and the columns it mentions
+func updateTableSchema(client *bigquery.Client, datasetID, tableID string, sch avro.Schema, opts backend.TableOptions) error {
+	return Retry(OpSchema, func() error {
+		return tryUpdateTableSchema(client, datasetID, tableID, sch, opts)
+	})
+}
+
+func tryUpdateTableSchema(client *bigquery.Client, datasetID, tableID string, sch avro.Schema, opts backend.TableOptions) error {
 	var newSchema = bigquery.Schema{}
 	ctx := context.Background()
 	defer ctx.Done()
@@ -45,10 +78,16 @@ func updateTableSchema(client *bigquery.Client, datasetID, tableID string, times
 	if err != nil {
 		return err
 	}
-	newSchema = append(tableMetadata.Schema)
+	newSchema = append(newSchema, tableMetadata.Schema...)
+	var columns []string
+	for _, tableField := range tableMetadata.Schema {
+		columns = append(columns, tableField.Name)
+	}
+	if err = sch.CheckPolicy(opts.SchemaPolicy, tableID, columns); err != nil {
+		return err
+	}
 	for _, avroField := range sch.Fields {
 		exists := false
-		avroFieldType := ""
 		for _, tableField := range newSchema {
 			if avroField.Name == tableField.Name {
 				exists = true
@@ -58,37 +97,195 @@ func updateTableSchema(client *bigquery.Client, datasetID, tableID string, times
 			}
 		}
 		if !exists {
-			for _, v := range avroField.FieldType {
-				if v == "null" {
-					continue
-				} else {
-					avroFieldType = v
-				}
-			}
 			newSchema = append(newSchema,
-				&bigquery.FieldSchema{Name: avroField.Name, Type: bqSchemaMap[avroFieldType]},
+				&bigquery.FieldSchema{Name: avroField.Name, Type: bqFieldType(avroField)},
 			)
 		}
 	}
-	for i, fieldSchema := range newSchema {
-		for _, timestampKey := range timestampFields {
-			if timestampKey != fieldSchema.Name {
-				continue
-			} else {
-				newSchema[i] = &bigquery.FieldSchema{Name: fieldSchema.Name, Type: bigquery.TimestampFieldType}
-			}
+
+	// SET THE DESCRIPTIONS AND POLICY TAGS ON THE COLUMNS THAT ARE MENTIONED
+	columnMetadata := sch.ColumnMetadata(opts.FieldMetadata)
+	for i, tableField := range newSchema {
+		if metadata, ok := columnMetadata[tableField.Name]; ok {
+			newSchema[i] = withColumnMetadata(tableField, metadata)
 		}
 	}
 
 	update := bigquery.TableMetadataToUpdate{
 		Schema: newSchema,
 	}
+	if opts.FieldMetadata != nil {
+		if opts.FieldMetadata.TableDescription != "" && opts.FieldMetadata.TableDescription != tableMetadata.Description {
+			update.Description = opts.FieldMetadata.TableDescription
+		}
+		for key, value := range opts.FieldMetadata.Labels {
+			if tableMetadata.Labels[key] != value {
+				update.SetLabel(key, value)
+			}
+		}
+	}
 	if _, err := tableRef.Update(ctx, update, tableMetadata.ETag); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Returns a copy of the column with the description and policy tags from the
+// metadata, blank values leave the column as it is
+func withColumnMetadata(tableField *bigquery.FieldSchema, metadata data.JTBColumnMetadata) *bigquery.FieldSchema {
+	field := *tableField
+	if metadata.Description != "" {
+		field.Description = metadata.Description
+	}
+	if len(metadata.PolicyTags) > 0 {
+		field.PolicyTags = &bigquery.PolicyTagList{Names: metadata.PolicyTags}
+	}
+	return &field
+}
+
+// Casts the columns of string fields that have another type in the table to
+// STRING, BigQuery cant change the type of a column in place so the table is
+// snapshotted and then replaced with a copy of itself that has the new types.
+// The copy is created with the same partitioning and clustering, then the
+// descriptions, labels and policy tags of the table are put back on it
+func migrateColumns(client *bigquery.Client, datasetID, tableID string, sch avro.Schema, strategy string) error {
+	tableMetadata, err := getTableMetadata(client, datasetID, tableID)
+	if err != nil {
+		return err
+	}
+	columnTypes := make(map[string]string)
+	for _, tableField := range tableMetadata.Schema {
+		columnTypes[tableField.Name] = string(tableField.Type)
+	}
+	changes := sch.WidenedColumns(columnTypes, func(columnType string) bool { return columnType == string(bigquery.StringFieldType) })
+	if err = avro.CheckTypeChanges(strategy, tableID, changes); err != nil || len(changes) == 0 {
+		return err
+	}
+	layout, err := tableLayout(tableID, tableMetadata)
+	if err != nil {
+		return err
+	}
+	var casts []string
+	for _, change := range changes {
+		casts = append(casts, fmt.Sprintf("CAST(`%v` AS STRING) AS `%v`", change.Column, change.Column))
+	}
+	tableName := fmt.Sprintf("%v.%v.%v", client.Dataset(datasetID).ProjectID, datasetID, tableID)
+	snapshotName := fmt.Sprintf("%v.%v.%v", client.Dataset(datasetID).ProjectID, datasetID, backend.SnapshotName(tableID))
+	log.Printf("REWRITING %v TO CHANGE THE TYPE OF %v, SNAPSHOT IS %v", tableName, changes, snapshotName)
+	_, err = ExecuteQueries(client, datasetID, "", []data.JTBQuery{
+		{SQL: fmt.Sprintf("CREATE SNAPSHOT TABLE `%v` CLONE `%v`", snapshotName, tableName)},
+		{SQL: fmt.Sprintf("CREATE OR REPLACE TABLE `%v`%v AS SELECT * REPLACE (%v) FROM `%v`", tableName, layout, strings.Join(casts, ", "), tableName)},
+	})
+	if err != nil {
+		return err
+	}
+	return restoreTableMetadata(client, datasetID, tableID, tableMetadata)
+}
+
+// Returns the PARTITION BY, CLUSTER BY and OPTIONS clauses that give a table
+// created from a query the same partitioning and clustering as the table, a
+// table partitioned by ingestion time cant be created from a query so it cant
+// be rewritten
+func tableLayout(tableID string, tableMetadata *bigquery.TableMetadata) (string, error) {
+	var clauses, options []string
+	columnTypes := make(map[string]bigquery.FieldType)
+	for _, tableField := range tableMetadata.Schema {
+		columnTypes[tableField.Name] = tableField.Type
+	}
+	if partitioning := tableMetadata.TimePartitioning; partitioning != nil {
+		if partitioning.Field == "" {
+			return "", fmt.Errorf("%v is partitioned by ingestion time so it cant be rewritten, use the sibling TypeChangeStrategy instead", tableID)
+		}
+		unit := partitioning.Type
+		if unit == "" {
+			unit = bigquery.DayPartitioningType
+		}
+		switch columnTypes[partitioning.Field] {
+		case bigquery.DateFieldType:
+			if unit == bigquery.DayPartitioningType {
+				clauses = append(clauses, fmt.Sprintf("PARTITION BY `%v`", partitioning.Field))
+			} else {
+				clauses = append(clauses, fmt.Sprintf("PARTITION BY DATE_TRUNC(`%v`, %v)", partitioning.Field, unit))
+			}
+		case bigquery.DateTimeFieldType:
+			clauses = append(clauses, fmt.Sprintf("PARTITION BY DATETIME_TRUNC(`%v`, %v)", partitioning.Field, unit))
+		default:
+			clauses = append(clauses, fmt.Sprintf("PARTITION BY TIMESTAMP_TRUNC(`%v`, %v)", partitioning.Field, unit))
+		}
+		if partitioning.Expiration > 0 {
+			options = append(options, fmt.Sprintf("partition_expiration_days = %v", partitioning.Expiration.Hours()/24))
+		}
+	} else if partitioning := tableMetadata.RangePartitioning; partitioning != nil && partitioning.Range != nil {
+		clauses = append(clauses, fmt.Sprintf(
+			"PARTITION BY RANGE_BUCKET(`%v`, GENERATE_ARRAY(%v, %v, %v))",
+			partitioning.Field, partitioning.Range.Start, partitioning.Range.End, partitioning.Range.Interval,
+		))
+	}
+	if tableMetadata.RequirePartitionFilter {
+		options = append(options, "require_partition_filter = true")
+	}
+	if tableMetadata.Clustering != nil && len(tableMetadata.Clustering.Fields) > 0 {
+		clauses = append(clauses, fmt.Sprintf("CLUSTER BY `%v`", strings.Join(tableMetadata.Clustering.Fields, "`, `")))
+	}
+	if len(options) > 0 {
+		clauses = append(clauses, fmt.Sprintf("OPTIONS (%v)", strings.Join(options, ", ")))
+	}
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " " + strings.Join(clauses, " "), nil
+}
+
+// Puts the description, labels and expiration of the table and the
+// descriptions and policy tags of its columns back after it was rewritten
+func restoreTableMetadata(client *bigquery.Client, datasetID, tableID string, previous *bigquery.TableMetadata) error {
+	return Retry(OpSchema, func() error {
+		ctx := context.Background()
+		defer ctx.Done()
+		tableRef := client.Dataset(datasetID).Table(tableID)
+		tableMetadata, err := tableRef.Metadata(ctx)
+		if err != nil {
+			return err
+		}
+		update := bigquery.TableMetadataToUpdate{
+			Schema: withPreviousColumnMetadata(tableMetadata.Schema, previous.Schema),
+		}
+		if previous.Description != "" {
+			update.Description = previous.Description
+		}
+		for key, value := range previous.Labels {
+			update.SetLabel(key, value)
+		}
+		if !previous.ExpirationTime.IsZero() {
+			update.ExpirationTime = previous.ExpirationTime
+		}
+		_, err = tableRef.Update(ctx, update, tableMetadata.ETag)
+		return err
+	})
+}
+
+// Returns a copy of the schema where each column has the description and
+// policy tags of the column with the same name in the previous schema
+func withPreviousColumnMetadata(tableSchema, previous bigquery.Schema) bigquery.Schema {
+	previousFields := make(map[string]*bigquery.FieldSchema)
+	for _, tableField := range previous {
+		previousFields[tableField.Name] = tableField
+	}
+	var restored bigquery.Schema
+	for _, tableField := range tableSchema {
+		field := *tableField
+		if previousField, ok := previousFields[field.Name]; ok {
+			field.Description = previousField.Description
+			field.PolicyTags = previousField.PolicyTags
+			if len(field.Schema) > 0 {
+				field.Schema = withPreviousColumnMetadata(field.Schema, previousField.Schema)
+			}
+		}
+		restored = append(restored, &field)
+	}
+	return restored
+}
+
 // Creates a dataset and then table if it doesnt already exist
 func createTable(client *bigquery.Client, datasetID, tableID string) error {
 	ctx := context.Background()
@@ -114,53 +311,253 @@ func createTable(client *bigquery.Client, datasetID, tableID string) error {
 
 // Function used only in this package, used to retunr the schema of a table
 func getTableSchema(client *bigquery.Client, datasetID, tableID string) (bigquery.Schema, error) {
+	meta, err := getTableMetadata(client, datasetID, tableID)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Schema, nil
+}
+
+// Returns the metadata of a table, retrying transient failures
+func getTableMetadata(client *bigquery.Client, datasetID, tableID string) (*bigquery.TableMetadata, error) {
+	var meta *bigquery.TableMetadata
 	ctx := context.Background()
 	defer ctx.Done()
 	tableRef := client.Dataset(datasetID).Table(tableID)
-	meta, err := tableRef.Metadata(ctx)
+	err := Retry(OpSchema, func() error {
+		var err error
+		meta, err = tableRef.Metadata(ctx)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return meta.Schema, nil
+	return meta, nil
 }
 
-// PrepareTable Creates a table if it doesnt exist, then updates the schema to
-// match the avro schema parsed in
-func PrepareTable(client *bigquery.Client, datasetID, tableID string, timestampFields []string, sch avro.Schema) error {
+// PrepareTable Creates a table if it doesnt exist, rewrites any columns that
+// were widened to a string, then updates the schema to match the avro schema
+// parsed in, as far as the schema policy allows, along with the field metadata
+func PrepareTable(client *bigquery.Client, datasetID, tableID string, sch avro.Schema, opts backend.TableOptions) error {
 	err := createTable(client, datasetID, tableID)
 	if err != nil {
 		return err
 	}
-	err = updateTableSchema(client, datasetID, tableID, timestampFields, sch)
+	err = migrateColumns(client, datasetID, tableID, sch, opts.TypeChangeStrategy)
+	if err != nil {
+		return err
+	}
+	err = updateTableSchema(client, datasetID, tableID, sch, opts)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// LoadAvroToTable Loads avro data into a BQ table from google cloud storage reference
+// LoadAvroToTable Loads avro data into a BQ table from google cloud storage
+// reference, the load job is retried on transient failures using deterministic
+// job IDs so a retry never loads the same file twice
 func LoadAvroToTable(client *bigquery.Client, bucketName, datasetID, tableID, avroFile string) error {
+	_, err := loadFile(client, datasetID, tableID, "", bigquery.Avro, gcsSource(fmt.Sprintf("gs://%v/%v/%v", bucketName, datasetID, avroFile), bigquery.Avro))
+	return err
+}
+
+// Returns a func that creates a load source for a file in google cloud storage
+func gcsSource(uri string, format bigquery.DataFormat) func(bigquery.Schema) bigquery.LoadSource {
+	return func(tableSchema bigquery.Schema) bigquery.LoadSource {
+		gcsRef := bigquery.NewGCSReference(uri)
+		gcsRef.SourceFormat = format
+		// PARQUET FILES DESCRIBE THEIR OWN SCHEMA
+		if format == bigquery.Avro {
+			gcsRef.Schema = tableSchema
+		}
+		return gcsRef
+	}
+}
+
+// LoadAvroBytesToTable Loads avro data into a BQ table straight from memory,
+// used when the files are not staged in google cloud storage
+func LoadAvroBytesToTable(client *bigquery.Client, datasetID, tableID string, avroBytes []byte) error {
+	_, err := loadFile(client, datasetID, tableID, "", bigquery.Avro, readerSource(avroBytes, bigquery.Avro))
+	return err
+}
+
+// Returns a func that creates a load source for a file held in memory
+func readerSource(fileBytes []byte, format bigquery.DataFormat) func(bigquery.Schema) bigquery.LoadSource {
+	return func(tableSchema bigquery.Schema) bigquery.LoadSource {
+		source := bigquery.NewReaderSource(bytes.NewReader(fileBytes))
+		source.SourceFormat = format
+		if format == bigquery.Avro {
+			source.Schema = tableSchema
+		}
+		return source
+	}
+}
+
+// Returns the source format of a staged file from its extension
+func sourceFormat(fileName string) (bigquery.DataFormat, error) {
+	switch path.Ext(fileName) {
+	case ".avro":
+		return bigquery.Avro, nil
+	case ".parquet":
+		return bigquery.Parquet, nil
+	default:
+		return "", fmt.Errorf("unknown staging format for file: %v", fileName)
+	}
+}
+
+// Returns the location of the dataset so jobs run and are looked up next to it,
+// when it cant be looked up the location is left blank for bigquery to pick
+func datasetLocation(client *bigquery.Client, datasetID string) string {
+	meta, err := client.Dataset(datasetID).Metadata(context.Background())
+	if err != nil {
+		return ""
+	}
+	return meta.Location
+}
+
+// Runs the load job and returns its ID, newSource is called for every attempt
+// as a reader source can only be read once
+func loadFile(client *bigquery.Client, datasetID, tableID, jobKey string, format bigquery.DataFormat, newSource func(bigquery.Schema) bigquery.LoadSource) (string, error) {
 	tableSchema, err := getTableSchema(client, datasetID, tableID)
 	if err != nil {
-		return err
+		return "", err
 	}
-	ctx := context.Background()
-	defer ctx.Done()
-	gcsRef := bigquery.NewGCSReference(fmt.Sprintf("gs://%v/%v/%v", bucketName, datasetID, avroFile))
-	gcsRef.SourceFormat = bigquery.Avro
-	gcsRef.Schema = tableSchema
-	loader := client.Dataset(datasetID).Table(tableID).LoaderFrom(gcsRef)
-	loader.WriteDisposition = bigquery.WriteAppend
-	job, err := loader.Run(ctx)
+	location := datasetLocation(client, datasetID)
+	job, _, err := runJobWithRetry(client, OpLoad, newJobID("load", jobKey, datasetID, tableID), location, func(ctx context.Context, jobID string) (*bigquery.Job, error) {
+		loader := client.Dataset(datasetID).Table(tableID).LoaderFrom(newSource(tableSchema))
+		loader.Location = location
+		loader.WriteDisposition = bigquery.WriteAppend
+		// READ TIMESTAMP, DATE, TIME, DECIMAL AND UUID FIELDS AS THEIR LOGICAL TYPES
+		loader.UseAvroLogicalTypes = format == bigquery.Avro
+		loader.JobID = jobID
+		return loader.Run(ctx)
+	})
+	if job == nil {
+		return "", err
+	}
+	return job.ID(), err
+}
+
+// BigQuery The BigQuery implementation of backend.Warehouse
+type BigQuery struct {
+	Client *bigquery.Client
+}
+
+// NewBigQuery Constructor func, returns a BigQuery for the project using the
+// creds file
+func NewBigQuery(credsPath, projectID string) (*BigQuery, error) {
+	client, err := GetBQClient(credsPath, projectID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &BigQuery{Client: client}, nil
+}
+
+// PrepareTable Creates the table if it doesnt exist, then updates the schema
+func (b *BigQuery) PrepareTable(datasetID, tableID string, sch avro.Schema, opts backend.TableOptions) error {
+	return PrepareTable(b.Client, datasetID, tableID, sch, opts)
+}
+
+// LoadFile Loads a staged avro or parquet file into the table, files in
+// google cloud storage are loaded by reference, files in any other store are
+// downloaded and uploaded with the load job. Staged file names hold the
+// request ID, so the load job ID is made from the file name and loading the
+// same request again picks up the job that already loaded it
+func (b *BigQuery) LoadFile(objects backend.ObjectStore, datasetID, tableID, fileName string) (string, error) {
+	format, err := sourceFormat(fileName)
+	if err != nil {
+		return "", err
+	}
+	uri := objects.URI(datasetID, fileName)
+	if strings.HasPrefix(uri, "gs://") {
+		return loadFile(b.Client, datasetID, tableID, fileName, format, gcsSource(uri, format))
+	}
+	fileBytes, err := objects.Download(datasetID, fileName)
+	if err != nil {
+		return "", err
+	}
+	return loadFile(b.Client, datasetID, tableID, fileName, format, readerSource(fileBytes, format))
+}
+
+// InsertRows Streams the rows into the table, this is only used for a few
+// rows at a time as streamed rows cant be changed by DML for a while
+func (b *BigQuery) InsertRows(datasetID, tableID string, rows []map[string]interface{}) error {
+	if len(rows) == 0 {
+		return nil
 	}
-	status, err := job.Wait(ctx)
+	tableSchema, err := getTableSchema(b.Client, datasetID, tableID)
 	if err != nil {
 		return err
 	}
-	if status.Err() != nil {
-		return fmt.Errorf("job completed with error: %v", status.Err())
+	savers := make([]*bigquery.ValuesSaver, 0, len(rows))
+	for _, row := range rows {
+		values := make([]bigquery.Value, len(tableSchema))
+		for i, field := range tableSchema {
+			values[i] = row[field.Name]
+		}
+		savers = append(savers, &bigquery.ValuesSaver{Schema: tableSchema, Row: values})
 	}
-	return nil
+	return Retry(OpInsert, func() error {
+		ctx := context.Background()
+		defer ctx.Done()
+		return b.Client.Dataset(datasetID).Table(tableID).Inserter().Put(ctx, savers)
+	})
+}
+
+// ExecuteQueries Runs the statements in order
+func (b *BigQuery) ExecuteQueries(datasetID, requestID string, statements []data.JTBQuery) ([]data.QueryResult, error) {
+	return ExecuteQueries(b.Client, datasetID, requestID, statements)
+}
+
+// AppendTables Inserts the rows of each source table into its destination
+// with a multi statement transaction, so the inserts are committed together
+func (b *BigQuery) AppendTables(datasetID string, copies []backend.TableCopy) error {
+	projectID := b.Client.Dataset(datasetID).ProjectID
+	statements := []string{"BEGIN TRANSACTION;"}
+	for _, c := range copies {
+		tableSchema, err := getTableSchema(b.Client, datasetID, c.Source)
+		if err != nil {
+			return err
+		}
+		columns := make([]string, len(tableSchema))
+		for i, field := range tableSchema {
+			columns[i] = fmt.Sprintf("`%v`", field.Name)
+		}
+		statements = append(statements, fmt.Sprintf(
+			"INSERT INTO `%v.%v.%v` (%v) SELECT %v FROM `%v.%v.%v`;",
+			projectID, datasetID, c.Destination, strings.Join(columns, ", "), strings.Join(columns, ", "), projectID, datasetID, c.Source,
+		))
+	}
+	statements = append(statements, "COMMIT TRANSACTION;")
+	_, err := ExecuteQueries(b.Client, datasetID, "", []data.JTBQuery{{SQL: strings.Join(statements, "\n")}})
+	return err
+}
+
+// DropTable Drops the table if it exists
+func (b *BigQuery) DropTable(datasetID, tableID string) error {
+	_, err := ExecuteQueries(b.Client, datasetID, "", []data.JTBQuery{
+		{SQL: fmt.Sprintf("DROP TABLE IF EXISTS `%v.%v.%v`", b.Client.Dataset(datasetID).ProjectID, datasetID, tableID)},
+	})
+	return err
+}
+
+// DeduplicateTable Replaces the table with one row for each set of key
+// column values in it, or with its distinct rows if there are no key columns
+func (b *BigQuery) DeduplicateTable(projectID, datasetID, tableID string, keyColumns []string) error {
+	tableName := fmt.Sprintf("%v.%v.%v", projectID, datasetID, tableID)
+	dedupe := data.JTBQuery{SQL: fmt.Sprintf("CREATE OR REPLACE TABLE `%v` AS (SELECT DISTINCT * FROM `%v`)", tableName, tableName)}
+	if len(keyColumns) > 0 {
+		dedupe.SQL = fmt.Sprintf(
+			"CREATE OR REPLACE TABLE `%v` AS (SELECT * FROM `%v` WHERE TRUE QUALIFY ROW_NUMBER() OVER (PARTITION BY `%v`) = 1)",
+			tableName, tableName, strings.Join(keyColumns, "`, `"),
+		)
+	}
+	_, err := ExecuteQueries(b.Client, datasetID, "", []data.JTBQuery{dedupe})
+	return err
+}
+
+// Close Closes the client
+func (b *BigQuery) Close() error {
+	return b.Client.Close()
 }
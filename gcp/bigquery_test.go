@@ -0,0 +1,85 @@
+package gcp
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestTableLayout(t *testing.T) {
+	tableSchema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "day", Type: bigquery.DateFieldType},
+		{Name: "at", Type: bigquery.TimestampFieldType},
+	}
+	tests := []struct {
+		name     string
+		metadata bigquery.TableMetadata
+		want     string
+	}{
+		{"unpartitioned", bigquery.TableMetadata{}, ""},
+		{
+			"date column",
+			bigquery.TableMetadata{TimePartitioning: &bigquery.TimePartitioning{Field: "day"}},
+			" PARTITION BY `day`",
+		},
+		{
+			"hourly timestamp with expiration and clustering",
+			bigquery.TableMetadata{
+				TimePartitioning:       &bigquery.TimePartitioning{Type: bigquery.HourPartitioningType, Field: "at", Expiration: 36 * time.Hour},
+				RequirePartitionFilter: true,
+				Clustering:             &bigquery.Clustering{Fields: []string{"id", "day"}},
+			},
+			" PARTITION BY TIMESTAMP_TRUNC(`at`, HOUR) CLUSTER BY `id`, `day` OPTIONS (partition_expiration_days = 1.5, require_partition_filter = true)",
+		},
+		{
+			"integer range",
+			bigquery.TableMetadata{RangePartitioning: &bigquery.RangePartitioning{Field: "id", Range: &bigquery.RangePartitioningRange{Start: 0, End: 100, Interval: 10}}},
+			" PARTITION BY RANGE_BUCKET(`id`, GENERATE_ARRAY(0, 100, 10))",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.metadata.Schema = tableSchema
+			got, err := tableLayout("events", &test.metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	ingestionTime := bigquery.TableMetadata{Schema: tableSchema, TimePartitioning: &bigquery.TimePartitioning{}}
+	if _, err := tableLayout("events", &ingestionTime); err == nil {
+		t.Error("expected a table partitioned by ingestion time to be rejected")
+	}
+}
+
+func TestWithPreviousColumnMetadata(t *testing.T) {
+	tags := &bigquery.PolicyTagList{Names: []string{"projects/p/locations/eu/taxonomies/1/policyTags/2"}}
+	previous := bigquery.Schema{
+		{Name: "email", Type: bigquery.StringFieldType, Description: "Contact email", PolicyTags: tags},
+		{Name: "amount", Type: bigquery.IntegerFieldType, Description: "Amount in pence"},
+	}
+	rewritten := bigquery.Schema{
+		{Name: "email", Type: bigquery.StringFieldType},
+		{Name: "amount", Type: bigquery.StringFieldType},
+		{Name: "added", Type: bigquery.StringFieldType},
+	}
+	restored := withPreviousColumnMetadata(rewritten, previous)
+	if len(restored) != 3 {
+		t.Fatalf("expected 3 columns, got %v", len(restored))
+	}
+	if restored[0].Description != "Contact email" || restored[0].PolicyTags != tags {
+		t.Errorf("expected the email column metadata to be restored, got %+v", restored[0])
+	}
+	if restored[1].Description != "Amount in pence" || restored[1].Type != bigquery.StringFieldType {
+		t.Errorf("expected the amount column to keep its new type and old description, got %+v", restored[1])
+	}
+	if rewritten[0].Description != "" {
+		t.Error("expected the rewritten schema not to be changed")
+	}
+}
@@ -0,0 +1,122 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// ExecuteQueries Runs the statements in order, stopping at the first failure
+// unless that statement is set to continue on error, returns the results of
+// every statement that was ran. The job IDs are made from the request ID and
+// the position of the statement, so running the same request again picks up
+// the jobs it already ran instead of running them twice, a blank request ID
+// always runs new jobs
+func ExecuteQueries(client *bigquery.Client, datasetID, requestID string, statements []data.JTBQuery) ([]data.QueryResult, error) {
+	var results []data.QueryResult
+	for i, statement := range statements {
+		jobKey := ""
+		if requestID != "" {
+			jobKey = fmt.Sprintf("%v_%v", requestID, i)
+		}
+		result, err := runQuery(client, datasetID, jobKey, statement)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			if statement.ContinueOnError {
+				log.Printf("STATEMENT FAILED, CONTINUING: %v", err.Error())
+				continue
+			}
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Runs a single statement, dry running it first if it has a byte threshold
+func runQuery(client *bigquery.Client, datasetID, jobKey string, statement data.JTBQuery) (data.QueryResult, error) {
+	result := data.QueryResult{SQL: statement.SQL}
+	ctx := context.Background()
+	defer ctx.Done()
+
+	q, err := newQuery(client, datasetID, statement)
+	if err != nil {
+		return result, err
+	}
+
+	// DRY RUN THE STATEMENT TO CHECK THE COST BEFORE RUNNING IT
+	if statement.MaxDryRunBytes > 0 {
+		q.DryRun = true
+		err = Retry(OpQuery, func() error {
+			job, err := q.Run(ctx)
+			if err != nil {
+				return err
+			}
+			// WITHOUT STATISTICS THE COST CANT BE CHECKED, SO THE STATEMENT ISNT RAN
+			status := job.LastStatus()
+			if status == nil || status.Statistics == nil {
+				return errors.New("dry run returned no statistics to check the cost against")
+			}
+			result.DryRunBytes = status.Statistics.TotalBytesProcessed
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		if result.DryRunBytes > statement.MaxDryRunBytes {
+			return result, fmt.Errorf("statement would process %v bytes, above the limit of %v", result.DryRunBytes, statement.MaxDryRunBytes)
+		}
+		q.DryRun = false
+	}
+
+	job, status, err := runJobWithRetry(client, OpQuery, newJobID("query", jobKey, datasetID), q.Location, func(ctx context.Context, jobID string) (*bigquery.Job, error) {
+		q.JobID = jobID
+		return q.Run(ctx)
+	})
+	if job != nil {
+		result.JobID = job.ID()
+	}
+	if status != nil && status.Statistics != nil {
+		result.BytesProcessed = status.Statistics.TotalBytesProcessed
+	}
+	return result, err
+}
+
+// Builds the bigquery query from the statement and its options
+func newQuery(client *bigquery.Client, datasetID string, statement data.JTBQuery) (*bigquery.Query, error) {
+	q := client.Query(statement.SQL)
+	q.Location = datasetLocation(client, datasetID)
+	q.MaxBytesBilled = statement.MaximumBytesBilled
+	q.Priority = bigquery.QueryPriority(statement.Priority)
+	if statement.DestinationTable != "" {
+		dst, err := destinationTable(client, datasetID, statement.DestinationTable)
+		if err != nil {
+			return nil, err
+		}
+		q.Dst = dst
+		q.WriteDisposition = bigquery.WriteAppend
+	}
+	return q, nil
+}
+
+// Resolves a table, dataset.table or project.dataset.table reference to a table
+// defaulting to the dataset in the request
+func destinationTable(client *bigquery.Client, datasetID, tableRef string) (*bigquery.Table, error) {
+	parts := strings.Split(tableRef, ".")
+	switch len(parts) {
+	case 1:
+		return client.Dataset(datasetID).Table(parts[0]), nil
+	case 2:
+		return client.Dataset(parts[0]).Table(parts[1]), nil
+	case 3:
+		return client.DatasetInProject(parts[0], parts[1]).Table(parts[2]), nil
+	default:
+		return nil, fmt.Errorf("invalid destination table: %v", tableRef)
+	}
+}
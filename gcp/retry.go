@@ -0,0 +1,207 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy How many times an operation is attempted and how long to back
+// off between attempts, the backoff doubles each time up to MaxBackoff
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Operation names used to look up retry policies and label retry metrics
+const (
+	OpUpload   = "upload"
+	OpDownload = "download"
+	OpSchema   = "schema"
+	OpLoad     = "load"
+	OpQuery    = "query"
+	OpInsert   = "insert"
+	OpList     = "list"
+	OpDelete   = "delete"
+	OpRewrite  = "rewrite"
+)
+
+// RetryPolicies The retry policy for each operation, each can be overridden
+// with JTB_RETRY_<OPERATION>_MAX_ATTEMPTS, _INITIAL_BACKOFF_MS and
+// _MAX_BACKOFF_MS env variables
+var RetryPolicies = map[string]RetryPolicy{
+	OpUpload:   newRetryPolicy(OpUpload, 5, 500*time.Millisecond, 30*time.Second),
+	OpDownload: newRetryPolicy(OpDownload, 5, 500*time.Millisecond, 30*time.Second),
+	OpSchema:   newRetryPolicy(OpSchema, 5, time.Second, 30*time.Second),
+	OpLoad:     newRetryPolicy(OpLoad, 5, time.Second, time.Minute),
+	OpQuery:    newRetryPolicy(OpQuery, 3, time.Second, time.Minute),
+	OpInsert:   newRetryPolicy(OpInsert, 5, 500*time.Millisecond, 30*time.Second),
+	OpList:     newRetryPolicy(OpList, 5, 500*time.Millisecond, 30*time.Second),
+	OpDelete:   newRetryPolicy(OpDelete, 5, 500*time.Millisecond, 30*time.Second),
+	OpRewrite:  newRetryPolicy(OpRewrite, 5, 500*time.Millisecond, 30*time.Second),
+}
+
+var (
+	// Count of retries made for each operation
+	retryCount = expvar.NewMap("jtb_retries")
+	// Count of operations that failed after using up all their attempts
+	retryExhausted = expvar.NewMap("jtb_retries_exhausted")
+	// Characters that cant be used in a job ID
+	invalidJobIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+	// Reasons returned by google apis and bigquery jobs that are worth retrying
+	retryableReasons = map[string]bool{
+		"rateLimitExceeded": true,
+		"backendError":      true,
+		"internalError":     true,
+		"jobBackendError":   true,
+		"jobInternalError":  true,
+	}
+)
+
+func newRetryPolicy(operation string, maxAttempts int, initialBackoff, maxBackoff time.Duration) RetryPolicy {
+	prefix := fmt.Sprintf("JTB_RETRY_%v_", strings.ToUpper(operation))
+	return RetryPolicy{
+		MaxAttempts:    int(data.EnvInt64(prefix+"MAX_ATTEMPTS", int64(maxAttempts))),
+		InitialBackoff: time.Duration(data.EnvInt64(prefix+"INITIAL_BACKOFF_MS", initialBackoff.Milliseconds())) * time.Millisecond,
+		MaxBackoff:     time.Duration(data.EnvInt64(prefix+"MAX_BACKOFF_MS", maxBackoff.Milliseconds())) * time.Millisecond,
+	}
+}
+
+// IsRetryable Classifies an error from google storage or bigquery as transient
+// or not, 429s, 5xxs, ETag precondition failures and rate limit or backend
+// errors are transient
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case 412, 429, 500, 502, 503, 504:
+			return true
+		}
+		for _, item := range apiErr.Errors {
+			if retryableReasons[item.Reason] {
+				return true
+			}
+		}
+		return false
+	}
+	var jobErr *bigquery.Error
+	if errors.As(err, &jobErr) {
+		return retryableReasons[jobErr.Reason]
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Returns true if the error is a 409 from trying to create something that
+// already exists
+func isAlreadyExists(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == 409
+}
+
+// Retry Runs fn until it succeeds, returns a non retryable error or runs out of
+// attempts, backing off with jitter between each attempt
+func Retry(operation string, fn func() error) error {
+	policy := RetryPolicies[operation]
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("%v SUCCEEDED AFTER %v ATTEMPTS", strings.ToUpper(operation), attempt)
+			}
+			return nil
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			retryExhausted.Add(operation, 1)
+			log.Printf("%v FAILED AFTER %v ATTEMPTS: %v", strings.ToUpper(operation), attempt, err.Error())
+			return err
+		}
+		// FULL JITTER, SLEEP A RANDOM AMOUNT UP TO THE CURRENT BACKOFF
+		sleep := time.Duration(rand.Int63n(int64(backoff) + 1))
+		retryCount.Add(operation, 1)
+		log.Printf("%v ATTEMPT %v OF %v FAILED, RETRYING IN %v: %v", strings.ToUpper(operation), attempt, policy.MaxAttempts, sleep, err.Error())
+		time.Sleep(sleep)
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// Returns a job ID made from the kind of job, the key and the parts, so the
+// same work for the same request always gets the same ID and a job that was
+// already created, by a retry here or by the request being sent again, is
+// picked up instead of being ran twice. A blank key gets a unique one as
+// there is nothing to tie the job to
+func newJobID(kind, key string, parts ...string) string {
+	if key == "" {
+		key = fmt.Sprint(time.Now().UnixNano())
+	}
+	id := fmt.Sprintf("jtb_%v_%v_%v", kind, strings.Join(parts, "_"), key)
+	return invalidJobIDChars.ReplaceAllString(id, "_")
+}
+
+// Runs a bigquery job with retries, run is passed the job ID to use for each
+// attempt, the ID only changes when the previous job failed, a job that already
+// exists with the ID is waited on instead of being created again, location is
+// where the job runs and can be blank to look the job up in the default location
+func runJobWithRetry(client *bigquery.Client, operation, baseJobID, location string, run func(ctx context.Context, jobID string) (*bigquery.Job, error)) (*bigquery.Job, *bigquery.JobStatus, error) {
+	var (
+		job        *bigquery.Job
+		status     *bigquery.JobStatus
+		jobAttempt = 0
+		ctx        = context.Background()
+	)
+	defer ctx.Done()
+	err := Retry(operation, func() error {
+		jobID := fmt.Sprintf("%v_%v", baseJobID, jobAttempt)
+		var err error
+		job, err = run(ctx, jobID)
+		if isAlreadyExists(err) {
+			job, err = client.JobFromIDLocation(ctx, jobID, location)
+		}
+		if err != nil {
+			return err
+		}
+		status, err = job.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Err() != nil {
+			// THE JOB FAILED SO ANY RETRY NEEDS A NEW JOB ID
+			jobAttempt++
+			return status.Err()
+		}
+		return nil
+	})
+	if err != nil && status != nil && err == status.Err() {
+		err = fmt.Errorf("job completed with error: %v", err)
+	}
+	return job, status, err
+}
@@ -0,0 +1,19 @@
+package gcp
+
+import "testing"
+
+func TestNewJobID(t *testing.T) {
+	first := newJobID("load", "events.req-1.avro", "dataset", "events")
+	if first != "jtb_load_dataset_events_events_req-1_avro" {
+		t.Errorf("unexpected job ID %v", first)
+	}
+	if again := newJobID("load", "events.req-1.avro", "dataset", "events"); again != first {
+		t.Errorf("expected the same request to get the same job ID, got %v and %v", first, again)
+	}
+	if other := newJobID("query", "events.req-1.avro", "dataset", "events"); other == first {
+		t.Errorf("expected a different operation to get a different job ID, got %v", other)
+	}
+	if newJobID("query", "", "dataset") == newJobID("query", "", "dataset") {
+		t.Error("expected jobs without a key to get unique job IDs")
+	}
+}
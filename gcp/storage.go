@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -24,59 +28,279 @@ func GetStorageClient(credsFilePath string) (*storage.Client, error) {
 	return client, nil
 }
 
-// DownloadBlobFromStorage Downloads a file from Google storage and writes it to
-// a local file of the same name
-func DownloadBlobFromStorage(client *storage.Client, bucketName, dataset, fileName string) error {
-	blobName := fmt.Sprintf("%v/%v", dataset, fileName)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
-	defer cancel()
-	r, err := client.Bucket(bucketName).Object(blobName).NewReader(ctx)
-	if err != nil {
-		return err
+// ArchiveStorageClass The storage class staged files are moved to when they
+// are archived instead of deleted
+const ArchiveStorageClass = "ARCHIVE"
+
+// The buckets this process has already applied the lifecycle policy to
+var lifecycleApplied sync.Map
+
+// Returns the name of the blob for a file in a dataset folder, an empty
+// dataset is the root of the bucket
+func blobName(dataset, fileName string) string {
+	if dataset == "" {
+		return fileName
 	}
-	defer r.Close()
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
+	return fmt.Sprintf("%v/%v", dataset, fileName)
+}
+
+// DownloadBlobFromStorage Downloads a file from Google storage and returns its
+// contents
+func DownloadBlobFromStorage(client *storage.Client, bucketName, dataset, fileName string) ([]byte, error) {
+	var data []byte
+	blob := blobName(dataset, fileName)
+	err := Retry(OpDownload, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+		defer cancel()
+		r, err := client.Bucket(bucketName).Object(blob).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err = ioutil.ReadAll(r)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	err = ioutil.WriteFile(blobName, data, 0644)
+	return data, nil
+}
+
+// UploadBlobToStorage Uploads a file to Google storage
+func UploadBlobToStorage(client *storage.Client, bucketName, dataset, fileName string, data []byte) error {
+	blob := blobName(dataset, fileName)
+	err := Retry(OpUpload, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+		defer cancel()
+		w := client.Bucket(bucketName).Object(blob).NewWriter(ctx)
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+		// THE UPLOAD ONLY COMPLETES ON CLOSE SO THIS IS WHERE MOST ERRORS SHOW UP
+		return w.Close()
+	})
 	if err != nil {
 		return err
 	}
+	log.Printf("uploaded %v to %v", blob, bucketName)
 	return nil
 }
 
-// UploadBlobToStorage Uploads a file to Google storage
-func UploadBlobToStorage(client *storage.Client, bucketName, dataset, fileName string) error {
-	blobName := fmt.Sprintf("%v/%v", dataset, fileName)
+// ListBlobsInStorage Returns every blob under the dataset folder, named
+// relative to it, an empty dataset lists the whole bucket
+func ListBlobsInStorage(client *storage.Client, bucketName, dataset string) ([]backend.ObjectInfo, error) {
+	prefix := blobName(dataset, "")
+	var objects []backend.ObjectInfo
+	err := Retry(OpList, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+		defer cancel()
+		objects = nil
+		it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			objects = append(objects, backend.ObjectInfo{
+				Name:     strings.TrimPrefix(attrs.Name, prefix),
+				Size:     attrs.Size,
+				Updated:  attrs.Updated,
+				Archived: attrs.StorageClass == ArchiveStorageClass,
+			})
+		}
+	})
+	return objects, err
+}
+
+// DeleteBlobFromStorage Deletes a blob, a blob that doesnt exist is not an
+// error
+func DeleteBlobFromStorage(client *storage.Client, bucketName, dataset, fileName string) error {
+	blob := blobName(dataset, fileName)
+	return Retry(OpDelete, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+		defer cancel()
+		err := client.Bucket(bucketName).Object(blob).Delete(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		return err
+	})
+}
+
+// ArchiveBlobInStorage Rewrites a blob in place in the archive storage class,
+// a blob that doesnt exist is not an error
+func ArchiveBlobInStorage(client *storage.Client, bucketName, dataset, fileName string) error {
+	blob := client.Bucket(bucketName).Object(blobName(dataset, fileName))
+	return Retry(OpRewrite, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+		defer cancel()
+		copier := blob.CopierFrom(blob)
+		copier.StorageClass = ArchiveStorageClass
+		_, err := copier.Run(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		return err
+	})
+}
+
+// Returns the lifecycle rule that deletes staged files once they have been in
+// the archive storage class for the retention
+func archiveLifecycleRule() storage.LifecycleRule {
+	return storage.LifecycleRule{
+		Action: storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{
+			AgeInDays:             int64(data.StagingArchiveRetentionDays),
+			MatchesStorageClasses: []string{ArchiveStorageClass},
+		},
+	}
+}
+
+// Returns true if the rule is one added by archiveLifecycleRule, whatever its
+// age
+func isArchiveLifecycleRule(rule storage.LifecycleRule) bool {
+	return rule.Action.Type == storage.DeleteAction &&
+		len(rule.Condition.MatchesStorageClasses) == 1 &&
+		rule.Condition.MatchesStorageClasses[0] == ArchiveStorageClass
+}
+
+// Returns the lifecycle with the archive rule set to the current retention,
+// other rules are kept as they are, returns false if nothing changed
+func withArchiveLifecycleRule(lifecycle storage.Lifecycle) (storage.Lifecycle, bool) {
+	var (
+		rules   []storage.LifecycleRule
+		changed bool
+		found   bool
+		want    = archiveLifecycleRule()
+	)
+	for _, rule := range lifecycle.Rules {
+		if !isArchiveLifecycleRule(rule) {
+			rules = append(rules, rule)
+			continue
+		}
+		if data.StagingArchiveRetentionDays <= 0 || found || rule.Condition.AgeInDays != want.Condition.AgeInDays {
+			changed = true
+			continue
+		}
+		found = true
+		rules = append(rules, rule)
+	}
+	if data.StagingArchiveRetentionDays > 0 && !found {
+		rules = append(rules, want)
+		changed = true
+	}
+	return storage.Lifecycle{Rules: rules}, changed
+}
+
+// Applies the lifecycle policy to a bucket that already existed, once per
+// process
+func applyLifecycle(client *storage.Client, bucketName string) error {
+	if _, applied := lifecycleApplied.Load(bucketName); applied {
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
 	defer cancel()
-	data, err := ioutil.ReadFile(blobName)
-	w := client.Bucket(bucketName).Object(blobName).NewWriter(ctx)
-	defer w.Close()
-	_, err = w.Write(data)
+	bkt := client.Bucket(bucketName)
+	attrs, err := bkt.Attrs(ctx)
 	if err != nil {
 		return err
 	}
-	if err = os.Remove(blobName); err != nil {
-		return err
+	if lifecycle, changed := withArchiveLifecycleRule(attrs.Lifecycle); changed {
+		if _, err := bkt.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle}); err != nil {
+			return err
+		}
+		log.Printf("updated the lifecycle policy of %v", bucketName)
 	}
-	log.Printf("uploaded %v to %v", blobName, bucketName)
+	lifecycleApplied.Store(bucketName, true)
 	return nil
 }
 
-// CreateBucket Creates a Google storage bucket if it does not already exist
+// CreateBucket Creates a Google storage bucket if it does not already exist,
+// with a lifecycle policy that deletes archived staged files after the
+// retention. The policy is added to a bucket that already exists the first
+// time it is seen
 func CreateBucket(client *storage.Client, projectID, bucketName string) error {
 	ctx := context.Background()
 	defer ctx.Done()
 	bkt := client.Bucket(bucketName)
-	if err := bkt.Create(ctx, projectID, nil); err != nil {
+	lifecycle, _ := withArchiveLifecycleRule(storage.Lifecycle{})
+	if err := bkt.Create(ctx, projectID, &storage.BucketAttrs{Lifecycle: lifecycle}); err != nil {
 		if e, ok := err.(*googleapi.Error); ok {
 			if e.Code != 409 {
 				log.Printf("ERROR CREATING BUCKET: %v", err.Error())
 				return err
 			}
 		}
+		// A FAILURE TO UPDATE THE POLICY SHOULDNT STOP THE BUCKET BEING USED
+		if err := applyLifecycle(client, bucketName); err != nil {
+			log.Printf("ERROR APPLYING LIFECYCLE POLICY TO %v: %v", bucketName, err.Error())
+		}
+		return nil
 	}
+	lifecycleApplied.Store(bucketName, true)
 	return nil
 }
+
+// Storage The Google storage implementation of backend.ObjectStore, objects
+// are kept in a single bucket under a folder per dataset
+type Storage struct {
+	Client     *storage.Client
+	BucketName string
+}
+
+// NewStorage Constructor func, returns a Storage using the creds file
+func NewStorage(credsFilePath, bucketName string) (*Storage, error) {
+	client, err := GetStorageClient(credsFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{Client: client, BucketName: bucketName}, nil
+}
+
+// Prepare Creates the bucket if it does not already exist
+func (s *Storage) Prepare(projectID string) error {
+	return CreateBucket(s.Client, projectID, s.BucketName)
+}
+
+// Download Returns the contents of a blob, or backend.ErrObjectNotExist
+func (s *Storage) Download(dataset, fileName string) ([]byte, error) {
+	data, err := DownloadBlobFromStorage(s.Client, s.BucketName, dataset, fileName)
+	if err == storage.ErrObjectNotExist {
+		return nil, backend.ErrObjectNotExist
+	}
+	return data, err
+}
+
+// Upload Creates or overwrites a blob
+func (s *Storage) Upload(dataset, fileName string, data []byte) error {
+	return UploadBlobToStorage(s.Client, s.BucketName, dataset, fileName, data)
+}
+
+// URI Returns the gs:// URI of a blob
+func (s *Storage) URI(dataset, fileName string) string {
+	return fmt.Sprintf("gs://%v/%v", s.BucketName, blobName(dataset, fileName))
+}
+
+// List Returns every blob under the dataset folder
+func (s *Storage) List(dataset string) ([]backend.ObjectInfo, error) {
+	return ListBlobsInStorage(s.Client, s.BucketName, dataset)
+}
+
+// Delete Deletes a blob
+func (s *Storage) Delete(dataset, fileName string) error {
+	return DeleteBlobFromStorage(s.Client, s.BucketName, dataset, fileName)
+}
+
+// Archive Moves a blob to the archive storage class
+func (s *Storage) Archive(dataset, fileName string) error {
+	return ArchiveBlobInStorage(s.Client, s.BucketName, dataset, fileName)
+}
+
+// Close Closes the client
+func (s *Storage) Close() error {
+	return s.Client.Close()
+}
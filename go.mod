@@ -8,8 +8,15 @@ require (
 	github.com/go-playground/universal-translator v0.17.0 // indirect
 	github.com/go-playground/validator v9.31.0+incompatible
 	github.com/gorilla/mux v1.8.0
-	github.com/hamba/avro v1.5.4
+	github.com/hamba/avro v1.8.0
+	github.com/klauspost/compress v1.13.1
 	github.com/leodido/go-urn v1.2.1 // indirect
+	github.com/lib/pq v1.10.2
+	github.com/mattn/go-sqlite3 v1.14.7
+	github.com/segmentio/kafka-go v0.4.17
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	golang.org/x/text v0.3.6
 	google.golang.org/api v0.47.0
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 )
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pool"
+)
+
+// Admit Wraps a handler in the process wide admission control, requests that
+// cant get a slot in time are turned away with a 429 and a Retry-After header
+func Admit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := pool.Requests.Acquire(); err != nil {
+			retryAfter := data.QueueTimeoutSeconds
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			data.RespondWithJSON(w, "error", err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer pool.Requests.Release()
+		next(w, r)
+	}
+}
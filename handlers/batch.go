@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/batch"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/gorilla/mux"
+)
+
+// BatchGet Returns the status of a micro batch so callers that buffered
+// records can find out when they were flushed
+func BatchGet(w http.ResponseWriter, r *http.Request) {
+	batchID := mux.Vars(r)["batchID"]
+	status, ok := batch.Buffers.Status(batchID)
+	if !ok {
+		data.RespondWithJSON(w, "error", fmt.Sprintf("No batch found with ID %v", batchID), http.StatusNotFound)
+		return
+	}
+	resp := data.NewResponse(status.State, fmt.Sprintf("Batch %v is %v.", status.BatchID, status.State))
+	resp.Batch = &status
+	resp.Respond(w, http.StatusOK)
+}
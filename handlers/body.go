@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// A request body capped with http.MaxBytesReader that records whether the
+// limit was hit, as go 1.16 has no error type to check for it
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	// MAXBYTESREADER ONLY FAILS WITH SOMETHING OTHER THAN EOF ONCE IT HAS READ
+	// THE LIMIT AND THERE IS MORE TO COME
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// Caps the request body at the body size limit so a huge payload cant
+// exhaust memory, returns nil if there is no limit
+func limitBody(w http.ResponseWriter, r *http.Request) *limitedBody {
+	if data.RequestLimits.MaxBodyBytes <= 0 {
+		return nil
+	}
+	body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, data.RequestLimits.MaxBodyBytes), limit: data.RequestLimits.MaxBodyBytes}
+	r.Body = body
+	return body
+}
+
+// Responds to an error decoding the body, with a 413 if the body went over
+// the limit and a 400 otherwise
+func respondDecodeError(w http.ResponseWriter, body *limitedBody, what string, err error) {
+	if body != nil && body.exceeded {
+		data.RespondWithJSON(w, "error", fmt.Sprintf("Request body is larger than the limit of %v bytes", body.limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	data.RespondWithJSON(w, "error", fmt.Sprintf("%v is invalid: %v", what, err.Error()), http.StatusBadRequest)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+// MultiPost Loads records into several tables in the same project and dataset
+// in one request, the tables are loaded at the same time with the same clients
+// and the outcome of each is reported in the tables of the response
+func MultiPost(w http.ResponseWriter, r *http.Request) {
+	multi := &data.JTBMultiRequest{}
+
+	// CAP THE BODY SIZE SO A HUGE PAYLOAD CANT EXHAUST MEMORY
+	body := limitBody(w, r)
+	if err := multi.LoadFromJSON(r); err != nil {
+		respondDecodeError(w, body, "JSON data", err)
+		return
+	}
+	if err := multi.Validate(); err != nil {
+		data.RespondWithJSON(w, "error", validationError(err).Error(), http.StatusBadRequest)
+		return
+	}
+	if multi.RequestID == "" {
+		multi.RequestID = data.NewRequestID()
+	}
+	multi.Caller = requestCaller(r)
+
+	// EVERY TABLE IS CHECKED BEFORE ANY OF THEM ARE RAN
+	requests := multi.Requests()
+	for _, jtb := range requests {
+		if statusCode, err := validateRequest(jtb); err != nil {
+			data.RespondWithJSON(w, "error", fmt.Sprintf("%v: %v", jtb.TableName, err.Error()), statusCode)
+			return
+		}
+	}
+	log.Printf("GOT MULTI TABLE REQUEST %v FOR %v TABLES IN %v.%v", multi.RequestID, len(requests), multi.ProjectID, multi.DatasetName)
+
+	clients, err := pipeline.NewClients(multi.ProjectID)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if e, ok := err.(*pipeline.Error); ok {
+			statusCode = e.StatusCode
+		}
+		data.RespondWithJSON(w, "error", err.Error(), statusCode)
+		return
+	}
+	defer clients.Close()
+	results := pipeline.RunMulti(clients, requests, multi.AllOrNothing)
+
+	// A PARTIAL FAILURE IS A MULTI STATUS, IF EVERY TABLE FAILED THE FIRST
+	// FAILURE THAT WASNT CAUSED BY ANOTHER TABLE GIVES THE STATUS CODE
+	loaded, statusCode := 0, 0
+	for _, result := range results {
+		if result.Status == "success" {
+			loaded++
+			continue
+		}
+		if statusCode == 0 || statusCode == http.StatusFailedDependency {
+			statusCode = result.StatusCode
+		}
+	}
+	status := "error"
+	switch loaded {
+	case len(results):
+		status, statusCode = "success", http.StatusOK
+	case 0:
+	default:
+		status, statusCode = "partial", http.StatusMultiStatus
+	}
+	resp := data.NewResponse(status, fmt.Sprintf("Loaded %v of %v tables into %v.%v.", loaded, len(results), multi.ProjectID, multi.DatasetName))
+	resp.RequestID = multi.RequestID
+	resp.Tables = results
+	resp.Respond(w, statusCode)
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+// Points the pipeline at a local file store and an in memory warehouse for
+// the length of the test
+func useLocalClients(t *testing.T) (*backend.FileStore, *backend.MemoryWarehouse) {
+	t.Helper()
+	objects := backend.NewFileStore(t.TempDir())
+	warehouse := backend.NewMemoryWarehouse()
+	newClients := pipeline.NewClients
+	pipeline.NewClients = func(projectID string) (*pipeline.Clients, error) {
+		return &pipeline.Clients{Objects: objects, Warehouse: warehouse}, nil
+	}
+	t.Cleanup(func() { pipeline.NewClients = newClients })
+	return objects, warehouse
+}
+
+// Posts the body to JtBPost and decodes the response
+func postJSON(t *testing.T, body string) (int, data.Response) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	JtBPost(rec, req)
+	var resp data.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, rec.Body.String())
+	}
+	return rec.Code, resp
+}
+
+func TestJtBPostLoadsRecords(t *testing.T) {
+	_, warehouse := useLocalClients(t)
+
+	code, resp := postJSON(t, `{
+		"RequestID": "req-1",
+		"ProjectID": "project",
+		"DatasetName": "dataset",
+		"TableName": "events",
+		"IdField": "id",
+		"Data": [
+			{"id": 1, "name": "first", "score": 1.5},
+			{"id": 2, "name": "second", "tags": ["a", "b"]}
+		]
+	}`)
+	if code != http.StatusOK || resp.Status != "success" {
+		t.Fatalf("expected success, got %v: %+v", code, resp)
+	}
+	if resp.RequestID != "req-1" {
+		t.Errorf("expected the request ID to be returned, got %q", resp.RequestID)
+	}
+
+	table, ok := warehouse.Table("dataset", "events")
+	if !ok {
+		t.Fatal("events table was not created")
+	}
+	if len(table.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %v", len(table.Rows))
+	}
+	columns := make(map[string]bool)
+	for _, column := range table.Columns {
+		columns[column.Name] = true
+	}
+	for _, name := range []string{"id", "name", "score"} {
+		if !columns[name] {
+			t.Errorf("expected a %v column, got %+v", name, table.Columns)
+		}
+	}
+
+	if _, ok := warehouse.Table("dataset", "ListMappings"); !ok {
+		t.Error("expected the list field to be written to ListMappings")
+	}
+	if data.IngestionLog {
+		logTable, ok := warehouse.Table("dataset", pipeline.IngestionLogTable)
+		if !ok || len(logTable.Rows) != 1 {
+			t.Fatalf("expected one ingestion log row, got %+v", logTable.Rows)
+		}
+		if logTable.Rows[0]["requestId"] != "req-1" || logTable.Rows[0]["status"] != "success" {
+			t.Errorf("unexpected ingestion log row %+v", logTable.Rows[0])
+		}
+	}
+}
+
+func TestJtBPostAddsNewFields(t *testing.T) {
+	_, warehouse := useLocalClients(t)
+	request := `{"ProjectID": "project", "DatasetName": "dataset", "TableName": "events", "IdField": "id", "Data": [%v]}`
+
+	if code, resp := postJSON(t, strings.Replace(request, "%v", `{"id": 1}`, 1)); code != http.StatusOK {
+		t.Fatalf("expected the first request to succeed, got %v: %+v", code, resp)
+	}
+	code, resp := postJSON(t, strings.Replace(request, "%v", `{"id": 2, "added": "value"}`, 1))
+	if code != http.StatusOK {
+		t.Fatalf("expected the second request to succeed, got %v: %+v", code, resp)
+	}
+	if resp.Schema == nil || len(resp.Schema.AddedFields) != 1 || resp.Schema.AddedFields[0] != "added" {
+		t.Errorf("expected the added field to be reported, got %+v", resp.Schema)
+	}
+	table, _ := warehouse.Table("dataset", "events")
+	if len(table.Rows) != 2 {
+		t.Errorf("expected 2 rows, got %v", len(table.Rows))
+	}
+}
+
+func TestJtBPostRejectsInvalidRequests(t *testing.T) {
+	_, warehouse := useLocalClients(t)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"malformed JSON", `{"ProjectID": "project"`},
+		{"missing fields", `{"ProjectID": "project", "DatasetName": "dataset", "Data": [{"id": 1}]}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, resp := postJSON(t, test.body)
+			if code != http.StatusBadRequest || resp.Status != "error" {
+				t.Errorf("expected a 400 error, got %v: %+v", code, resp)
+			}
+		})
+	}
+	if _, ok := warehouse.Table("dataset", "events"); ok {
+		t.Error("expected no table to be created")
+	}
+}
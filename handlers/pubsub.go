@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/batch"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pubsub"
+)
+
+// PubSubPost Accepts a Pub/Sub push envelope and loads the message data into
+// the table routed from the subscription or message attributes, a 2xx response
+// acks the message and anything else makes Pub/Sub redeliver it. A message that
+// fails with a client error would fail the same way every time, so it is
+// logged and acked rather than redelivered forever
+func PubSubPost(w http.ResponseWriter, r *http.Request) {
+	body := limitBody(w, r)
+	defer r.Body.Close()
+
+	// DECODE THE ENVELOPE, THE MESSAGE DATA IS BASE64 DECODED INTO BYTES
+	envelope := &pubsub.PushEnvelope{}
+	if err := json.NewDecoder(r.Body).Decode(envelope); err != nil {
+		respondDecodeError(w, body, "Push envelope", err)
+		return
+	}
+	messageID := envelope.Message.MessageID
+	if messageID == "" {
+		data.RespondWithJSON(w, "error", "Push envelope is missing message.messageId", http.StatusBadRequest)
+		return
+	}
+
+	// ACK MESSAGES THAT HAVE ALREADY BEEN LOADED, AND NACK ONES THAT ARE STILL
+	// BEING LOADED SO THEY COME BACK ONCE THAT HAS FINISHED
+	if err := pubsub.Seen.Begin(messageID); err != nil {
+		log.Printf("DUPLICATE PUBSUB MESSAGE %v: %v", messageID, err.Error())
+		if err == pubsub.ErrInFlight {
+			data.RespondWithJSON(w, "error", fmt.Sprintf("Message %v is %v.", messageID, err.Error()), http.StatusConflict)
+			return
+		}
+		data.RespondWithJSON(w, "success", fmt.Sprintf("Message %v was %v.", messageID, err.Error()), http.StatusOK)
+		return
+	}
+	acked := false
+	defer func() { pubsub.Seen.Finish(messageID, acked) }()
+
+	jtb, err := envelope.ToRequest(pubsub.Routes)
+	if err != nil {
+		acked = true
+		ackFailure(w, messageID, data.NewResponse("error", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if statusCode, err := validateRequest(jtb); err != nil {
+		acked = true
+		resp := data.NewResponse("error", err.Error())
+		resp.RequestID = jtb.RequestID
+		ackFailure(w, messageID, resp, statusCode)
+		return
+	}
+	log.Printf("GOT PUBSUB MESSAGE %v FOR %v.%v.%v", messageID, jtb.ProjectID, jtb.DatasetName, jtb.TableName)
+
+	// THE MESSAGE IS SAFE TO ACK ONCE IT IS IN THE SPOOL
+	if jtb.Buffer {
+		status, err := batch.Buffers.Add(jtb)
+		if err != nil {
+			data.RespondWithJSON(w, "error", err.Error(), http.StatusInternalServerError)
+			return
+		}
+		acked = true
+		resp := data.NewResponse("accepted", fmt.Sprintf("Buffered message %v in batch %v.", messageID, status.BatchID))
+		resp.RequestID = jtb.RequestID
+		resp.Batch = &status
+		resp.Respond(w, http.StatusAccepted)
+		return
+	}
+
+	result, err := pipeline.Run(jtb)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if e, ok := err.(*pipeline.Error); ok {
+			statusCode = e.StatusCode
+		}
+		resp := data.NewResponse("error", err.Error())
+		resp.RequestID = jtb.RequestID
+		if result != nil {
+			resp.Tables = result.Tables
+		}
+		if statusCode < http.StatusInternalServerError {
+			acked = true
+			ackFailure(w, messageID, resp, statusCode)
+			return
+		}
+		resp.Respond(w, statusCode)
+		return
+	}
+	acked = true
+	resp := data.NewResponse(
+		"success",
+		fmt.Sprintf("Successfully Inserted %v number of rows from message %v into %v.%v.%v.", result.Rows, messageID, jtb.ProjectID, jtb.DatasetName, jtb.TableName),
+	)
+	if len(result.Tables) > 0 {
+		resp.Content = fmt.Sprintf("Successfully Inserted %v number of rows from message %v into %v routed tables in %v.%v.", result.Rows, messageID, len(result.Tables), jtb.ProjectID, jtb.DatasetName)
+	}
+	resp.RequestID = jtb.RequestID
+	resp.Queries = result.Queries
+	resp.Tables = result.Tables
+	resp.Compression = result.Compression
+	resp.Schema = result.Schema
+	resp.Respond(w, http.StatusOK)
+}
+
+// Acks a message that can never be loaded with a 200, as Pub/Sub would
+// redeliver anything else forever, the failure is logged along with the status
+// code it would have got so the message can be found and sent again once the
+// problem is fixed
+func ackFailure(w http.ResponseWriter, messageID string, resp *data.Response, statusCode int) {
+	log.Printf("ERROR LOADING PUBSUB MESSAGE %v, ACKING IT AS IT CANT BE LOADED (%v): %v", messageID, statusCode, resp.Content)
+	resp.Content = fmt.Sprintf("Message %v can never be loaded so it was acked, it would have got a %v: %v", messageID, statusCode, resp.Content)
+	resp.Respond(w, http.StatusOK)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pubsub"
+)
+
+// Routes the events subscription to the test table and gives the test its
+// own idempotency store
+func useTestSubscription(t *testing.T) {
+	t.Helper()
+	routes, seen := pubsub.Routes, pubsub.Seen
+	pubsub.Routes = map[string]data.Route{"events-sub": {ProjectID: "project", DatasetName: "dataset", TableName: "events", IdField: "id"}}
+	pubsub.Seen = pubsub.NewIdempotencyStore(time.Hour)
+	t.Cleanup(func() { pubsub.Routes, pubsub.Seen = routes, seen })
+}
+
+// Pushes a message with the payload to PubSubPost and decodes the response
+func pushMessage(t *testing.T, subscription, messageID, payload string) (int, data.Response) {
+	t.Helper()
+	body := fmt.Sprintf(
+		`{"message": {"data": %q, "messageId": %q}, "subscription": "projects/project/subscriptions/%v"}`,
+		base64.StdEncoding.EncodeToString([]byte(payload)), messageID, subscription,
+	)
+	rec := httptest.NewRecorder()
+	PubSubPost(rec, httptest.NewRequest(http.MethodPost, "/pubsub/push", strings.NewReader(body)))
+	var resp data.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, rec.Body.String())
+	}
+	return rec.Code, resp
+}
+
+func TestPubSubPostAcksLoadedMessagesOnce(t *testing.T) {
+	_, warehouse := useLocalClients(t)
+	useTestSubscription(t)
+
+	code, resp := pushMessage(t, "events-sub", "msg-1", `{"id": 1}`)
+	if code != http.StatusOK || resp.Status != "success" || resp.RequestID != "msg-1" {
+		t.Fatalf("expected the message to be loaded and acked, got %v: %+v", code, resp)
+	}
+	code, resp = pushMessage(t, "events-sub", "msg-1", `{"id": 1}`)
+	if code != http.StatusOK || !strings.Contains(resp.Content, "already processed") {
+		t.Errorf("expected a redelivery to be acked without loading it, got %v: %+v", code, resp)
+	}
+	if table, _ := warehouse.Table("dataset", "events"); len(table.Rows) != 1 {
+		t.Errorf("expected the message to be loaded once, got %v rows", len(table.Rows))
+	}
+}
+
+func TestPubSubPostNacksMessagesInFlight(t *testing.T) {
+	useLocalClients(t)
+	useTestSubscription(t)
+
+	if err := pubsub.Seen.Begin("msg-1"); err != nil {
+		t.Fatal(err)
+	}
+	if code, resp := pushMessage(t, "events-sub", "msg-1", `{"id": 1}`); code != http.StatusConflict {
+		t.Errorf("expected a message being loaded to be nacked with a 409, got %v: %+v", code, resp)
+	}
+}
+
+func TestPubSubPostAcksClientErrors(t *testing.T) {
+	useLocalClients(t)
+	useTestSubscription(t)
+	if code, resp := pushMessage(t, "events-sub", "msg-1", `{"id": 1}`); code != http.StatusOK {
+		t.Fatalf("expected the first message to load, got %v: %+v", code, resp)
+	}
+
+	tests := []struct {
+		name         string
+		subscription string
+		payload      string
+		statusCode   int
+	}{
+		{"no route", "unknown-sub", `{"id": 1}`, http.StatusBadRequest},
+		{"invalid data", "events-sub", `not json`, http.StatusBadRequest},
+		{"type conflict", "events-sub", `{"id": "text"}`, http.StatusConflict},
+	}
+	for i, test := range tests {
+		messageID := fmt.Sprintf("msg-failed-%v", i)
+		code, resp := pushMessage(t, test.subscription, messageID, test.payload)
+		if code != http.StatusOK || resp.Status != "error" || !strings.Contains(resp.Content, fmt.Sprint(test.statusCode)) {
+			t.Errorf("%v: expected the message to be acked with the error, got %v: %+v", test.name, code, resp)
+		}
+		// THE REDELIVERY OF A MESSAGE THAT WAS ACKED ISNT LOADED AGAIN
+		if code, resp := pushMessage(t, test.subscription, messageID, test.payload); code != http.StatusOK || !strings.Contains(resp.Content, "already processed") {
+			t.Errorf("%v: expected a redelivery to be acked, got %v: %+v", test.name, code, resp)
+		}
+	}
+}
+
+func TestPubSubPostNacksServerErrors(t *testing.T) {
+	useTestSubscription(t)
+	newClients := pipeline.NewClients
+	pipeline.NewClients = func(projectID string) (*pipeline.Clients, error) {
+		return nil, errors.New("warehouse is down")
+	}
+	defer func() { pipeline.NewClients = newClients }()
+
+	if code, resp := pushMessage(t, "events-sub", "msg-1", `{"id": 1}`); code != http.StatusInternalServerError || resp.Status != "error" {
+		t.Errorf("expected a server error to nack the message, got %v: %+v", code, resp)
+	}
+	// THE MESSAGE ISNT MARKED AS PROCESSED SO THE REDELIVERY IS LOADED
+	if err := pubsub.Seen.Begin("msg-1"); err != nil {
+		t.Errorf("expected the failed message to be tried again, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+// ReplayPost Loads archived requests again, picked by time range, request ID
+// and table, optionally into a different dataset or table. Each replayed
+// request is reported in the replays of the response
+func ReplayPost(w http.ResponseWriter, r *http.Request) {
+	replay := &data.ReplayRequest{}
+
+	// CAP THE BODY SIZE SO A HUGE PAYLOAD CANT EXHAUST MEMORY
+	body := limitBody(w, r)
+	if err := replay.LoadFromJSON(r); err != nil {
+		respondDecodeError(w, body, "JSON data", err)
+		return
+	}
+	if err := replay.Validate(); err != nil {
+		data.RespondWithJSON(w, "error", validationError(err).Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("GOT REPLAY REQUEST: %#v", replay)
+
+	clients, err := pipeline.NewClients(replay.ProjectID)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if e, ok := err.(*pipeline.Error); ok {
+			statusCode = e.StatusCode
+		}
+		data.RespondWithJSON(w, "error", err.Error(), statusCode)
+		return
+	}
+	defer clients.Close()
+
+	results, err := pipeline.Replay(clients, replay)
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if e, ok := err.(*pipeline.Error); ok {
+			statusCode = e.StatusCode
+		}
+		data.RespondWithJSON(w, "error", err.Error(), statusCode)
+		return
+	}
+
+	// NOTHING REPLAYED IS NOT A FAILURE OF THE REPLAY, THERE WAS NOTHING TO FIND
+	if len(results) == 0 {
+		data.RespondWithJSON(w, "error", "No archived requests match the replay.", http.StatusNotFound)
+		return
+	}
+
+	// THE REPLAY ONLY FAILS AS A WHOLE IF EVERY REQUEST IN IT FAILED
+	failed := 0
+	for _, result := range results {
+		if result.Status != "success" {
+			failed++
+		}
+	}
+	status, statusCode := "success", http.StatusOK
+	if failed == len(results) {
+		status, statusCode = "error", http.StatusInternalServerError
+	}
+	resp := data.NewResponse(status, fmt.Sprintf("Replayed %v archived requests, %v failed.", len(results), failed))
+	resp.Replays = results
+	resp.Respond(w, statusCode)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Posts the body to ReplayPost and decodes the response
+func postReplay(t *testing.T, body string) (int, data.Response) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ReplayPost(rec, httptest.NewRequest(http.MethodPost, "/replay", strings.NewReader(body)))
+	var resp data.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, rec.Body.String())
+	}
+	return rec.Code, resp
+}
+
+func TestReplayPostWithoutMatches(t *testing.T) {
+	useLocalClients(t)
+
+	code, resp := postReplay(t, `{"ProjectID": "project", "RequestIDs": ["missing"]}`)
+	if code != http.StatusNotFound || resp.Status != "error" {
+		t.Errorf("expected a 404 when nothing matches, got %v: %+v", code, resp)
+	}
+}
+
+func TestReplayPostReloadsArchivedRequest(t *testing.T) {
+	if !data.Archive {
+		t.Skip("the payload archive is turned off")
+	}
+	_, warehouse := useLocalClients(t)
+	if code, resp := postJSON(t, `{"RequestID": "req-1", "ProjectID": "project", "DatasetName": "dataset", "TableName": "events", "IdField": "id", "Data": [{"id": 1}]}`); code != http.StatusOK {
+		t.Fatalf("expected the request to load, got %v: %+v", code, resp)
+	}
+
+	code, resp := postReplay(t, `{"ProjectID": "project", "RequestIDs": ["req-1"], "TargetTableName": "events_copy"}`)
+	if code != http.StatusOK || len(resp.Replays) != 1 {
+		t.Fatalf("expected one replayed request, got %v: %+v", code, resp)
+	}
+	if table, ok := warehouse.Table("dataset", "events_copy"); !ok || len(table.Rows) != 1 {
+		t.Errorf("expected the archived record to be loaded into the target table, got %+v", table.Rows)
+	}
+}
+
+func TestReplayPostRejectsLargeBody(t *testing.T) {
+	defer func(limit int64) { data.RequestLimits.MaxBodyBytes = limit }(data.RequestLimits.MaxBodyBytes)
+	data.RequestLimits.MaxBodyBytes = 64
+
+	code, resp := postReplay(t, `{"ProjectID": "project", "RequestIDs": ["`+strings.Repeat("a", 128)+`"]}`)
+	if code != http.StatusRequestEntityTooLarge || resp.Status != "error" {
+		t.Errorf("expected a 413 for a body over the limit, got %v: %+v", code, resp)
+	}
+}
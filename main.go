@@ -1,18 +1,96 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/BenHiramTaylor/JSONToBigQuery/batch"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
 	"github.com/BenHiramTaylor/JSONToBigQuery/handlers"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+	"github.com/BenHiramTaylor/JSONToBigQuery/source"
 	"github.com/gorilla/mux"
 )
 
 func main() {
 	port := ":80"
+	// FLUSH ANY BATCHES LEFT IN THE SPOOL FROM THE LAST RUN
+	if err := batch.Buffers.Recover(); err != nil {
+		log.Printf("ERROR RECOVERING SPOOLED BATCHES: %v", err.Error())
+	}
+	// START CONSUMING FROM KAFKA IF BROKERS ARE SET
+	if data.KafkaBrokers != "" {
+		go consumeKafka()
+	}
+	// CLEAN UP STAGED FILES LEFT BEHIND BY REQUESTS THAT FAILED
+	if data.StagingMaxAgeHours > 0 && data.StagingSweepIntervalMinutes > 0 {
+		go sweepStaging()
+	}
+	// DELETE ARCHIVED REQUESTS OLDER THAN THE RETENTION EVERY DAY
+	if data.Archive && data.ArchiveRetentionDays > 0 {
+		go pruneArchive()
+	}
 	r := mux.NewRouter()
-	r.HandleFunc("/", handlers.JtBPost).Methods(http.MethodPost)
+	r.HandleFunc("/", handlers.Admit(handlers.JtBPost)).Methods(http.MethodPost)
+	r.HandleFunc("/pubsub/push", handlers.Admit(handlers.PubSubPost)).Methods(http.MethodPost)
+	r.HandleFunc("/multi", handlers.Admit(handlers.MultiPost)).Methods(http.MethodPost)
+	r.HandleFunc("/replay", handlers.Admit(handlers.ReplayPost)).Methods(http.MethodPost)
+	r.HandleFunc("/batches/{batchID}", handlers.BatchGet).Methods(http.MethodGet)
+	r.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
 	fmt.Println("Listening on port", port)
 	log.Fatal(http.ListenAndServe(port, r))
 }
+
+// Consumes the topics in the Kafka routes file until the consumer fails
+func consumeKafka() {
+	routes := data.LoadRoutes(data.KafkaRoutesFile)
+	var topics []string
+	for topic := range routes {
+		topics = append(topics, topic)
+	}
+	src := source.NewKafkaSource(data.KafkaBrokers, data.KafkaGroupID, topics)
+	defer src.Close()
+	err := source.NewConsumer(src, routes).Consume(context.Background())
+	log.Printf("KAFKA CONSUMER STOPPED: %v", err)
+}
+
+// Prunes the payload archive once a day, starting when the service starts
+func pruneArchive() {
+	for {
+		objects, err := pipeline.NewObjectStore()
+		if err != nil {
+			log.Printf("ERROR CREATING OBJECT STORE TO PRUNE THE ARCHIVE: %v", err.Error())
+		} else {
+			deleted, err := pipeline.PruneArchive(objects, time.Now())
+			if err != nil {
+				log.Printf("ERROR PRUNING THE ARCHIVE: %v", err.Error())
+			}
+			log.Printf("PRUNED %v ARCHIVED REQUESTS", deleted)
+			objects.Close()
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// Sweeps the staging store for orphaned files every sweep interval, starting
+// when the service starts
+func sweepStaging() {
+	for {
+		objects, err := pipeline.NewObjectStore()
+		if err != nil {
+			log.Printf("ERROR CREATING OBJECT STORE TO SWEEP STAGING: %v", err.Error())
+		} else {
+			swept, err := pipeline.SweepStaging(objects, time.Now())
+			if err != nil {
+				log.Printf("ERROR SWEEPING STAGING: %v", err.Error())
+			}
+			log.Printf("SWEPT %v ORPHANED STAGED FILES", swept)
+			objects.Close()
+		}
+		time.Sleep(time.Duration(data.StagingSweepIntervalMinutes) * time.Minute)
+	}
+}
@@ -0,0 +1,185 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/common"
+	parquetformat "github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// The parquet types for each avro type
+var parquetTypes = map[string]string{
+	"string":  "type=BYTE_ARRAY, convertedtype=UTF8",
+	"int":     "type=INT32",
+	"long":    "type=INT64",
+	"float":   "type=FLOAT",
+	"double":  "type=DOUBLE",
+	"boolean": "type=BOOLEAN",
+}
+
+// The parquet types for each avro logical type, these take priority over the
+// type they are applied to
+var parquetLogicalTypes = map[string]string{
+	avro.TimestampMicros: "type=INT64, convertedtype=TIMESTAMP_MICROS",
+	avro.Date:            "type=INT32, convertedtype=DATE",
+	avro.TimeMicros:      "type=INT64, convertedtype=TIME_MICROS",
+	avro.Decimal:         fmt.Sprintf("type=BYTE_ARRAY, convertedtype=DECIMAL, precision=%v, scale=%v", avro.DecimalPrecision, avro.DecimalScale),
+	avro.UUID:            "type=BYTE_ARRAY, convertedtype=UTF8",
+}
+
+const secondsPerDay = 24 * 60 * 60
+
+type schemaNode struct {
+	Tag    string        `json:"Tag"`
+	Fields []*schemaNode `json:"Fields,omitempty"`
+}
+
+// Schema Converts the avro schema to the json schema used by the parquet
+// writer, every column is optional as every avro field is nullable
+func Schema(sch avro.Schema) (string, error) {
+	root := &schemaNode{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	seen := make(map[string]string)
+	for _, field := range sch.Fields {
+		// THE WRITER CANNOT TELL APART NAMES THAT ONLY DIFFER BY CASE
+		if other, ok := seen[strings.ToLower(field.Name)]; ok {
+			return "", fmt.Errorf("fields %v and %v only differ by case", other, field.Name)
+		}
+		seen[strings.ToLower(field.Name)] = field.Name
+		parquetType, ok := parquetLogicalTypes[field.LogicalType]
+		if !ok {
+			parquetType, ok = parquetTypes[field.NonNullType()]
+		}
+		if !ok {
+			return "", fmt.Errorf("field %v has a type that cannot be written to parquet: %v", field.Name, field.FieldType)
+		}
+		root.Fields = append(root.Fields, &schemaNode{Tag: fmt.Sprintf("name=%v, %v, repetitiontype=OPTIONAL", field.Name, parquetType)})
+	}
+	jsonSchema, err := json.Marshal(root)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonSchema), nil
+}
+
+// Converts the logical values in a record to the primitives the parquet writer
+// takes
+func toParquetValue(value interface{}, logicalType string) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		if logicalType == avro.Date {
+			return v.Unix() / secondsPerDay
+		}
+		return v.UnixNano() / 1000
+	case time.Duration:
+		return v.Microseconds()
+	case *big.Rat:
+		return v.FloatString(avro.DecimalScale)
+	}
+	return value
+}
+
+// Converts a value read from a parquet column back to the go type used for its
+// logical type, the same types the avro decoder returns
+func fromParquetValue(value interface{}, element *parquetformat.SchemaElement) interface{} {
+	if value == nil || element.ConvertedType == nil {
+		return value
+	}
+	switch *element.ConvertedType {
+	case parquetformat.ConvertedType_TIMESTAMP_MICROS:
+		return time.Unix(0, value.(int64)*1000).UTC()
+	case parquetformat.ConvertedType_DATE:
+		return time.Unix(int64(value.(int32))*secondsPerDay, 0).UTC()
+	case parquetformat.ConvertedType_TIME_MICROS:
+		return time.Duration(value.(int64)) * time.Microsecond
+	case parquetformat.ConvertedType_DECIMAL:
+		// DECIMALS ARE THE TWOS COMPLEMENT BYTES OF THE UNSCALED VALUE
+		unscaled := new(big.Int).SetBytes([]byte(value.(string)))
+		if len(value.(string)) > 0 && value.(string)[0]&0x80 != 0 {
+			unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(8*len(value.(string)))))
+		}
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(element.GetScale())), nil)
+		return new(big.Rat).SetFrac(unscaled, scale)
+	}
+	return value
+}
+
+// WriteRecords This function writes the records passed to a parquet file using
+// the avro schema, and returns the bytes
+func WriteRecords(sch avro.Schema, records []map[string]interface{}) ([]byte, error) {
+	jsonSchema, err := Schema(sch)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	pw, err := writer.NewJSONWriterFromWriter(jsonSchema, &buf, 4)
+	if err != nil {
+		return nil, err
+	}
+	logicalTypes := make(map[string]string)
+	for _, field := range sch.Fields {
+		logicalTypes[field.Name] = field.LogicalType
+	}
+	for _, record := range records {
+		parquetRecord := make(map[string]interface{}, len(record))
+		for k, v := range record {
+			parquetRecord[k] = toParquetValue(v, logicalTypes[k])
+		}
+		recordJSON, err := json.Marshal(parquetRecord)
+		if err != nil {
+			return nil, err
+		}
+		if err = pw.Write(string(recordJSON)); err != nil {
+			return nil, err
+		}
+	}
+	if err = pw.WriteStop(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadRecords Reads the rows of a parquet file written by WriteRecords back in
+// to records keyed by column name, with logical types converted back to the go
+// types the avro decoder uses
+func ReadRecords(parquetBytes []byte) ([]map[string]interface{}, error) {
+	pf, err := buffer.NewBufferFile(parquetBytes)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := reader.NewParquetColumnReader(pf, 4)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+
+	numRows := pr.GetNumRows()
+	records := make([]map[string]interface{}, numRows)
+	for i := range records {
+		records[i] = make(map[string]interface{})
+	}
+	if numRows == 0 {
+		return records, nil
+	}
+	for _, inPath := range pr.SchemaHandler.ValueColumns {
+		exPath := strings.Split(pr.SchemaHandler.InPathToExPath[inPath], common.PAR_GO_PATH_DELIMITER)
+		name := exPath[len(exPath)-1]
+		values, _, _, err := pr.ReadColumnByPath(inPath, numRows)
+		if err != nil {
+			return nil, err
+		}
+		element := pr.SchemaHandler.SchemaElements[pr.SchemaHandler.MapIndex[inPath]]
+		for i, value := range values {
+			records[i][name] = fromParquetValue(value, element)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,80 @@
+package parquet
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+)
+
+func TestWriteAndReadRecords(t *testing.T) {
+	sch := avro.Schema{Name: "events.avro", Namespace: "events.avsc", Type: "record", Fields: []avro.Field{
+		{Name: "id", FieldType: []string{"long", "null"}},
+		{Name: "name", FieldType: []string{"string", "null"}},
+		{Name: "score", FieldType: []string{"double", "null"}},
+		{Name: "active", FieldType: []string{"boolean", "null"}},
+		{Name: "at", FieldType: []string{"long", "null"}, LogicalType: avro.TimestampMicros},
+		{Name: "day", FieldType: []string{"int", "null"}, LogicalType: avro.Date},
+		{Name: "clock", FieldType: []string{"long", "null"}, LogicalType: avro.TimeMicros},
+		{Name: "amount", FieldType: []string{"bytes", "null"}, LogicalType: avro.Decimal, Precision: avro.DecimalPrecision, Scale: avro.DecimalScale},
+	}}
+	at := time.Date(2021, 3, 4, 5, 6, 7, 123456000, time.UTC)
+	day := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)
+	amount, _ := new(big.Rat).SetString("1234.567890123")
+	negative, _ := new(big.Rat).SetString("-0.5")
+	records := []map[string]interface{}{
+		{"id": int64(1), "name": "first", "score": 1.5, "active": true, "at": at, "day": day, "clock": 5*time.Hour + 6*time.Second, "amount": amount},
+		// EVERY COLUMN IS NULLABLE, MISSING VALUES ARE READ BACK AS NIL
+		{"id": int64(2), "amount": negative},
+	}
+
+	parquetBytes, err := WriteRecords(sch, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadRecords(parquetBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("expected 2 records, got %v", len(read))
+	}
+
+	first := read[0]
+	if first["id"] != int64(1) || first["name"] != "first" || first["score"] != 1.5 || first["active"] != true {
+		t.Errorf("unexpected primitive values %v", first)
+	}
+	if got, ok := first["at"].(time.Time); !ok || !got.Equal(at) {
+		t.Errorf("expected the timestamp %v, got %v", at, first["at"])
+	}
+	if got, ok := first["day"].(time.Time); !ok || !got.Equal(day) {
+		t.Errorf("expected the date %v, got %v", day, first["day"])
+	}
+	if first["clock"] != 5*time.Hour+6*time.Second {
+		t.Errorf("expected the time of day, got %v", first["clock"])
+	}
+	if got, ok := first["amount"].(*big.Rat); !ok || got.Cmp(amount) != 0 {
+		t.Errorf("expected the decimal %v, got %v", amount.FloatString(avro.DecimalScale), first["amount"])
+	}
+
+	second := read[1]
+	for _, name := range []string{"name", "score", "active", "at", "day", "clock"} {
+		if second[name] != nil {
+			t.Errorf("expected %v to be null, got %v", name, second[name])
+		}
+	}
+	if got, ok := second["amount"].(*big.Rat); !ok || got.Cmp(negative) != 0 {
+		t.Errorf("expected the negative decimal %v, got %v", negative.FloatString(avro.DecimalScale), second["amount"])
+	}
+}
+
+func TestSchemaRejectsNamesThatOnlyDifferByCase(t *testing.T) {
+	sch := avro.Schema{Fields: []avro.Field{
+		{Name: "id", FieldType: []string{"long", "null"}},
+		{Name: "ID", FieldType: []string{"long", "null"}},
+	}}
+	if _, err := Schema(sch); err == nil {
+		t.Error("expected fields that only differ by case to be rejected")
+	}
+}
@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+const (
+	// The layout of the day partitions archived requests are kept in
+	archivePartitionLayout = "2006-01-02"
+	// The layout of the time at the start of an archived file name
+	archiveTimeLayout = "20060102T150405.000Z"
+)
+
+// What is written to the archive for every request, the caller is kept
+// separately as it is never read from a request body
+type archivedRequest struct {
+	ArchivedAt time.Time        `json:"archivedAt"`
+	Caller     string           `json:"caller"`
+	Request    *data.JTBRequest `json:"request"`
+}
+
+// An archived request as found in a listing of the archive
+type archiveEntry struct {
+	// Name The name of the object relative to the archive prefix
+	Name        string
+	ProjectID   string
+	DatasetName string
+	TableName   string
+	RequestID   string
+	ArchivedAt  time.Time
+}
+
+// Returns the name of the object a request archived at the time is kept in,
+// relative to the archive prefix
+func archiveName(jtb *data.JTBRequest, at time.Time) string {
+	at = at.UTC()
+	return path.Join(
+		fmt.Sprintf("dt=%v", at.Format(archivePartitionLayout)),
+		jtb.ProjectID,
+		jtb.DatasetName,
+		jtb.TableName,
+		fmt.Sprintf("%v_%v.json", at.Format(archiveTimeLayout), url.PathEscape(jtb.RequestID)),
+	)
+}
+
+// Parses the name of an archived object, returns false for anything that was
+// not written by archiveRequest
+func parseArchiveName(name string) (archiveEntry, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 5 || !strings.HasPrefix(parts[0], "dt=") || !strings.HasSuffix(parts[4], ".json") {
+		return archiveEntry{}, false
+	}
+	file := strings.SplitN(strings.TrimSuffix(parts[4], ".json"), "_", 2)
+	if len(file) != 2 {
+		return archiveEntry{}, false
+	}
+	at, err := time.Parse(archiveTimeLayout, file[0])
+	if err != nil {
+		return archiveEntry{}, false
+	}
+	requestID, err := url.PathUnescape(file[1])
+	if err != nil {
+		return archiveEntry{}, false
+	}
+	return archiveEntry{
+		Name:        name,
+		ProjectID:   parts[1],
+		DatasetName: parts[2],
+		TableName:   parts[3],
+		RequestID:   requestID,
+		ArchivedAt:  at,
+	}, true
+}
+
+// Encodes the request as it was received, this has to be done before it is
+// parsed as parsing changes the records
+func encodeArchivedRequest(jtb *data.JTBRequest, at time.Time) ([]byte, error) {
+	return json.Marshal(archivedRequest{ArchivedAt: at.UTC(), Caller: jtb.Caller, Request: jtb})
+}
+
+// Uploads an encoded request to the archive, failures are only logged so they
+// never fail the request
+func archiveRequest(objects backend.ObjectStore, jtb *data.JTBRequest, contents []byte, at time.Time) {
+	name := archiveName(jtb, at)
+	if err := objects.Upload(data.ArchivePrefix, name, contents); err != nil {
+		log.Printf("ERROR ARCHIVING REQUEST %v: %v", jtb.RequestID, err.Error())
+	}
+}
+
+// Lists every request in the archive, partitions that dont match are skipped
+// before their names are parsed
+func listArchive(objects backend.ObjectStore, partition func(day time.Time) bool) ([]archiveEntry, error) {
+	objectInfos, err := objects.List(data.ArchivePrefix)
+	if err != nil {
+		return nil, err
+	}
+	var entries []archiveEntry
+	for _, info := range objectInfos {
+		day, err := time.Parse(archivePartitionLayout, strings.TrimPrefix(strings.SplitN(info.Name, "/", 2)[0], "dt="))
+		if err != nil || !partition(day) {
+			continue
+		}
+		if entry, ok := parseArchiveName(info.Name); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// PruneArchive Deletes the archived requests in day partitions older than the
+// retention, returns how many were deleted
+func PruneArchive(objects backend.ObjectStore, now time.Time) (int, error) {
+	if data.ArchiveRetentionDays <= 0 {
+		return 0, nil
+	}
+	cutoff := truncateDay(now).AddDate(0, 0, -data.ArchiveRetentionDays)
+	entries, err := listArchive(objects, func(day time.Time) bool {
+		return day.Before(cutoff)
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := objects.Delete(data.ArchivePrefix, entry.Name); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// The extensions of the files staged for a load, the avsc schema files are
+// needed by the next request so are never cleaned up
+var stagedExtensions = map[string]bool{".avro": true, ".parquet": true, ".json": true}
+
+// Characters that cant be in the request ID part of a staged file name
+var unsafeStagedChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Returns the name staged files for a request are given before their
+// extension, the request ID is part of the name so requests loading the same
+// table at the same time never overwrite or clean up each others files
+func stagedName(baseName, requestID string) string {
+	return fmt.Sprintf("%v.%v", baseName, unsafeStagedChars.ReplaceAllString(requestID, "_"))
+}
+
+// Splits the name of a staged file into the name it was staged under and the
+// request ID it was staged for, files staged by older versions have no request
+// ID. Returns false if the file isnt a staged file
+func parseStagedName(fileName string) (baseName, requestID string, ok bool) {
+	ext := path.Ext(fileName)
+	if !stagedExtensions[ext] {
+		return "", "", false
+	}
+	name := strings.TrimSuffix(path.Base(fileName), ext)
+	i := strings.LastIndex(name, ".")
+	// OLDER VERSIONS STAGED TABLE.AVRO AND TABLE.LISTMAPPINGS.AVRO
+	if i < 0 || name[i+1:] == "ListMappings" {
+		return name, "", name != ""
+	}
+	return name[:i], name[i+1:], i > 0 && i < len(name)-1
+}
+
+// Deletes or archives staged files once they have been loaded, depending on
+// the staging cleanup setting. Stores that cant archive keep the files, and
+// failures are only logged so they never fail the request. Returns how many
+// files were cleaned up
+func cleanupStaged(objects backend.ObjectStore, dataset string, fileNames ...string) int {
+	cleaned := 0
+	for _, fileName := range fileNames {
+		var err error
+		switch data.StagingCleanup {
+		case "keep":
+			return cleaned
+		case "delete":
+			err = objects.Delete(dataset, fileName)
+		case "archive":
+			archiver, ok := objects.(backend.Archiver)
+			if !ok {
+				return cleaned
+			}
+			err = archiver.Archive(dataset, fileName)
+		default:
+			log.Printf("ERROR UNKNOWN STAGING CLEANUP %v, KEEPING %v", data.StagingCleanup, fileName)
+			return cleaned
+		}
+		if err != nil {
+			log.Printf("ERROR CLEANING UP STAGED FILE %v/%v: %v", dataset, fileName, err.Error())
+			continue
+		}
+		cleaned++
+	}
+	return cleaned
+}
+
+// SweepStaging Cleans up staged files that were last written before the max
+// age, these are left behind by requests that failed before their load
+// finished. Archived files and the payload archive are left alone, and temp
+// files from unfinished uploads to a local store are removed. Returns how many
+// files were cleaned up
+func SweepStaging(objects backend.ObjectStore, now time.Time) (int, error) {
+	if data.StagingMaxAgeHours <= 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-time.Duration(data.StagingMaxAgeHours) * time.Hour)
+	swept := 0
+	if fileStore, ok := objects.(*backend.FileStore); ok {
+		removed, err := fileStore.SweepTempFiles(cutoff)
+		swept += removed
+		if err != nil {
+			return swept, err
+		}
+	}
+
+	// LIST THE WHOLE STORE AS THE FILES ARE KEPT UNDER A FOLDER PER DATASET
+	objectInfos, err := objects.List("")
+	if err != nil {
+		return swept, err
+	}
+	for _, info := range objectInfos {
+		if info.Archived || !info.Updated.Before(cutoff) || strings.HasPrefix(info.Name, data.ArchivePrefix+"/") {
+			continue
+		}
+		_, requestID, ok := parseStagedName(info.Name)
+		if !ok {
+			continue
+		}
+		if cleanupStaged(objects, "", info.Name) > 0 {
+			log.Printf("SWEPT STAGED FILE %v LEFT BY REQUEST %q", info.Name, requestID)
+			swept++
+		}
+	}
+	return swept, nil
+}
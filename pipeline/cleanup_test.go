@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+func TestStagedNames(t *testing.T) {
+	if got := stagedName("events", "req/1.events"); got != "events.req_1_events" {
+		t.Errorf("expected the request ID to be made safe for a file name, got %v", got)
+	}
+
+	tests := []struct {
+		fileName  string
+		baseName  string
+		requestID string
+		ok        bool
+	}{
+		{"dataset/events.req-1.avro", "events", "req-1", true},
+		{"dataset/events.ListMappings.req-1.parquet", "events.ListMappings", "req-1", true},
+		{"dataset/events.req-1.json", "events", "req-1", true},
+		{"dataset/events.avro", "events", "", true},
+		{"dataset/events.ListMappings.avro", "events.ListMappings", "", true},
+		{"dataset/events.avsc", "", "", false},
+		{"dataset/notes.txt", "", "", false},
+	}
+	for _, test := range tests {
+		baseName, requestID, ok := parseStagedName(test.fileName)
+		if baseName != test.baseName || requestID != test.requestID || ok != test.ok {
+			t.Errorf("parseStagedName(%q) = %q, %q, %v, want %q, %q, %v", test.fileName, baseName, requestID, ok, test.baseName, test.requestID, test.ok)
+		}
+	}
+}
+
+func TestSweepStaging(t *testing.T) {
+	defer func(maxAge int, cleanup string) {
+		data.StagingMaxAgeHours, data.StagingCleanup = maxAge, cleanup
+	}(data.StagingMaxAgeHours, data.StagingCleanup)
+	data.StagingMaxAgeHours, data.StagingCleanup = 1, "delete"
+
+	root := t.TempDir()
+	objects := backend.NewFileStore(root)
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]bool{
+		"events.req-1.avro":              true,
+		"events.req-1.json":              true,
+		"events.ListMappings.req-1.avro": true,
+		"events.avsc":                    false,
+		"notes.txt":                      false,
+	}
+	for fileName := range files {
+		if err := objects.Upload("dataset", fileName, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(root, "dataset", fileName), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A FILE STAGED BY A REQUEST THAT IS STILL RUNNING IS TOO NEW TO SWEEP
+	if err := objects.Upload("dataset", "events.req-2.avro", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	files["events.req-2.avro"] = false
+
+	swept, err := SweepStaging(objects, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swept != 3 {
+		t.Errorf("expected 3 files to be swept, got %v", swept)
+	}
+	for fileName, sweep := range files {
+		_, err := os.Stat(filepath.Join(root, "dataset", fileName))
+		if sweep != os.IsNotExist(err) {
+			t.Errorf("expected %v to be swept: %v, got %v", fileName, sweep, err)
+		}
+	}
+}
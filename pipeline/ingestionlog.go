@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// IngestionLogTable The table a row is written to for every request run
+// through the pipeline, it is kept in the requests dataset unless
+// JTB_INGESTION_LOG_DATASET is set
+const IngestionLogTable = "_jtb_ingestion_log"
+
+var (
+	// The schema of the ingestion log table, the job IDs, added fields and the
+	// IDs of the requests merged into a micro batch are comma separated
+	ingestionLogSchema = avro.Schema{
+		Name:      fmt.Sprintf("%v.avro", IngestionLogTable),
+		Namespace: fmt.Sprintf("%v.avsc", IngestionLogTable),
+		Type:      "record",
+		Fields: []avro.Field{
+			{Name: "requestId", FieldType: []string{"string", "null"}},
+			{Name: "caller", FieldType: []string{"string", "null"}},
+			{Name: "projectId", FieldType: []string{"string", "null"}},
+			{Name: "datasetName", FieldType: []string{"string", "null"}},
+			{Name: "tableName", FieldType: []string{"string", "null"}},
+			{Name: "mergedRequestIds", FieldType: []string{"string", "null"}},
+			{Name: "startedAt", FieldType: []string{"long", "null"}, LogicalType: avro.TimestampMicros},
+			{Name: "status", FieldType: []string{"string", "null"}},
+			{Name: "statusCode", FieldType: []string{"long", "null"}},
+			{Name: "error", FieldType: []string{"string", "null"}},
+			{Name: "rows", FieldType: []string{"long", "null"}},
+			{Name: "rejectedRows", FieldType: []string{"long", "null"}},
+			{Name: "stagedBytes", FieldType: []string{"long", "null"}},
+			{Name: "fieldsAdded", FieldType: []string{"string", "null"}},
+			{Name: "loadJobIds", FieldType: []string{"string", "null"}},
+			{Name: "queryJobIds", FieldType: []string{"string", "null"}},
+			{Name: "parseMs", FieldType: []string{"long", "null"}},
+			{Name: "stageMs", FieldType: []string{"long", "null"}},
+			{Name: "uploadMs", FieldType: []string{"long", "null"}},
+			{Name: "prepareMs", FieldType: []string{"long", "null"}},
+			{Name: "loadMs", FieldType: []string{"long", "null"}},
+			{Name: "queryMs", FieldType: []string{"long", "null"}},
+			{Name: "totalMs", FieldType: []string{"long", "null"}},
+		},
+	}
+	// The ingestion log tables this process has already prepared, keyed by
+	// project and dataset
+	preparedIngestionLogs sync.Map
+)
+
+// What happened to a request as it went through the pipeline, each stage
+// fills in its part so whatever was done before a failure is still logged
+type ingestion struct {
+	startedAt   time.Time
+	stagedBytes int
+	fieldsAdded []string
+	loadJobIDs  []string
+	parse       time.Duration
+	stage       time.Duration
+	upload      time.Duration
+	prepare     time.Duration
+	load        time.Duration
+	query       time.Duration
+}
+
+// Returns the row written to the ingestion log for the request
+func (i *ingestion) row(jtb *data.JTBRequest, result *Result, err error) map[string]interface{} {
+	status, statusCode, errMessage := "success", http.StatusOK, ""
+	if err != nil {
+		status, statusCode, errMessage = "error", http.StatusInternalServerError, err.Error()
+		if e, ok := err.(*Error); ok {
+			statusCode = e.StatusCode
+		}
+	}
+
+	// THERE IS ONLY A RESULT ONCE THE LOAD HAS SUCCEEDED, BEFORE THAT EVERY
+	// RECORD IN THE REQUEST WAS REJECTED
+	rows, rejectedRows := 0, len(jtb.Data)
+	var queryJobIDs []string
+	if result != nil {
+		rows, rejectedRows = result.Rows, 0
+		for _, query := range result.Queries {
+			if query.JobID != "" {
+				queryJobIDs = append(queryJobIDs, query.JobID)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"requestId":        jtb.RequestID,
+		"caller":           jtb.Caller,
+		"projectId":        jtb.ProjectID,
+		"datasetName":      jtb.DatasetName,
+		"tableName":        jtb.TableName,
+		"mergedRequestIds": strings.Join(jtb.MergedRequestIDs, ","),
+		"startedAt":        i.startedAt.UTC(),
+		"status":           status,
+		"statusCode":       int64(statusCode),
+		"error":            errMessage,
+		"rows":             int64(rows),
+		"rejectedRows":     int64(rejectedRows),
+		"stagedBytes":      int64(i.stagedBytes),
+		"fieldsAdded":      strings.Join(i.fieldsAdded, ","),
+		"loadJobIds":       strings.Join(i.loadJobIDs, ","),
+		"queryJobIds":      strings.Join(queryJobIDs, ","),
+		"parseMs":          i.parse.Milliseconds(),
+		"stageMs":          i.stage.Milliseconds(),
+		"uploadMs":         i.upload.Milliseconds(),
+		"prepareMs":        i.prepare.Milliseconds(),
+		"loadMs":           i.load.Milliseconds(),
+		"queryMs":          i.query.Milliseconds(),
+		"totalMs":          time.Since(i.startedAt).Milliseconds(),
+	}
+}
+
+// Writes a row for the request to the ingestion log table, failures are only
+// logged so they never fail the request
+func writeIngestionLog(clients *Clients, jtb *data.JTBRequest, i *ingestion, result *Result, err error) {
+	datasetID := data.IngestionLogDataset
+	if datasetID == "" {
+		datasetID = jtb.DatasetName
+	}
+	row := i.row(jtb, result, err)
+
+	// THE SCHEMA NEVER CHANGES SO THE TABLE IS ONLY PREPARED ONCE PER DATASET,
+	// IF THE INSERT FAILS IT IS PREPARED AGAIN IN CASE THE TABLE WAS DROPPED
+	key := fmt.Sprintf("%v.%v", jtb.ProjectID, datasetID)
+	_, prepared := preparedIngestionLogs.Load(key)
+	for {
+		if !prepared {
+			if err := clients.Warehouse.PrepareTable(datasetID, IngestionLogTable, ingestionLogSchema, backend.TableOptions{}); err != nil {
+				log.Printf("ERROR PREPARING INGESTION LOG %v: %v", key, err.Error())
+				return
+			}
+			preparedIngestionLogs.Store(key, true)
+		}
+		err := clients.Warehouse.InsertRows(datasetID, IngestionLogTable, []map[string]interface{}{row})
+		if err == nil {
+			return
+		}
+		if !prepared {
+			log.Printf("ERROR WRITING INGESTION LOG FOR REQUEST %v: %v", jtb.RequestID, err.Error())
+			return
+		}
+		preparedIngestionLogs.Delete(key)
+		prepared = false
+	}
+}
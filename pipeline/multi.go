@@ -0,0 +1,206 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Characters that cant be used in the name of a load table
+var unsafeTableChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Returns the name of the table a request that is all or nothing is loaded
+// into before it is committed, the _jtb_ prefix means records cant be routed
+// to it
+func loadTableName(jtb *data.JTBRequest) string {
+	return "_jtb_load_" + unsafeTableChars.ReplaceAllString(jtb.RequestID, "_")
+}
+
+// The barriers the requests in an all or nothing multi table request wait at.
+// The first opens once every request has either got as far as the load or
+// failed, and only lets them load if none of them failed. Each table is then
+// loaded into its own load table, and once every load has either finished or
+// failed the load tables are appended to their tables together and dropped
+type loadGate struct {
+	arrived   sync.WaitGroup
+	loaded    sync.WaitGroup
+	committed chan struct{}
+	mu        sync.Mutex
+	failed    string
+	copies    []backend.TableCopy
+	commitErr error
+}
+
+// One requests place at a load gate, a nil entry is a request that doesnt
+// wait for any others
+type gateEntry struct {
+	gate       *loadGate
+	table      string
+	arriveOnce sync.Once
+	loadOnce   sync.Once
+}
+
+// Returns the places at a new gate for every request, the load tables are
+// committed in the background once every request has been loaded
+func newLoadGate(clients *Clients, requests []*data.JTBRequest) []*gateEntry {
+	gate := &loadGate{committed: make(chan struct{})}
+	gate.arrived.Add(len(requests))
+	gate.loaded.Add(len(requests))
+	entries := make([]*gateEntry, len(requests))
+	for i, jtb := range requests {
+		entries[i] = &gateEntry{gate: gate, table: jtb.TableName}
+	}
+	if len(requests) > 0 {
+		go gate.commit(clients, requests[0].DatasetName)
+	}
+	return entries
+}
+
+// Records the table as failed, only the first failure is kept
+func (g *loadGate) fail(table string) {
+	g.mu.Lock()
+	if g.failed == "" {
+		g.failed = table
+	}
+	g.mu.Unlock()
+}
+
+// Waits for every request to be loaded, appends the load tables to their
+// tables if none of them failed, then drops the load tables
+func (g *loadGate) commit(clients *Clients, datasetID string) {
+	defer close(g.committed)
+	g.loaded.Wait()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failed == "" && len(g.copies) > 0 {
+		g.commitErr = clients.Warehouse.AppendTables(datasetID, g.copies)
+	}
+	for _, c := range g.copies {
+		if err := clients.Warehouse.DropTable(datasetID, c.Source); err != nil {
+			log.Printf("ERROR DROPPING LOAD TABLE %v: %v", c.Source, err.Error())
+		}
+	}
+}
+
+// Marks the request as having arrived at the first gate, only the first
+// arrival counts
+func (e *gateEntry) arrive(ready bool) {
+	if e == nil {
+		return
+	}
+	e.arriveOnce.Do(func() {
+		if !ready {
+			e.gate.fail(e.table)
+		}
+		e.gate.arrived.Done()
+	})
+}
+
+// Waits for every request to arrive, returns an error if any of them failed
+func (e *gateEntry) wait() error {
+	if e == nil {
+		return nil
+	}
+	e.gate.arrived.Wait()
+	e.gate.mu.Lock()
+	defer e.gate.mu.Unlock()
+	if e.gate.failed != "" {
+		return fmt.Errorf("%v was not loaded as %v failed", e.table, e.gate.failed)
+	}
+	return nil
+}
+
+// Marks the request as ready to load and waits for the rest
+func (e *gateEntry) ready() error {
+	e.arrive(true)
+	return e.wait()
+}
+
+// Marks the request as loaded into the load table it is copied from, a nil
+// copy is a request that failed, only the first call counts
+func (e *gateEntry) load(copy *backend.TableCopy) {
+	if e == nil {
+		return
+	}
+	e.loadOnce.Do(func() {
+		if copy == nil {
+			e.gate.fail(e.table)
+		} else {
+			e.gate.mu.Lock()
+			e.gate.copies = append(e.gate.copies, *copy)
+			e.gate.mu.Unlock()
+		}
+		e.gate.loaded.Done()
+	})
+}
+
+// Waits for the load tables to be committed, returns a 424 if another table
+// failed or a 500 if the commit did
+func (e *gateEntry) committed() error {
+	if e == nil {
+		return nil
+	}
+	<-e.gate.committed
+	e.gate.mu.Lock()
+	defer e.gate.mu.Unlock()
+	if e.gate.failed != "" {
+		return newError(http.StatusFailedDependency, fmt.Errorf("%v was not loaded as %v failed", e.table, e.gate.failed))
+	}
+	if e.gate.commitErr != nil {
+		return newError(http.StatusInternalServerError, e.gate.commitErr)
+	}
+	return nil
+}
+
+// RunMulti Runs the requests for a multi table request through the pipeline
+// at the same time with the same clients, returns the result of each in the
+// same order. When allOrNothing is set either every table is loaded or none
+// of them are, otherwise each table is loaded on its own. The post load
+// statements and ListMappings are ran after the tables are committed, so they
+// arent undone if they fail
+func RunMulti(clients *Clients, requests []*data.JTBRequest, allOrNothing bool) []data.TableResult {
+	var (
+		entries = make([]*gateEntry, len(requests))
+		results = make([]data.TableResult, len(requests))
+		wg      sync.WaitGroup
+	)
+	if allOrNothing {
+		entries = newLoadGate(clients, requests)
+	}
+	for i, jtb := range requests {
+		wg.Add(1)
+		go func(i int, jtb *data.JTBRequest) {
+			defer wg.Done()
+			result, err := runLogged(clients, jtb, runOptions{archive: data.Archive, gate: entries[i]})
+			// A REQUEST THAT FAILED BEFORE IT GOT TO THE GATES STILL HAS TO ARRIVE
+			entries[i].arrive(false)
+			entries[i].load(nil)
+			results[i] = tableResult(jtb, result, err)
+		}(i, jtb)
+	}
+	wg.Wait()
+	return results
+}
+
+// Returns the result reported for one of the tables in a multi table request
+func tableResult(jtb *data.JTBRequest, result *Result, err error) data.TableResult {
+	tableResult := data.TableResult{Table: jtb.TableName, RequestID: jtb.RequestID, Status: "success", StatusCode: http.StatusOK}
+	if result != nil {
+		tableResult.Rows = result.Rows
+		tableResult.Queries = result.Queries
+		tableResult.Compression = result.Compression
+		tableResult.Schema = result.Schema
+	}
+	if err != nil {
+		tableResult.Status, tableResult.StatusCode, tableResult.Error = "error", http.StatusInternalServerError, err.Error()
+		if e, ok := err.(*Error); ok {
+			tableResult.StatusCode = e.StatusCode
+		}
+	}
+	return tableResult
+}
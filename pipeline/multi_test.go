@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Returns a request for a table in the test dataset
+func testRequest(table string, records ...map[string]interface{}) *data.JTBRequest {
+	jtb := data.NewJTB()
+	jtb.ProjectID, jtb.DatasetName, jtb.TableName, jtb.IdField = "project", "dataset", table, "id"
+	jtb.Data = records
+	return jtb
+}
+
+func TestRunMultiAllOrNothing(t *testing.T) {
+	for _, allOrNothing := range []bool{true, false} {
+		clients := &Clients{Objects: backend.NewFileStore(t.TempDir()), Warehouse: backend.NewMemoryWarehouse()}
+		if _, err := RunWithClients(clients, testRequest("customers", map[string]interface{}{"id": 1})); err != nil {
+			t.Fatal(err)
+		}
+
+		// THE CUSTOMERS ID CHANGES TYPE SO THAT TABLE FAILS BEFORE THE LOAD
+		results := RunMulti(clients, []*data.JTBRequest{
+			testRequest("orders", map[string]interface{}{"id": 1}),
+			testRequest("customers", map[string]interface{}{"id": "c1"}),
+		}, allOrNothing)
+
+		if results[1].StatusCode != http.StatusConflict {
+			t.Errorf("expected the customers table to fail with a 409, got %+v", results[1])
+		}
+		orders, loaded := clients.Warehouse.(*backend.MemoryWarehouse).Table("dataset", "orders")
+		loaded = loaded && len(orders.Rows) == 1
+		if allOrNothing && (loaded || results[0].StatusCode != http.StatusFailedDependency) {
+			t.Errorf("expected orders not to be loaded with a 424, got %+v", results[0])
+		}
+		if !allOrNothing && (!loaded || results[0].StatusCode != http.StatusOK) {
+			t.Errorf("expected orders to be loaded on its own, got %+v", results[0])
+		}
+	}
+}
+
+// A memory warehouse where loading a staged file for the table fails
+type failingLoadWarehouse struct {
+	*backend.MemoryWarehouse
+	table string
+}
+
+func (w failingLoadWarehouse) LoadFile(objects backend.ObjectStore, datasetID, tableID, fileName string) (string, error) {
+	if strings.HasPrefix(fileName, w.table+".") {
+		return "", errors.New("load failed")
+	}
+	return w.MemoryWarehouse.LoadFile(objects, datasetID, tableID, fileName)
+}
+
+func TestRunMultiAllOrNothingCommitsTogether(t *testing.T) {
+	for _, failing := range []string{"", "customers"} {
+		warehouse := backend.NewMemoryWarehouse()
+		clients := &Clients{Objects: backend.NewFileStore(t.TempDir()), Warehouse: failingLoadWarehouse{warehouse, failing}}
+		requests := []*data.JTBRequest{
+			testRequest("orders", map[string]interface{}{"id": 1}),
+			testRequest("customers", map[string]interface{}{"id": 2}),
+		}
+
+		// THE CUSTOMERS LOAD FAILS AFTER THE ORDERS ARE ALREADY IN THEIR LOAD TABLE
+		results := RunMulti(clients, requests, true)
+		for i, jtb := range requests {
+			table, _ := warehouse.Table("dataset", jtb.TableName)
+			if failing == "" && (results[i].StatusCode != http.StatusOK || len(table.Rows) != 1) {
+				t.Errorf("expected %v to be loaded, got %+v with %v rows", jtb.TableName, results[i], len(table.Rows))
+			}
+			if failing != "" && len(table.Rows) != 0 {
+				t.Errorf("expected %v not to be loaded, got %v rows", jtb.TableName, len(table.Rows))
+			}
+			if _, ok := warehouse.Table("dataset", loadTableName(jtb)); ok {
+				t.Errorf("expected the load table for %v to be dropped", jtb.TableName)
+			}
+		}
+		if failing != "" && (results[0].StatusCode != http.StatusFailedDependency || results[1].StatusCode != http.StatusInternalServerError) {
+			t.Errorf("expected orders to fail with a 424 and customers with a 500, got %+v", results)
+		}
+	}
+}
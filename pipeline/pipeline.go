@@ -0,0 +1,502 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/gcp"
+	"github.com/BenHiramTaylor/JSONToBigQuery/parquet"
+	"github.com/BenHiramTaylor/JSONToBigQuery/sqldb"
+)
+
+// Error An error from one of the stages of the pipeline, includes the http
+// status code it should be reported with
+type Error struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Wraps an error in a pipeline error with the status code
+func newError(statusCode int, err error) *Error {
+	return &Error{StatusCode: statusCode, Err: err}
+}
+
+var (
+	// Size of the avro encoded records before compression, by codec
+	stagedUncompressedBytes = expvar.NewMap("jtb_staged_uncompressed_bytes")
+	// Size of the staged avro files, by codec
+	stagedCompressedBytes = expvar.NewMap("jtb_staged_compressed_bytes")
+)
+
+func init() {
+	expvar.Publish("jtb_compression_ratio", expvar.Func(compressionRatios))
+}
+
+// Result The outcome of running a request through the pipeline
+type Result struct {
+	Rows        int
+	Queries     []data.QueryResult
+	Compression *data.CompressionStats
+	Schema      *data.SchemaChanges
+	// Tables The outcome of each table the records were routed to, only set
+	// for requests with routing rules
+	Tables []data.TableResult
+}
+
+// Clients The object store and warehouse used by the pipeline, these can be
+// shared between runs for the same project
+type Clients struct {
+	Objects   backend.ObjectStore
+	Warehouse backend.Warehouse
+}
+
+// NewClients Creates the clients for a project, defaults to the backends
+// chosen in the config, replace it to run the pipeline against other backends
+var NewClients = NewConfiguredClients
+
+// NewConfiguredClients Constructor func, creates the object store and the
+// warehouse chosen by the staging backend and warehouse settings, the bigquery
+// warehouse uses the creds file from the env
+func NewConfiguredClients(projectID string) (*Clients, error) {
+	objects, err := NewObjectStore()
+	if err != nil {
+		return nil, err
+	}
+	warehouse, err := newWarehouse(projectID)
+	if err != nil {
+		objects.Close()
+		return nil, err
+	}
+	return &Clients{Objects: objects, Warehouse: warehouse}, nil
+}
+
+// Creates the warehouse chosen by the warehouse setting
+func newWarehouse(projectID string) (backend.Warehouse, error) {
+	switch data.WarehouseBackend {
+	case "bigquery":
+		// CREATING BQ CLIENT
+		bigqueryClient, err := gcp.NewBigQuery(data.CredsFilePath, projectID)
+		if err != nil {
+			log.Printf("ERROR CREATING BQ CLIENT: %v", err.Error())
+			return nil, newError(http.StatusInternalServerError, err)
+		}
+		if bigqueryClient.Client == nil {
+			return nil, newError(http.StatusBadRequest, fmt.Errorf("Authentication JSON passed invalid."))
+		}
+		return bigqueryClient, nil
+	case "sqlite", "postgres":
+		warehouse, err := sqldb.New(data.WarehouseBackend, data.WarehouseDSN)
+		if err != nil {
+			log.Printf("ERROR OPENING %v WAREHOUSE: %v", data.WarehouseBackend, err.Error())
+			return nil, newError(http.StatusInternalServerError, err)
+		}
+		return warehouse, nil
+	default:
+		return nil, newError(http.StatusInternalServerError, fmt.Errorf("unknown warehouse: %v", data.WarehouseBackend))
+	}
+}
+
+// NewObjectStore Creates the object store chosen by the staging backend setting
+func NewObjectStore() (backend.ObjectStore, error) {
+	switch data.StagingBackend {
+	case "local":
+		return backend.NewFileStore(data.StagingRoot), nil
+	case "gcs":
+		// CREATE A STORAGE CLIENT TO TEST THE AUTH
+		storageClient, err := gcp.NewStorage(data.CredsFilePath, data.BucketName)
+		if err != nil {
+			log.Printf("ERROR CREATING GCS CLIENT: %v", err.Error())
+			return nil, newError(http.StatusInternalServerError, err)
+		}
+		if storageClient.Client == nil {
+			return nil, newError(http.StatusBadRequest, fmt.Errorf("Authentication JSON passed invalid."))
+		}
+		return storageClient, nil
+	default:
+		return nil, newError(http.StatusInternalServerError, fmt.Errorf("unknown staging backend: %v", data.StagingBackend))
+	}
+}
+
+// Close Closes both of the clients
+func (c *Clients) Close() {
+	c.Objects.Close()
+	c.Warehouse.Close()
+}
+
+// Run Creates the clients for the request and runs it through the pipeline
+func Run(jtb *data.JTBRequest) (*Result, error) {
+	clients, err := NewClients(jtb.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	defer clients.Close()
+	return RunWithClients(clients, jtb)
+}
+
+// RunWithClients Parses the records in the request into avro, stages the files
+// in the object store, updates the table schema, loads the data and then runs
+// any post load statements. The request is archived so it can be replayed, and
+// a row is written to the ingestion log whether it succeeds or not. Requests
+// with routing rules are split into a request per table first
+func RunWithClients(clients *Clients, jtb *data.JTBRequest) (*Result, error) {
+	if jtb.Routing != nil {
+		return runRouted(clients, jtb)
+	}
+	return runLogged(clients, jtb, runOptions{archive: data.Archive})
+}
+
+// How a request is ran through the pipeline
+type runOptions struct {
+	// Whether the request is archived, replayed requests are already in the
+	// archive so are not archived again
+	archive bool
+	// The gate the load waits at, for requests that are only loaded if the
+	// others in the same multi table request are too
+	gate *gateEntry
+}
+
+// Runs the request through the pipeline and writes its ingestion log row
+func runLogged(clients *Clients, jtb *data.JTBRequest, opts runOptions) (*Result, error) {
+	if jtb.RequestID == "" {
+		jtb.RequestID = data.NewRequestID()
+	}
+	audit := &ingestion{startedAt: time.Now()}
+	result, err := run(clients, jtb, audit, opts)
+	if data.IngestionLog {
+		writeIngestionLog(clients, jtb, audit, result, err)
+	}
+	return result, err
+}
+
+// Runs the request through each stage of the pipeline, recording what was
+// done in the ingestion
+func run(clients *Clients, jtb *data.JTBRequest, audit *ingestion, opts runOptions) (*Result, error) {
+	// CREATE LIST OF FILE NAMES AND STORAGE WG
+	var (
+		avscFile       = fmt.Sprintf("%v.avsc", jtb.TableName)
+		stagedBase     = stagedName(jtb.TableName, jtb.RequestID)
+		jsonFile       = fmt.Sprintf("%v.json", stagedBase)
+		fileUploadWg   sync.WaitGroup
+		listMappingsWg sync.WaitGroup
+		archiveWg      sync.WaitGroup
+		uploadErr      error
+		uploadTime     time.Duration
+		stageStart     = time.Now()
+	)
+
+	// GET TIMESTAMP FORMAT OR USE DEFAULT
+	if jtb.TimestampFormat == "" {
+		jtb.TimestampFormat = time.RFC3339
+	}
+
+	// CREATE BUCKET IF NOT BEEN MADE BEFORE
+	err := clients.Objects.Prepare(jtb.ProjectID)
+	audit.upload += time.Since(stageStart)
+	if err != nil {
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+
+	// ARCHIVE THE REQUEST AS IT WAS SENT, IT IS ENCODED BEFORE PARSING CHANGES IT
+	if opts.archive {
+		archived, err := encodeArchivedRequest(jtb, audit.startedAt)
+		if err != nil {
+			log.Printf("ERROR ENCODING REQUEST %v FOR THE ARCHIVE: %v", jtb.RequestID, err.Error())
+		} else {
+			archiveWg.Add(1)
+			go func() {
+				archiveRequest(clients.Objects, jtb, archived, audit.startedAt)
+				archiveWg.Done()
+			}()
+			defer archiveWg.Wait()
+		}
+	}
+
+	// DOWNLOAD THE EXISTING SCHEMA IF THERE IS ONE
+	stageStart = time.Now()
+	avscData, err := clients.Objects.Download(jtb.DatasetName, avscFile)
+	if err != nil && err != backend.ErrObjectNotExist {
+		log.Printf("ERROR DOWNLOADING SCHEMA: %v", err.Error())
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+
+	// BEGIN PARSING THE REQUEST USING THE AVRO MODULE, THIS FORMATS DATA AND CREATES SCHEMA
+	s, formattedData, ListMappings, changes, err := avro.ParseRequest(jtb, avscData)
+	audit.parse = time.Since(stageStart)
+	if changes != nil {
+		audit.fieldsAdded = changes.AddedFields
+	}
+	if err != nil {
+		switch err.(type) {
+		case *avro.PolicyError:
+			return nil, newError(http.StatusBadRequest, err)
+		case *avro.TypeConflictError:
+			return nil, newError(http.StatusConflict, err)
+		}
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+
+	// START GOROUTINE FOR PARSING LIST MAPPINGS
+	listMappingsWg.Add(1)
+	go func() {
+		parseListMappings(clients, jtb, ListMappings, opts.gate)
+		listMappingsWg.Done()
+	}()
+	defer listMappingsWg.Wait()
+	// THE LIST MAPPINGS WAIT FOR THE COMMIT, SO A FAILURE HAS TO REACH BOTH
+	// GATES BEFORE WAITING FOR THEM
+	defer opts.gate.load(nil)
+	defer opts.gate.arrive(false)
+
+	// PARSE OUR AVSC DATA THROUGH THE ENCODER FOR THE STAGING FORMAT
+	stageStart = time.Now()
+	staged, err := StageRecords(stagedBase, s, formattedData, jtb.Compression)
+	if err != nil {
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+	audit.stagedBytes = len(staged.Bytes)
+	schemaBytes, err := s.ToJSON()
+	if err != nil {
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+	jsonBytes, err := json.Marshal(formattedData)
+	if err != nil {
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+	audit.stage = time.Since(stageStart)
+
+	// UPLOAD ALL THE FILES
+	fileUploadWg.Add(1)
+	go func() {
+		defer fileUploadWg.Done()
+		uploadStart := time.Now()
+		defer func() { uploadTime = time.Since(uploadStart) }()
+		uploadErr = uploadFiles(clients.Objects, jtb.DatasetName, map[string][]byte{
+			avscFile:    schemaBytes,
+			jsonFile:    jsonBytes,
+			staged.Name: staged.Bytes,
+		})
+	}()
+
+	// CREATE TABLE AND ADD ANY NEW SCHEMA USING SCHEMA FIELD NAMES
+	stageStart = time.Now()
+	err = clients.Warehouse.PrepareTable(jtb.DatasetName, jtb.TableName, s, backend.TableOptions{
+		SchemaPolicy:       jtb.SchemaPolicy,
+		TypeChangeStrategy: jtb.TypeChangeStrategy,
+		FieldMetadata:      jtb.FieldMetadata,
+	})
+	audit.prepare = time.Since(stageStart)
+
+	// WAIT FOR THE FILE UPLOAD TO FINISH IF NOT DONE
+	fileUploadWg.Wait()
+	audit.upload += uploadTime
+	if _, ok := err.(*avro.TypeConflictError); ok {
+		return nil, newError(http.StatusConflict, err)
+	}
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, err)
+	}
+	if uploadErr != nil {
+		return nil, newError(http.StatusInternalServerError, uploadErr)
+	}
+
+	// WAIT FOR THE OTHER TABLES IN THE REQUEST TO BE READY TO LOAD
+	if err := opts.gate.ready(); err != nil {
+		cleanupStaged(clients.Objects, jtb.DatasetName, staged.Name, jsonFile)
+		return nil, newError(http.StatusFailedDependency, err)
+	}
+
+	// LOAD THE STAGED DATA, AN ALL OR NOTHING REQUEST IS LOADED INTO ITS OWN
+	// TABLE FIRST AND COMMITTED WITH THE OTHER TABLES ONCE THEY ARE ALL LOADED
+	stageStart = time.Now()
+	loadTable := jtb.TableName
+	if opts.gate != nil {
+		loadTable = loadTableName(jtb)
+		if err = clients.Warehouse.PrepareTable(jtb.DatasetName, loadTable, s, backend.TableOptions{}); err != nil {
+			return nil, newError(http.StatusInternalServerError, err)
+		}
+	}
+	jobID, err := clients.Warehouse.LoadFile(clients.Objects, jtb.DatasetName, loadTable, staged.Name)
+	audit.load = time.Since(stageStart)
+	if jobID != "" {
+		audit.loadJobIDs = append(audit.loadJobIDs, jobID)
+	}
+	if err != nil {
+		if opts.gate != nil {
+			if dropErr := clients.Warehouse.DropTable(jtb.DatasetName, loadTable); dropErr != nil {
+				log.Printf("ERROR DROPPING LOAD TABLE %v: %v", loadTable, dropErr.Error())
+			}
+		}
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+	if opts.gate != nil {
+		opts.gate.load(&backend.TableCopy{Source: loadTable, Destination: jtb.TableName})
+		if err := opts.gate.committed(); err != nil {
+			cleanupStaged(clients.Objects, jtb.DatasetName, staged.Name, jsonFile)
+			return nil, err
+		}
+	}
+
+	// CLEAN UP THE STAGED FILES NOW THEY ARE LOADED, THE SCHEMA IS KEPT FOR THE
+	// NEXT REQUEST
+	cleanupStaged(clients.Objects, jtb.DatasetName, staged.Name, jsonFile)
+	result := &Result{Rows: len(formattedData), Compression: staged.Compression, Schema: changes}
+
+	// RUN THE POST LOAD STATEMENTS IN ORDER
+	stageStart = time.Now()
+	result.Queries, err = clients.Warehouse.ExecuteQueries(jtb.DatasetName, jtb.RequestID, jtb.Statements())
+	audit.query = time.Since(stageStart)
+	if err != nil {
+		return result, newError(http.StatusInternalServerError, err)
+	}
+	return result, nil
+}
+
+// The columns that identify a ListMappings row, the lineage columns are left
+// out so the same mapping loaded by another request is still a duplicate
+var listMappingsKey = []string{"tableName", "idField", "Key", "Value"}
+
+// If there are list mappings to parse, it will create the avro files, and load
+// them to a generic ListMappings table in the dataset once the tables in the
+// request are committed
+func parseListMappings(clients *Clients, request *data.JTBRequest, ListMappings []map[string]interface{}, gate *gateEntry) {
+	var (
+		storageWg  sync.WaitGroup
+		listSchema = avro.Schema{
+			Name:      fmt.Sprintf("%v.ListMappings.avro", request.TableName),
+			Namespace: fmt.Sprintf("%v.ListMappings.avsc", request.TableName),
+			Type:      "record",
+			Fields: []avro.Field{
+				{Name: "tableName", FieldType: []string{"string", "null"}},
+				{Name: "idField", FieldType: []string{"string", "null"}},
+				{Name: "Key", FieldType: []string{"string", "null"}},
+				{Name: "Value", FieldType: []string{"string", "null"}},
+			},
+		}
+		uploadErr error
+	)
+	listSchema.AddLineageFields()
+	log.Printf("LIST SCHEMA: %#v", listSchema)
+	log.Printf("Finished Parsing all list mappings: %v", ListMappings)
+	if len(ListMappings) == 0 {
+		return
+	}
+	// PARSE OUR AVSC DATA THROUGH THE ENCODER FOR THE STAGING FORMAT
+	staged, err := StageRecords(stagedName(fmt.Sprintf("%v.ListMappings", request.TableName), request.RequestID), listSchema, ListMappings, request.Compression)
+	if err != nil {
+		log.Printf("ERROR PARSING LIST MAPPINGS: %v", err.Error())
+		return
+	}
+
+	storageWg.Add(1)
+	go func() {
+		// UPLOAD FILE TO BUCKET
+		uploadErr = clients.Objects.Upload(request.DatasetName, staged.Name, staged.Bytes)
+		if uploadErr != nil {
+			log.Printf("ERROR UPLOADING STAGED FILE: %v %v", staged.Name, uploadErr.Error())
+		}
+		storageWg.Done()
+	}()
+	// CREATE TABLE AND ADD ANY NEW SCHEMA USING SCHEMA FIELD NAMES
+	err = clients.Warehouse.PrepareTable(request.DatasetName, "ListMappings", listSchema, backend.TableOptions{})
+	storageWg.Wait()
+	if err != nil {
+		log.Println("ERROR PREPARING TABLE: ListMappings")
+		return
+	}
+	if uploadErr != nil {
+		return
+	}
+	if err := gate.committed(); err != nil {
+		log.Printf("NOT LOADING LISTMAPPINGS FOR %v: %v", request.TableName, err.Error())
+		cleanupStaged(clients.Objects, request.DatasetName, staged.Name)
+		return
+	}
+	// LOAD THE STAGED DATA
+	_, err = clients.Warehouse.LoadFile(clients.Objects, request.DatasetName, "ListMappings", staged.Name)
+	if err != nil {
+		log.Printf("ERROR LOADING LISTMAPPINGS TABLE: %v", err.Error())
+		return
+	}
+	cleanupStaged(clients.Objects, request.DatasetName, staged.Name)
+	err = clients.Warehouse.DeduplicateTable(request.ProjectID, request.DatasetName, "ListMappings", listMappingsKey)
+	if err != nil {
+		log.Println("Failed to run ListMappings De-duplicate")
+		return
+	}
+}
+
+// StagedFile Records encoded in the staging format, ready to be uploaded
+type StagedFile struct {
+	Name  string
+	Bytes []byte
+	// Compression How well the records compressed, only set for avro files
+	Compression *data.CompressionStats
+}
+
+// StageRecords Encodes the records in the staging format, avro files are
+// compressed using the compression settings
+func StageRecords(baseName string, sch avro.Schema, records []map[string]interface{}, compression data.JTBCompression) (*StagedFile, error) {
+	switch data.StagingFormat {
+	case "avro":
+		compression = compression.WithDefaults()
+		avroBytes, err := sch.WriteRecords(records, compression)
+		if err != nil {
+			return nil, err
+		}
+		stats := &data.CompressionStats{
+			Codec:             compression.Codec,
+			UncompressedBytes: sch.EncodedSize(records),
+			CompressedBytes:   int64(len(avroBytes)),
+		}
+		if stats.CompressedBytes > 0 {
+			stats.Ratio = float64(stats.UncompressedBytes) / float64(stats.CompressedBytes)
+		}
+		stagedUncompressedBytes.Add(stats.Codec, stats.UncompressedBytes)
+		stagedCompressedBytes.Add(stats.Codec, stats.CompressedBytes)
+		return &StagedFile{Name: fmt.Sprintf("%v.avro", baseName), Bytes: avroBytes, Compression: stats}, nil
+	case "parquet":
+		parquetBytes, err := parquet.WriteRecords(sch, records)
+		if err != nil {
+			return nil, err
+		}
+		return &StagedFile{Name: fmt.Sprintf("%v.parquet", baseName), Bytes: parquetBytes}, nil
+	default:
+		return nil, fmt.Errorf("unknown staging format: %v", data.StagingFormat)
+	}
+}
+
+// Returns the compression ratio of all the avro files staged for each codec
+func compressionRatios() interface{} {
+	ratios := make(map[string]float64)
+	stagedCompressedBytes.Do(func(kv expvar.KeyValue) {
+		compressed := kv.Value.(*expvar.Int).Value()
+		if uncompressed, ok := stagedUncompressedBytes.Get(kv.Key).(*expvar.Int); ok && compressed > 0 {
+			ratios[kv.Key] = float64(uncompressed.Value()) / float64(compressed)
+		}
+	})
+	return ratios
+}
+
+func uploadFiles(objects backend.ObjectStore, dataSetName string, files map[string][]byte) error {
+	// UPLOAD FILES TO BUCKET
+	for f, contents := range files {
+		err := objects.Upload(dataSetName, f, contents)
+		if err != nil {
+			log.Printf("ERROR UPLOADING FILE: %v %v", f, err.Error())
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Replay Loads the archived requests picked by the replay request again, in
+// the order they were archived. Each one is run as a new request so it gets
+// its own ingestion log row, and is not archived a second time. A request that
+// fails is reported in its result and does not stop the rest
+func Replay(clients *Clients, replay *data.ReplayRequest) ([]data.ReplayResult, error) {
+	// ONLY THE DAY PARTITIONS IN THE TIME RANGE NEED TO BE LISTED
+	entries, err := listArchive(clients.Objects, func(day time.Time) bool {
+		if !replay.From.IsZero() && day.Before(truncateDay(replay.From)) {
+			return false
+		}
+		return replay.To.IsZero() || !day.After(replay.To.UTC())
+	})
+	if err != nil {
+		return nil, newError(http.StatusInternalServerError, err)
+	}
+	var matched []archiveEntry
+	for _, entry := range entries {
+		if replay.Matches(entry.ProjectID, entry.DatasetName, entry.TableName, entry.RequestID, entry.ArchivedAt) {
+			matched = append(matched, entry)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, newError(http.StatusNotFound, fmt.Errorf("no archived requests match the replay"))
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].ArchivedAt.Before(matched[j].ArchivedAt)
+	})
+
+	results := make([]data.ReplayResult, 0, len(matched))
+	for _, entry := range matched {
+		result := data.ReplayResult{RequestID: entry.RequestID, ArchivedAt: entry.ArchivedAt, Status: "success"}
+		rows, jtb, err := replayEntry(clients, replay, entry)
+		if jtb != nil {
+			result.ReplayRequestID = jtb.RequestID
+			result.Table = fmt.Sprintf("%v.%v", jtb.DatasetName, jtb.TableName)
+		}
+		result.Rows = rows
+		if err != nil {
+			log.Printf("ERROR REPLAYING REQUEST %v: %v", entry.RequestID, err.Error())
+			result.Status, result.Error = "error", err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Downloads one archived request and runs it through the pipeline again
+func replayEntry(clients *Clients, replay *data.ReplayRequest, entry archiveEntry) (int, *data.JTBRequest, error) {
+	contents, err := clients.Objects.Download(data.ArchivePrefix, entry.Name)
+	if err != nil {
+		return 0, nil, err
+	}
+	var archived archivedRequest
+	if err := json.Unmarshal(contents, &archived); err != nil {
+		return 0, nil, err
+	}
+	if archived.Request == nil {
+		return 0, nil, fmt.Errorf("archived request %v is empty", entry.Name)
+	}
+	jtb := archived.Request
+	jtb.RequestID = data.NewRequestID()
+	jtb.Caller = fmt.Sprintf("replay:%v", archived.Caller)
+	if replay.TargetDatasetName != "" {
+		jtb.DatasetName = replay.TargetDatasetName
+	}
+	if replay.TargetTableName != "" {
+		jtb.TableName = replay.TargetTableName
+	}
+	if err := jtb.Validate(); err != nil {
+		return 0, jtb, err
+	}
+	result, err := runLogged(clients, jtb, runOptions{})
+	if result == nil {
+		return 0, jtb, err
+	}
+	return result.Rows, jtb, err
+}
+
+// Returns the start of the day the time is in, in UTC
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
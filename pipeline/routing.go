@@ -0,0 +1,49 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Splits a request with routing rules into a request per table and runs them
+// at the same time, each gets its own schema, table and load. The post load
+// statements are ran once after every table has loaded
+func runRouted(clients *Clients, jtb *data.JTBRequest) (*Result, error) {
+	if jtb.RequestID == "" {
+		jtb.RequestID = data.NewRequestID()
+	}
+	requests, err := jtb.RouteRecords()
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, err)
+	}
+
+	result := &Result{Tables: RunMulti(clients, requests, jtb.Routing.AllOrNothing)}
+	var (
+		failed     []string
+		statusCode int
+	)
+	for _, table := range result.Tables {
+		if table.Status == "success" {
+			result.Rows += table.Rows
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%v: %v", table.Table, table.Error))
+		// A TABLE THAT FAILED BECAUSE ANOTHER ONE DID DOESNT DECIDE THE STATUS
+		if statusCode == 0 || statusCode == http.StatusFailedDependency {
+			statusCode = table.StatusCode
+		}
+	}
+	if len(failed) > 0 {
+		return result, newError(statusCode, fmt.Errorf("%v of %v routed tables failed, %v", len(failed), len(result.Tables), strings.Join(failed, ", ")))
+	}
+
+	// RUN THE POST LOAD STATEMENTS IN ORDER
+	result.Queries, err = clients.Warehouse.ExecuteQueries(jtb.DatasetName, jtb.RequestID, jtb.Statements())
+	if err != nil {
+		return result, newError(http.StatusInternalServerError, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// ErrBusy Returned when a request could not be admitted, either because the
+// queue is full or it timed out waiting for a slot
+var ErrBusy = errors.New("server is busy, try again later")
+
+// Requests The process wide admission control for incoming requests
+var Requests = NewAdmission(data.MaxConcurrentRequests, data.MaxQueuedRequests, time.Duration(data.QueueTimeoutSeconds)*time.Second)
+
+var (
+	requestsActive   = expvar.NewInt("jtb_requests_active")
+	requestsQueued   = expvar.NewInt("jtb_requests_queued")
+	requestsRejected = expvar.NewInt("jtb_requests_rejected")
+)
+
+// Admission Limits the number of requests being processed at once, queueing
+// the rest up to a max queue length and timeout
+type Admission struct {
+	slots    chan struct{}
+	queued   int64
+	maxQueue int64
+	Timeout  time.Duration
+}
+
+// NewAdmission Constructor func, returns an admission controller
+func NewAdmission(maxConcurrent, maxQueued int, timeout time.Duration) *Admission {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Admission{slots: make(chan struct{}, maxConcurrent), maxQueue: int64(maxQueued), Timeout: timeout}
+}
+
+// Acquire Waits for a free slot, returns ErrBusy if the queue is full or the
+// timeout passes, Release must be called when the request is done
+func (a *Admission) Acquire() error {
+	select {
+	case a.slots <- struct{}{}:
+		requestsActive.Add(1)
+		return nil
+	default:
+	}
+	if atomic.AddInt64(&a.queued, 1) > a.maxQueue {
+		atomic.AddInt64(&a.queued, -1)
+		requestsRejected.Add(1)
+		return ErrBusy
+	}
+	requestsQueued.Add(1)
+	defer func() {
+		atomic.AddInt64(&a.queued, -1)
+		requestsQueued.Add(-1)
+	}()
+	timer := time.NewTimer(a.Timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		requestsActive.Add(1)
+		return nil
+	case <-timer.C:
+		requestsRejected.Add(1)
+		return ErrBusy
+	}
+}
+
+// Release Frees up the slot taken by Acquire
+func (a *Admission) Release() {
+	<-a.slots
+	requestsActive.Add(-1)
+}
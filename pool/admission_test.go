@@ -0,0 +1,40 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmissionRejectsWhenQueueIsFull(t *testing.T) {
+	a := NewAdmission(1, 0, time.Second)
+	if err := a.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Acquire(); err != ErrBusy {
+		t.Errorf("expected ErrBusy with no room to queue, got %v", err)
+	}
+	a.Release()
+	if err := a.Acquire(); err != nil {
+		t.Errorf("expected the released slot to be free, got %v", err)
+	}
+}
+
+func TestAdmissionQueuesUntilTimeout(t *testing.T) {
+	a := NewAdmission(1, 1, 20*time.Millisecond)
+	if err := a.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Acquire(); err != ErrBusy {
+		t.Errorf("expected ErrBusy once the queue timeout passed, got %v", err)
+	}
+
+	// A QUEUED REQUEST GETS THE SLOT WHEN IT IS RELEASED IN TIME
+	a.Timeout = time.Second
+	acquired := make(chan error)
+	go func() { acquired <- a.Acquire() }()
+	time.Sleep(10 * time.Millisecond)
+	a.Release()
+	if err := <-acquired; err != nil {
+		t.Errorf("expected the queued request to be admitted, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package pool
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Workers The process wide worker pool used for parsing and encoding records
+var Workers = NewPool(data.WorkerPoolSize)
+
+var (
+	workersSize       = expvar.NewInt("jtb_workers_size")
+	workersBusy       = expvar.NewInt("jtb_workers_busy")
+	workerTasksQueued = expvar.NewInt("jtb_worker_tasks_queued")
+)
+
+// Pool A fixed number of goroutines that run tasks submitted by any request,
+// so concurrent requests share the workers instead of each starting their own
+type Pool struct {
+	tasks chan func()
+}
+
+// NewPool Constructor func, starts the workers and returns the pool
+func NewPool(size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{tasks: make(chan func())}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	workersSize.Add(int64(size))
+	return p
+}
+
+func (p *Pool) work() {
+	for task := range p.tasks {
+		workersBusy.Add(1)
+		task()
+		workersBusy.Add(-1)
+	}
+}
+
+// Each Runs fn once for every index from 0 to n on the pool and waits for them
+// all to finish, fn must not submit more work to the pool. If fn panics the
+// worker recovers and the first panic is raised again in the caller once every
+// task is done
+func (p *Pool) Each(n int, fn func(i int)) {
+	var (
+		wg        sync.WaitGroup
+		panicOnce sync.Once
+		panicked  interface{}
+	)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		workerTasksQueued.Add(1)
+		p.tasks <- func() {
+			defer wg.Done()
+			// A PANIC ON A WORKER WOULD CRASH THE PROCESS, SO IT IS HANDED BACK
+			// TO THE CALLER INSTEAD
+			defer func() {
+				if r := recover(); r != nil {
+					panicOnce.Do(func() { panicked = r })
+				}
+			}()
+			workerTasksQueued.Add(-1)
+			fn(i)
+		}
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+}
+
+// Do Runs fn on the pool and waits for it to finish
+func (p *Pool) Do(fn func()) {
+	p.Each(1, func(int) { fn() })
+}
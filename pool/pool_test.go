@@ -0,0 +1,79 @@
+package pool
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEachIsBoundedByPoolSize(t *testing.T) {
+	p := NewPool(2)
+	var running, most int64
+	p.Each(10, func(int) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&most)
+			if n <= m || atomic.CompareAndSwapInt64(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt64(&running, -1)
+	})
+	if most != 2 {
+		t.Errorf("expected at most 2 tasks at once, got %v", most)
+	}
+}
+
+func TestEachBlocksWhileWorkersAreBusy(t *testing.T) {
+	p := NewPool(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go p.Do(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	// THE ONLY WORKER IS BUSY SO THE SECOND CALLER HAS TO WAIT FOR IT
+	done := make(chan struct{})
+	go func() {
+		p.Do(func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the task to wait for a free worker")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the task to run once the worker was free")
+	}
+}
+
+func TestEachRaisesPanicInCaller(t *testing.T) {
+	p := NewPool(2)
+	var ran int64
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("expected the panic to reach the caller, got %v", r)
+			}
+		}()
+		p.Each(4, func(i int) {
+			atomic.AddInt64(&ran, 1)
+			if i == 1 {
+				panic("boom")
+			}
+		})
+	}()
+	if ran != 4 {
+		t.Errorf("expected every task to run, got %v", ran)
+	}
+
+	// THE WORKERS ARE STILL ALIVE AFTER THE PANIC
+	p.Each(2, func(int) {})
+}
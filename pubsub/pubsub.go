@@ -0,0 +1,134 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// How long a message ID is remembered for after it was processed, Pub/Sub
+// redelivers within the ack deadline and retention window so this only needs
+// to cover the retry period
+const seenRetention = 24 * time.Hour
+
+// Routes The target table for each subscription, loaded from the JSON file at
+// JTB_PUBSUB_ROUTES_FILE
+var Routes = data.LoadRoutes(data.EnvString("JTB_PUBSUB_ROUTES_FILE", ""))
+
+// Seen The message IDs that have been processed or are being processed, used
+// as an idempotency key so redelivered messages are only loaded once
+var Seen = NewIdempotencyStore(seenRetention)
+
+// PushEnvelope The body of a Pub/Sub push request, the message data is base64
+// in the JSON which is decoded into bytes
+type PushEnvelope struct {
+	Message struct {
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// Finds the route for a subscription by its full path or short name
+func findRoute(routes map[string]data.Route, subscription string) data.Route {
+	if route, ok := routes[subscription]; ok {
+		return route
+	}
+	parts := strings.Split(subscription, "/")
+	return routes[parts[len(parts)-1]]
+}
+
+// ToRequest Builds a JTBRequest from the message, the table comes from the
+// subscription route with the message attributes taking priority, the data
+// can be a single JSON object or a list of them. The message ID is used as the
+// request ID
+func (e *PushEnvelope) ToRequest(routes map[string]data.Route) (*data.JTBRequest, error) {
+	route := findRoute(routes, e.Subscription)
+	attrs := e.Message.Attributes
+	route.ProjectID = attributeOr(attrs, "ProjectID", route.ProjectID)
+	route.DatasetName = attributeOr(attrs, "DatasetName", route.DatasetName)
+	route.TableName = attributeOr(attrs, "TableName", route.TableName)
+	route.IdField = attributeOr(attrs, "IdField", route.IdField)
+	route.TimestampFormat = attributeOr(attrs, "TimestampFormat", route.TimestampFormat)
+	route.SchemaPolicy = attributeOr(attrs, "SchemaPolicy", route.SchemaPolicy)
+	route.TypeChangeStrategy = attributeOr(attrs, "TypeChangeStrategy", route.TypeChangeStrategy)
+	if buffer, ok := attrs["Buffer"]; ok {
+		route.Buffer, _ = strconv.ParseBool(buffer)
+	}
+	if keepRaw, ok := attrs["KeepRaw"]; ok {
+		route.KeepRaw, _ = strconv.ParseBool(keepRaw)
+	}
+	records, err := data.DecodeRecords(e.Message.Data)
+	if err != nil {
+		return nil, err
+	}
+	request := route.NewRequest(records)
+	request.RequestID = e.Message.MessageID
+	request.Caller = fmt.Sprintf("pubsub:%v", e.Subscription)
+	return request, nil
+}
+
+func attributeOr(attrs map[string]string, key, defaultValue string) string {
+	if value, ok := attrs[key]; ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// IdempotencyStore Remembers keys that have been processed, or are being
+// processed, for a retention period
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	done      map[string]time.Time
+	inFlight  map[string]bool
+}
+
+// NewIdempotencyStore Constructor func, returns an empty store
+func NewIdempotencyStore(retention time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{retention: retention, done: make(map[string]time.Time), inFlight: make(map[string]bool)}
+}
+
+// Errors returned by Begin when a key shouldnt be processed again
+var (
+	ErrAlreadyProcessed = errors.New("already processed")
+	ErrInFlight         = errors.New("currently being processed")
+)
+
+// Begin Marks the key as in flight, returns ErrAlreadyProcessed or ErrInFlight
+// if the key has already been processed or is being processed right now
+func (s *IdempotencyStore) Begin(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, doneAt := range s.done {
+		if time.Since(doneAt) > s.retention {
+			delete(s.done, k)
+		}
+	}
+	if _, ok := s.done[key]; ok {
+		return ErrAlreadyProcessed
+	}
+	if s.inFlight[key] {
+		return ErrInFlight
+	}
+	s.inFlight[key] = true
+	return nil
+}
+
+// Finish Marks an in flight key as processed if it succeeded, otherwise
+// forgets it so a redelivery can try again
+func (s *IdempotencyStore) Finish(key string, succeeded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, key)
+	if succeeded {
+		s.done[key] = time.Now()
+	}
+}
@@ -0,0 +1,76 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+func TestToRequest(t *testing.T) {
+	envelope := &PushEnvelope{}
+	body := `{
+		"message": {
+			"data": "eyJpZCI6IDEsICJuYW1lIjogImZpcnN0In0=",
+			"attributes": {"TableName": "events_override", "Buffer": "true"},
+			"messageId": "msg-1"
+		},
+		"subscription": "projects/project/subscriptions/events-sub"
+	}`
+	if err := json.Unmarshal([]byte(body), envelope); err != nil {
+		t.Fatal(err)
+	}
+	routes := map[string]data.Route{"events-sub": {ProjectID: "project", DatasetName: "dataset", TableName: "events", IdField: "id"}}
+
+	request, err := envelope.ToRequest(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.ProjectID != "project" || request.DatasetName != "dataset" || request.IdField != "id" {
+		t.Errorf("expected the route to be found by the short subscription name, got %+v", request)
+	}
+	if request.TableName != "events_override" || !request.Buffer {
+		t.Errorf("expected the attributes to override the route, got %+v", request)
+	}
+	if request.RequestID != "msg-1" || request.Caller != "pubsub:projects/project/subscriptions/events-sub" {
+		t.Errorf("unexpected request ID or caller %q, %q", request.RequestID, request.Caller)
+	}
+	if len(request.Data) != 1 || request.Data[0]["name"] != "first" {
+		t.Errorf("expected the base64 data to be decoded into the records, got %v", request.Data)
+	}
+
+	envelope.Message.Data = []byte("not json")
+	if _, err := envelope.ToRequest(routes); err == nil {
+		t.Error("expected data that isnt JSON to be rejected")
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	s := NewIdempotencyStore(time.Hour)
+	if err := s.Begin("msg-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Begin("msg-1"); err != ErrInFlight {
+		t.Errorf("expected the message to be in flight, got %v", err)
+	}
+
+	// A FAILED MESSAGE IS FORGOTTEN SO A REDELIVERY CAN TRY AGAIN
+	s.Finish("msg-1", false)
+	if err := s.Begin("msg-1"); err != nil {
+		t.Errorf("expected a failed message to be tried again, got %v", err)
+	}
+	s.Finish("msg-1", true)
+	if err := s.Begin("msg-1"); err != ErrAlreadyProcessed {
+		t.Errorf("expected the message to be processed, got %v", err)
+	}
+
+	// KEYS ARE ONLY KEPT FOR THE RETENTION PERIOD
+	expiring := NewIdempotencyStore(time.Millisecond)
+	expiring.Begin("msg-2")
+	expiring.Finish("msg-2", true)
+	time.Sleep(5 * time.Millisecond)
+	if err := expiring.Begin("msg-2"); err != nil {
+		t.Errorf("expected the key to be forgotten after the retention, got %v", err)
+	}
+}
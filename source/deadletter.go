@@ -0,0 +1,51 @@
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Characters that cant be used in the name of a dead letter file
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// One line of a dead letter file, the value is kept as it was fetched and is
+// base64 in the JSON so messages that arent valid JSON or UTF-8 survive
+type deadLetterEntry struct {
+	Source    string    `json:"source"`
+	Topic     string    `json:"topic"`
+	RequestID string    `json:"requestId,omitempty"`
+	Error     string    `json:"error"`
+	FailedAt  time.Time `json:"failedAt"`
+	Value     []byte    `json:"value"`
+}
+
+// Appends the entries to the dead letter file for the source and topic in
+// dir, the file is synced before returning so the messages can be committed
+func writeDeadLetters(dir, sourceName, topic string, entries []deadLetterEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	fileName := unsafeFileChars.ReplaceAllString(fmt.Sprintf("%v_%v", sourceName, topic), "_") + ".jsonl"
+	f, err := os.OpenFile(filepath.Join(dir, fileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
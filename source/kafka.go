@@ -0,0 +1,54 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaSource Reads messages from a set of Kafka topics as part of a consumer
+// group, offsets are only committed when Commit is called
+type KafkaSource struct {
+	reader *kafka.Reader
+}
+
+// NewKafkaSource Constructor func, returns a source reading the topics from
+// the comma separated brokers
+func NewKafkaSource(brokers, groupID string, topics []string) *KafkaSource {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     strings.Split(brokers, ","),
+		GroupID:     groupID,
+		GroupTopics: topics,
+	})
+	return &KafkaSource{reader: reader}
+}
+
+// Name Returns a name for the source used in logs
+func (k *KafkaSource) Name() string {
+	return fmt.Sprintf("kafka:%v", k.reader.Config().GroupID)
+}
+
+// Fetch Blocks until the next message is available or the context is done
+func (k *KafkaSource) Fetch(ctx context.Context) (Message, error) {
+	m, err := k.reader.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Topic: m.Topic, Value: m.Value, Ref: m}, nil
+}
+
+// Commit Commits the offsets of the messages to the consumer group
+func (k *KafkaSource) Commit(ctx context.Context, msgs []Message) error {
+	kafkaMsgs := make([]kafka.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		kafkaMsgs = append(kafkaMsgs, msg.Ref.(kafka.Message))
+	}
+	return k.reader.CommitMessages(ctx, kafkaMsgs...)
+}
+
+// Close Closes the connection to the brokers
+func (k *KafkaSource) Close() error {
+	return k.reader.Close()
+}
@@ -0,0 +1,59 @@
+package source
+
+import (
+	"context"
+	"sync"
+)
+
+// MemorySource A source backed by a channel, used to feed the consumer
+// without a broker, committed messages can be read back with Committed
+type MemorySource struct {
+	messages  chan Message
+	mu        sync.Mutex
+	committed []Message
+}
+
+// NewMemorySource Constructor func, returns an empty source
+func NewMemorySource() *MemorySource {
+	return &MemorySource{messages: make(chan Message, 1024)}
+}
+
+// Publish Adds a message to the source
+func (m *MemorySource) Publish(topic string, value []byte) {
+	m.messages <- Message{Topic: topic, Value: value}
+}
+
+// Name Returns a name for the source used in logs
+func (m *MemorySource) Name() string {
+	return "memory"
+}
+
+// Fetch Blocks until the next message is available or the context is done
+func (m *MemorySource) Fetch(ctx context.Context) (Message, error) {
+	select {
+	case msg := <-m.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Commit Records the messages as committed
+func (m *MemorySource) Commit(ctx context.Context, msgs []Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.committed = append(m.committed, msgs...)
+	return nil
+}
+
+// Committed Returns every message committed so far
+func (m *MemorySource) Committed() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.committed...)
+}
+
+// Close Does nothing as there is no connection to close
+func (m *MemorySource) Close() error {
+	return nil
+}
@@ -0,0 +1,242 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+// Message A single message pulled from a source, Ref is whatever the source
+// needs to commit the message once it has been loaded
+type Message struct {
+	Topic string
+	Value []byte
+	Ref   interface{}
+}
+
+// Source A stream of messages the service pulls from itself, messages are
+// only committed after the records in them have been loaded
+type Source interface {
+	// Name Returns a name for the source used in logs
+	Name() string
+	// Fetch Blocks until the next message is available or the context is done
+	Fetch(ctx context.Context) (Message, error)
+	// Commit Marks the messages as processed so they are not fetched again
+	Commit(ctx context.Context, msgs []Message) error
+	// Close Closes any connections held by the source
+	Close() error
+}
+
+// The messages waiting to be loaded for a topic, decodeErrs holds the error
+// for each message in msgs that couldnt be decoded, by its index
+type pending struct {
+	msgs       []Message
+	decodeErrs map[int]error
+	records    []map[string]interface{}
+	deadline   time.Time
+}
+
+// Consumer Pulls messages from a source, batches them per topic by size and
+// time, loads each batch into the table routed from its topic and then
+// commits the messages
+type Consumer struct {
+	Source     Source
+	Routes     map[string]data.Route
+	MaxRecords int
+	MaxWait    time.Duration
+	// RetryBackoff How long to wait before loading a failed batch again,
+	// doubled after every failure up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// MaxRetries How many times a batch that fails with a server error is
+	// retried before the consumer stops without committing it, 0 retries it
+	// until it loads
+	MaxRetries int
+	// DeadLetterDir The folder messages that can never be loaded are written
+	// to before they are committed
+	DeadLetterDir string
+	// Run is used to load a batch, defaults to pipeline.Run
+	Run func(*data.JTBRequest) (*pipeline.Result, error)
+
+	pending map[string]*pending
+}
+
+// NewConsumer Constructor func, returns a consumer for the source using the
+// batching settings from the env
+func NewConsumer(src Source, routes map[string]data.Route) *Consumer {
+	return &Consumer{
+		Source:       src,
+		Routes:       routes,
+		MaxRecords:   data.SourceMaxRecords,
+		MaxWait:      time.Duration(data.SourceMaxWaitSeconds) * time.Second,
+		RetryBackoff: 5 * time.Second,
+		MaxRetries:   data.SourceMaxRetries,
+		Run:          pipeline.Run,
+
+		MaxRetryBackoff: time.Duration(data.SourceMaxRetryBackoffSeconds) * time.Second,
+		DeadLetterDir:   data.SourceDeadLetterDir,
+	}
+}
+
+// Consume Runs until the context is done, messages for a topic are loaded once
+// MaxRecords have been fetched or MaxWait has passed since the first one. A
+// batch that fails with a server error is never committed, it is retried with
+// backoff until it loads, or the consumer stops after MaxRetries. Messages
+// that can never be loaded are written to the dead letter folder and committed
+// so they dont block the topic
+func (c *Consumer) Consume(ctx context.Context) error {
+	c.pending = make(map[string]*pending)
+	log.Printf("STARTING CONSUMER FOR SOURCE %v", c.Source.Name())
+	for {
+		fetchCtx, cancel := context.WithDeadline(ctx, c.nextDeadline())
+		msg, err := c.Source.Fetch(fetchCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		if err == nil {
+			c.add(msg)
+		}
+		if err := c.flushDue(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns when the oldest pending batch has to be loaded by, or MaxWait from
+// now if nothing is pending
+func (c *Consumer) nextDeadline() time.Time {
+	deadline := time.Now().Add(c.MaxWait)
+	for _, p := range c.pending {
+		if p.deadline.Before(deadline) {
+			deadline = p.deadline
+		}
+	}
+	return deadline
+}
+
+// Adds the records in a message to the pending batch for its topic, messages
+// that cant be decoded are dead lettered when the batch is committed so they
+// dont block the topic
+func (c *Consumer) add(msg Message) {
+	p, ok := c.pending[msg.Topic]
+	if !ok {
+		p = &pending{deadline: time.Now().Add(c.MaxWait), decodeErrs: make(map[int]error)}
+		c.pending[msg.Topic] = p
+	}
+	p.msgs = append(p.msgs, msg)
+	records, err := data.DecodeRecords(msg.Value)
+	if err != nil {
+		log.Printf("CANT DECODE MESSAGE FROM %v ON %v, IT WILL BE DEAD LETTERED: %v", c.Source.Name(), msg.Topic, err.Error())
+		p.decodeErrs[len(p.msgs)-1] = err
+		return
+	}
+	p.records = append(p.records, records...)
+}
+
+// Loads and commits every pending batch that is full or past its deadline
+func (c *Consumer) flushDue(ctx context.Context) error {
+	now := time.Now()
+	for topic, p := range c.pending {
+		if len(p.records) < c.MaxRecords && now.Before(p.deadline) {
+			continue
+		}
+		if err := c.flush(ctx, topic, p); err != nil {
+			return err
+		}
+		delete(c.pending, topic)
+	}
+	return nil
+}
+
+// Loads a batch and commits its messages. Messages that can never be loaded,
+// because the topic has no route, the route is invalid, the load fails with a
+// client error or they cant be decoded, are written to the dead letter folder
+// first. A batch that fails with a server error is never committed
+func (c *Consumer) flush(ctx context.Context, topic string, p *pending) error {
+	var (
+		requestID string
+		failed    error
+	)
+	route, ok := c.Routes[topic]
+	if !ok {
+		failed = fmt.Errorf("no route for topic %v", topic)
+	} else if len(p.records) > 0 {
+		request := route.NewRequest(p.records)
+		request.RequestID = data.NewRequestID()
+		request.Caller = fmt.Sprintf("%v:%v", c.Source.Name(), topic)
+		requestID = request.RequestID
+		err := request.Validate()
+		if err == nil {
+			err = request.CheckLimits(data.RequestLimits)
+		}
+		if err != nil {
+			failed = fmt.Errorf("route for topic %v is invalid: %v", topic, err)
+		} else if failed, err = c.load(ctx, topic, request); err != nil {
+			return err
+		}
+	}
+
+	// EVERY MESSAGE IN A FAILED BATCH IS DEAD LETTERED, OTHERWISE ONLY THE ONES
+	// THAT COULDNT BE DECODED
+	var entries []deadLetterEntry
+	now := time.Now()
+	for i, msg := range p.msgs {
+		err, undecodable := p.decodeErrs[i]
+		if !undecodable {
+			err = failed
+		}
+		if err == nil {
+			continue
+		}
+		entries = append(entries, deadLetterEntry{Source: c.Source.Name(), Topic: topic, RequestID: requestID, Error: err.Error(), FailedAt: now, Value: msg.Value})
+	}
+	if len(entries) > 0 {
+		log.Printf("DEAD LETTERING %v OF %v MESSAGES FROM %v ON %v TO %v: %v", len(entries), len(p.msgs), c.Source.Name(), topic, c.DeadLetterDir, entries[0].Error)
+		if err := writeDeadLetters(c.DeadLetterDir, c.Source.Name(), topic, entries); err != nil {
+			return fmt.Errorf("writing dead letters for %v, not committing: %v", topic, err)
+		}
+	}
+	return c.Source.Commit(ctx, p.msgs)
+}
+
+// Loads a batch, retrying server errors with backoff until it loads, runs out
+// of retries or the context is done, which return an error to stop the
+// consumer without committing. A client error fails the same way every time so
+// it is returned as failed for the batch to be dead lettered
+func (c *Consumer) load(ctx context.Context, topic string, request *data.JTBRequest) (failed error, err error) {
+	backoff := c.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := c.Run(request)
+		if err == nil {
+			log.Printf("LOADED %v RECORDS FROM %v ON %v", len(request.Data), c.Source.Name(), topic)
+			return nil, nil
+		}
+		var pipelineErr *pipeline.Error
+		if errors.As(err, &pipelineErr) && pipelineErr.StatusCode < 500 {
+			log.Printf("ERROR LOADING BATCH %v FROM %v ON %v: %v", request.RequestID, c.Source.Name(), topic, err.Error())
+			return err, nil
+		}
+		if c.MaxRetries > 0 && attempt > c.MaxRetries {
+			return nil, fmt.Errorf("batch %v from %v on %v failed after %v retries, stopping without committing: %v", request.RequestID, c.Source.Name(), topic, c.MaxRetries, err)
+		}
+		log.Printf("ERROR LOADING BATCH %v FROM %v ON %v, RETRYING IN %v: %v", request.RequestID, c.Source.Name(), topic, backoff, err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if c.MaxRetryBackoff > 0 && backoff > c.MaxRetryBackoff {
+			backoff = c.MaxRetryBackoff
+		}
+	}
+}
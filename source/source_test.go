@@ -0,0 +1,199 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+	"github.com/BenHiramTaylor/JSONToBigQuery/pipeline"
+)
+
+var testRoutes = map[string]data.Route{
+	"events": {ProjectID: "project", DatasetName: "dataset", TableName: "events", IdField: "id"},
+}
+
+// Records the requests the consumer tries to load, failing each attempt with
+// the next error in errs until they run out
+type recordingRun struct {
+	mu       sync.Mutex
+	errs     []error
+	requests []*data.JTBRequest
+}
+
+func (r *recordingRun) run(request *data.JTBRequest) (*pipeline.Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, request)
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return nil, err
+	}
+	return &pipeline.Result{}, nil
+}
+
+func (r *recordingRun) attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+// Returns a consumer over the source that batches two records at a time and
+// dead letters to a temp folder
+func newTestConsumer(t *testing.T, src *MemorySource, run *recordingRun, maxRetries int) *Consumer {
+	c := NewConsumer(src, testRoutes)
+	c.MaxRecords = 2
+	c.MaxWait = 20 * time.Millisecond
+	c.RetryBackoff = time.Millisecond
+	c.MaxRetryBackoff = 4 * time.Millisecond
+	c.MaxRetries = maxRetries
+	c.DeadLetterDir = t.TempDir()
+	c.Run = run.run
+	return c
+}
+
+// Runs a consumer over the source until want messages have been committed,
+// returning the messages it dead lettered
+func consumeUntilCommitted(t *testing.T, src *MemorySource, run *recordingRun, maxRetries int, want int) []deadLetterEntry {
+	t.Helper()
+	c := newTestConsumer(t, src, run, maxRetries)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Consume(ctx) }()
+	for len(src.Committed()) < want {
+		select {
+		case err := <-done:
+			t.Fatalf("consumer stopped with %v committed messages: %v", len(src.Committed()), err)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+	return readDeadLetters(t, c.DeadLetterDir)
+}
+
+// Reads every entry in the dead letter files in dir
+func readDeadLetters(t *testing.T, dir string) []deadLetterEntry {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []deadLetterEntry
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+			var entry deadLetterEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestConsumerLoadsAndCommits(t *testing.T) {
+	src := NewMemorySource()
+	src.Publish("events", []byte(`{"id": 1}`))
+	src.Publish("events", []byte(`[{"id": 2}, {"id": 3}]`))
+	run := &recordingRun{}
+
+	consumeUntilCommitted(t, src, run, 0, 2)
+
+	if run.attempts() != 1 {
+		t.Fatalf("expected 1 load, got %v", run.attempts())
+	}
+	request := run.requests[0]
+	if len(request.Data) != 3 {
+		t.Errorf("expected 3 records in the batch, got %v", len(request.Data))
+	}
+	if request.TableName != "events" || request.Caller != "memory:events" {
+		t.Errorf("unexpected table %v or caller %v", request.TableName, request.Caller)
+	}
+}
+
+func TestConsumerDeadLettersUnroutedAndUndecodableMessages(t *testing.T) {
+	src := NewMemorySource()
+	src.Publish("unknown", []byte(`{"id": 1}`))
+	src.Publish("events", []byte(`not json`))
+	src.Publish("events", []byte(`{"id": 2}`))
+	src.Publish("events", []byte(`{"id": 3}`))
+	run := &recordingRun{}
+
+	deadLetters := consumeUntilCommitted(t, src, run, 0, 4)
+
+	if run.attempts() != 1 || len(run.requests[0].Data) != 2 {
+		t.Errorf("expected the decodable events to be loaded, got %v loads", run.attempts())
+	}
+	values := make(map[string]string)
+	for _, entry := range deadLetters {
+		values[string(entry.Value)] = entry.Topic
+	}
+	if len(deadLetters) != 2 || values[`{"id": 1}`] != "unknown" || values[`not json`] != "events" {
+		t.Errorf("expected the unrouted and undecodable messages to be dead lettered, got %+v", deadLetters)
+	}
+}
+
+func TestConsumerDeadLettersClientErrors(t *testing.T) {
+	src := NewMemorySource()
+	src.Publish("events", []byte(`{"id": 1}`))
+	run := &recordingRun{errs: []error{&pipeline.Error{StatusCode: 409, Err: errors.New("type changed")}}}
+
+	deadLetters := consumeUntilCommitted(t, src, run, 0, 1)
+
+	if run.attempts() != 1 {
+		t.Errorf("expected a client error not to be retried, got %v attempts", run.attempts())
+	}
+	if len(deadLetters) != 1 || deadLetters[0].RequestID != run.requests[0].RequestID || deadLetters[0].Error != "type changed" {
+		t.Errorf("expected the batch to be dead lettered with its request ID and error, got %+v", deadLetters)
+	}
+}
+
+func TestConsumerRetriesServerErrorsUntilLoaded(t *testing.T) {
+	src := NewMemorySource()
+	src.Publish("events", []byte(`{"id": 1}`))
+	serverErr := &pipeline.Error{StatusCode: 500, Err: errors.New("backend error")}
+	run := &recordingRun{errs: []error{serverErr, errors.New("connection reset"), serverErr}}
+
+	consumeUntilCommitted(t, src, run, 0, 1)
+
+	if run.attempts() != 4 {
+		t.Errorf("expected 3 retries before the load, got %v attempts", run.attempts())
+	}
+}
+
+func TestConsumerStopsWithoutCommittingAfterMaxRetries(t *testing.T) {
+	src := NewMemorySource()
+	src.Publish("events", []byte(`{"id": 1}`))
+	serverErr := &pipeline.Error{StatusCode: 503, Err: errors.New("unavailable")}
+	run := &recordingRun{errs: []error{serverErr, serverErr, serverErr, serverErr, serverErr}}
+	c := newTestConsumer(t, src, run, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Consume(ctx); err == nil || ctx.Err() != nil {
+		t.Fatalf("expected the consumer to stop with an error, got %v", err)
+	}
+	if run.attempts() != 3 {
+		t.Errorf("expected 2 retries before stopping, got %v attempts", run.attempts())
+	}
+	if committed := src.Committed(); len(committed) != 0 {
+		t.Errorf("expected nothing to be committed, got %v messages", len(committed))
+	}
+	if deadLetters := readDeadLetters(t, c.DeadLetterDir); len(deadLetters) != 0 {
+		t.Errorf("expected a server error not to be dead lettered, got %+v", deadLetters)
+	}
+}
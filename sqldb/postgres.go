@@ -0,0 +1,80 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+
+	// REGISTERS THE postgres DRIVER
+	_ "github.com/lib/pq"
+)
+
+// Postgres The dialect for PostgreSQL, each dataset is a schema
+type Postgres struct{}
+
+var postgresTypes = map[string]string{
+	"string":           "TEXT",
+	"int":              "BIGINT",
+	"long":             "BIGINT",
+	"float":            "DOUBLE PRECISION",
+	"double":           "DOUBLE PRECISION",
+	"boolean":          "BOOLEAN",
+	"timestamp-micros": "TIMESTAMPTZ",
+	"date":             "DATE",
+	"time-micros":      "TIME",
+	"decimal":          "NUMERIC(38, 9)",
+	"uuid":             "UUID",
+	"json":             "JSONB",
+}
+
+// DriverName The database/sql driver the dialect uses
+func (Postgres) DriverName() string {
+	return "postgres"
+}
+
+// ColumnType Returns the column type for an avro type or logical type
+func (Postgres) ColumnType(avroType string) string {
+	if columnType, ok := postgresTypes[avroType]; ok {
+		return columnType
+	}
+	return "TEXT"
+}
+
+// Placeholder Returns the bind parameter for the nth value
+func (Postgres) Placeholder(n int) string {
+	return fmt.Sprintf("$%v", n)
+}
+
+// TableName Returns the quoted name of a table in a dataset
+func (Postgres) TableName(datasetID, tableID string) string {
+	return fmt.Sprintf("%v.%v", quote(datasetID), quote(tableID))
+}
+
+// PrepareDataset Creates the schema for the dataset
+func (Postgres) PrepareDataset(tx *sql.Tx, datasetID string) error {
+	_, err := tx.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %v", quote(datasetID)))
+	return err
+}
+
+// ChangeColumnType Changes the type of a column in place, casting its values
+func (p Postgres) ChangeColumnType(tx *sql.Tx, datasetID, tableID, column, columnType string) error {
+	_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %v ALTER COLUMN %v TYPE %v USING %v::%v", p.TableName(datasetID, tableID), quote(column), columnType, quote(column), columnType))
+	return err
+}
+
+// Columns Returns the columns of a table and their data types
+func (Postgres) Columns(tx *sql.Tx, datasetID, tableID string) (map[string]string, error) {
+	rows, err := tx.Query("SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2", datasetID, tableID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, columnType string
+		if err = rows.Scan(&name, &columnType); err != nil {
+			return nil, err
+		}
+		columns[name] = columnType
+	}
+	return columns, rows.Err()
+}
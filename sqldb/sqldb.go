@@ -0,0 +1,337 @@
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Dialect The differences between the SQL databases the warehouse can write to
+type Dialect interface {
+	// DriverName The database/sql driver the dialect uses
+	DriverName() string
+	// ColumnType Returns the column type for an avro type or logical type
+	ColumnType(avroType string) string
+	// Placeholder Returns the bind parameter for the nth value, starting at 1
+	Placeholder(n int) string
+	// TableName Returns the quoted name of a table in a dataset
+	TableName(datasetID, tableID string) string
+	// PrepareDataset Creates anything the dataset needs before a table can be
+	// created in it
+	PrepareDataset(tx *sql.Tx, datasetID string) error
+	// Columns Returns the columns of a table and their types, or an empty map
+	// if the table doesnt exist
+	Columns(tx *sql.Tx, datasetID, tableID string) (map[string]string, error)
+	// ChangeColumnType Changes the type of a column, casting the values in it
+	// to the new type
+	ChangeColumnType(tx *sql.Tx, datasetID, tableID, column, columnType string) error
+}
+
+// Dialects The dialects that can be used, keyed by name
+var Dialects = map[string]Dialect{
+	"sqlite":   SQLite{},
+	"postgres": Postgres{},
+}
+
+// Warehouse A backend.Warehouse that writes to a SQL database, the avro schema
+// is applied as CREATE TABLE and ALTER TABLE ADD COLUMN statements and the
+// staged records are inserted as rows
+type Warehouse struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// New Constructor func, opens the database with the named dialect
+func New(dialectName, dsn string) (*Warehouse, error) {
+	dialect, ok := Dialects[dialectName]
+	if !ok {
+		return nil, fmt.Errorf("unknown sql dialect: %v", dialectName)
+	}
+	db, err := sql.Open(dialect.DriverName(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &Warehouse{DB: db, Dialect: dialect}, nil
+}
+
+// Quotes an identifier, both dialects use double quotes
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Returns the logical type of an avro field, or its non null type if it doesnt
+// have one
+func fieldType(field avro.Field) string {
+	if field.LogicalType != "" {
+		return field.LogicalType
+	}
+	return field.NonNullType()
+}
+
+// Converts the values decoded from a staged file that the drivers cant take
+func sqlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return time.Time{}.Add(v).Format("15:04:05.000000")
+	case *big.Rat:
+		return v.FloatString(avro.DecimalScale)
+	}
+	return value
+}
+
+// PrepareTable Creates the table if it doesnt exist, then adds any fields in
+// the schema that are missing from it as new columns if the schema policy
+// allows it, columns widened to a string are cast after the table is copied to
+// a snapshot table
+func (w *Warehouse) PrepareTable(datasetID, tableID string, sch avro.Schema, opts backend.TableOptions) error {
+	if len(sch.Fields) == 0 {
+		return nil
+	}
+	columnType := func(field avro.Field) string {
+		return w.Dialect.ColumnType(fieldType(field))
+	}
+
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = w.Dialect.PrepareDataset(tx, datasetID); err != nil {
+		return err
+	}
+	existing, err := w.Dialect.Columns(tx, datasetID, tableID)
+	if err != nil {
+		return err
+	}
+	tableName := w.Dialect.TableName(datasetID, tableID)
+	if len(existing) == 0 {
+		var columns []string
+		for _, field := range sch.Fields {
+			columns = append(columns, fmt.Sprintf("%v %v", quote(field.Name), columnType(field)))
+		}
+		if _, err = tx.Exec(fmt.Sprintf("CREATE TABLE %v (%v)", tableName, strings.Join(columns, ", "))); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	var columns []string
+	for name := range existing {
+		columns = append(columns, name)
+	}
+	if err = sch.CheckPolicy(opts.SchemaPolicy, tableID, columns); err != nil {
+		return err
+	}
+	stringType := w.Dialect.ColumnType("string")
+	changes := sch.WidenedColumns(existing, func(columnType string) bool { return strings.EqualFold(columnType, stringType) })
+	if err = avro.CheckTypeChanges(opts.TypeChangeStrategy, tableID, changes); err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		snapshot := w.Dialect.TableName(datasetID, backend.SnapshotName(tableID))
+		if _, err = tx.Exec(fmt.Sprintf("CREATE TABLE %v AS SELECT * FROM %v", snapshot, tableName)); err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err = w.Dialect.ChangeColumnType(tx, datasetID, tableID, change.Column, stringType); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range sch.Fields {
+		if _, ok := existing[field.Name]; ok {
+			continue
+		}
+		if _, err = tx.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", tableName, quote(field.Name), columnType(field))); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadFile Decodes the staged file and inserts its rows into the table in a
+// single transaction, there is no load job so the job ID is blank
+func (w *Warehouse) LoadFile(objects backend.ObjectStore, datasetID, tableID, fileName string) (string, error) {
+	fileBytes, err := objects.Download(datasetID, fileName)
+	if err != nil {
+		return "", err
+	}
+	rows, err := backend.ReadRecords(fileName, fileBytes)
+	if err != nil {
+		return "", err
+	}
+	return "", w.InsertRows(datasetID, tableID, rows)
+}
+
+// InsertRows Inserts the rows into the table in a single transaction
+func (w *Warehouse) InsertRows(datasetID, tableID string, rows []map[string]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	existing, err := w.Dialect.Columns(tx, datasetID, tableID)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("table %v.%v does not exist", datasetID, tableID)
+	}
+
+	// THE COLUMNS ARE TAKEN FROM THE FIRST ROW, EVERY STAGED ROW HAS THE SAME KEYS
+	var columns []string
+	for name := range rows[0] {
+		if _, ok := existing[name]; ok {
+			columns = append(columns, name)
+		}
+	}
+	sort.Strings(columns)
+	stmt, err := tx.Prepare(w.insertStatement(datasetID, tableID, columns))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		values := make([]interface{}, len(columns))
+		for i, name := range columns {
+			values[i] = sqlValue(row[name])
+		}
+		if _, err = stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (w *Warehouse) insertStatement(datasetID, tableID string, columns []string) string {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, name := range columns {
+		quoted[i] = quote(name)
+		placeholders[i] = w.Dialect.Placeholder(i + 1)
+	}
+	return fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", w.Dialect.TableName(datasetID, tableID), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+}
+
+// ExecuteQueries Runs the statements in order, stopping at the first failure
+// unless that statement is set to continue on error, the BigQuery only job
+// options and the request ID are ignored
+func (w *Warehouse) ExecuteQueries(datasetID, requestID string, statements []data.JTBQuery) ([]data.QueryResult, error) {
+	var results []data.QueryResult
+	for _, statement := range statements {
+		result := data.QueryResult{SQL: statement.SQL}
+		var err error
+		if statement.DestinationTable != "" {
+			err = errors.New("DestinationTable is not supported by the sql warehouse")
+		} else {
+			_, err = w.DB.Exec(statement.SQL)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			if statement.ContinueOnError {
+				continue
+			}
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// AppendTables Inserts the rows of each source table into its destination in a
+// single transaction, the columns are copied by name
+func (w *Warehouse) AppendTables(datasetID string, copies []backend.TableCopy) error {
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range copies {
+		existing, err := w.Dialect.Columns(tx, datasetID, c.Source)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			return fmt.Errorf("table %v.%v does not exist", datasetID, c.Source)
+		}
+		var columns []string
+		for name := range existing {
+			columns = append(columns, quote(name))
+		}
+		sort.Strings(columns)
+		_, err = tx.Exec(fmt.Sprintf(
+			"INSERT INTO %v (%v) SELECT %v FROM %v",
+			w.Dialect.TableName(datasetID, c.Destination), strings.Join(columns, ", "), strings.Join(columns, ", "), w.Dialect.TableName(datasetID, c.Source),
+		))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DropTable Drops the table if it exists
+func (w *Warehouse) DropTable(datasetID, tableID string) error {
+	_, err := w.DB.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %v", w.Dialect.TableName(datasetID, tableID)))
+	return err
+}
+
+// DeduplicateTable Replaces the rows in the table with one row for each set
+// of key column values, or with the distinct rows if there are no key columns
+func (w *Warehouse) DeduplicateTable(projectID, datasetID, tableID string, keyColumns []string) error {
+	tableName := w.Dialect.TableName(datasetID, tableID)
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statements := []string{
+		fmt.Sprintf("CREATE TEMPORARY TABLE jtb_dedupe AS SELECT DISTINCT * FROM %v", tableName),
+		fmt.Sprintf("DELETE FROM %v", tableName),
+		fmt.Sprintf("INSERT INTO %v SELECT * FROM jtb_dedupe", tableName),
+		"DROP TABLE jtb_dedupe",
+	}
+	if len(keyColumns) > 0 {
+		existing, err := w.Dialect.Columns(tx, datasetID, tableID)
+		if err != nil {
+			return err
+		}
+		var columns, keys []string
+		for name := range existing {
+			columns = append(columns, quote(name))
+		}
+		sort.Strings(columns)
+		for _, name := range keyColumns {
+			keys = append(keys, quote(name))
+		}
+		// THE ROW NUMBER COLUMN IS LEFT OUT WHEN THE ROWS ARE COPIED BACK
+		statements[0] = fmt.Sprintf(
+			"CREATE TEMPORARY TABLE jtb_dedupe AS SELECT * FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY %v) AS jtb_row FROM %v) numbered WHERE jtb_row = 1",
+			strings.Join(keys, ", "), tableName,
+		)
+		statements[2] = fmt.Sprintf("INSERT INTO %v (%v) SELECT %v FROM jtb_dedupe", tableName, strings.Join(columns, ", "), strings.Join(columns, ", "))
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close Closes the database
+func (w *Warehouse) Close() error {
+	return w.DB.Close()
+}
@@ -0,0 +1,255 @@
+package sqldb
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BenHiramTaylor/JSONToBigQuery/avro"
+	"github.com/BenHiramTaylor/JSONToBigQuery/backend"
+	"github.com/BenHiramTaylor/JSONToBigQuery/data"
+)
+
+// Opens a warehouse on a new SQLite database in a temp folder
+func newSQLiteWarehouse(t *testing.T) *Warehouse {
+	t.Helper()
+	w, err := New("sqlite", filepath.Join(t.TempDir(), "jtb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func testSchema(fields ...avro.Field) avro.Schema {
+	return avro.Schema{Name: "events.avro", Namespace: "events.avsc", Type: "record", Fields: fields}
+}
+
+// Returns the rows of a table ordered by id, as strings
+func tableRows(t *testing.T, w *Warehouse, tableID string, columns string) [][]string {
+	t.Helper()
+	rows, err := w.DB.Query("SELECT " + columns + " FROM " + w.Dialect.TableName("dataset", tableID) + " ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	names, _ := rows.Columns()
+	var result [][]string
+	for rows.Next() {
+		values := make([]interface{}, len(names))
+		strs := make([]*string, len(names))
+		for i := range values {
+			values[i] = &strs[i]
+		}
+		if err := rows.Scan(values...); err != nil {
+			t.Fatal(err)
+		}
+		row := make([]string, len(names))
+		for i, s := range strs {
+			if s != nil {
+				row[i] = *s
+			}
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+func TestPrepareTableAndInsertRows(t *testing.T) {
+	w := newSQLiteWarehouse(t)
+	sch := testSchema(
+		avro.Field{Name: "id", FieldType: []string{"long", "null"}},
+		avro.Field{Name: "name", FieldType: []string{"string", "null"}},
+	)
+	if err := w.PrepareTable("dataset", "events", sch, backend.TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err := w.InsertRows("dataset", "events", []map[string]interface{}{
+		{"id": int64(1), "name": "first"},
+		{"id": int64(2), "name": "second"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A NEW FIELD IS ADDED AS A COLUMN UNDER THE DEFAULT POLICY
+	sch.Fields = append(sch.Fields, avro.Field{Name: "score", FieldType: []string{"double", "null"}})
+	if err := w.PrepareTable("dataset", "events", sch, backend.TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.InsertRows("dataset", "events", []map[string]interface{}{{"id": int64(3), "name": "third", "score": 1.5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := tableRows(t, w, "events", `id, name, score`)
+	if len(rows) != 3 || rows[0][1] != "first" || rows[2][2] != "1.5" || rows[0][2] != "" {
+		t.Errorf("unexpected rows %v", rows)
+	}
+}
+
+func TestPrepareTableRejectsNewFieldsWhenStrict(t *testing.T) {
+	w := newSQLiteWarehouse(t)
+	sch := testSchema(avro.Field{Name: "id", FieldType: []string{"long", "null"}})
+	if err := w.PrepareTable("dataset", "events", sch, backend.TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sch.Fields = append(sch.Fields, avro.Field{Name: "added", FieldType: []string{"string", "null"}})
+	err := w.PrepareTable("dataset", "events", sch, backend.TableOptions{SchemaPolicy: avro.PolicyStrict})
+	if err == nil {
+		t.Fatal("expected the strict policy to reject the new field")
+	}
+}
+
+func TestPrepareTableTypeChanges(t *testing.T) {
+	w := newSQLiteWarehouse(t)
+	sch := testSchema(
+		avro.Field{Name: "id", FieldType: []string{"long", "null"}},
+		avro.Field{Name: "value", FieldType: []string{"long", "null"}},
+	)
+	if err := w.PrepareTable("dataset", "events", sch, backend.TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.InsertRows("dataset", "events", []map[string]interface{}{{"id": int64(1), "value": int64(10)}}); err != nil {
+		t.Fatal(err)
+	}
+	widened := testSchema(
+		avro.Field{Name: "id", FieldType: []string{"long", "null"}},
+		avro.Field{Name: "value", FieldType: []string{"string", "null"}},
+	)
+
+	err := w.PrepareTable("dataset", "events", widened, backend.TableOptions{TypeChangeStrategy: avro.TypeChangeReject})
+	var conflict *avro.TypeConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected a type conflict, got %v", err)
+	}
+
+	if err := w.PrepareTable("dataset", "events", widened, backend.TableOptions{TypeChangeStrategy: avro.TypeChangeRewrite}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.InsertRows("dataset", "events", []map[string]interface{}{{"id": int64(2), "value": "text"}}); err != nil {
+		t.Fatal(err)
+	}
+	rows := tableRows(t, w, "events", `id, value`)
+	if len(rows) != 2 || rows[0][1] != "10" || rows[1][1] != "text" {
+		t.Errorf("unexpected rows after the rewrite %v", rows)
+	}
+	var snapshotTable string
+	if err := w.DB.QueryRow(`SELECT name FROM sqlite_master WHERE name LIKE 'dataset__events__snapshot_%'`).Scan(&snapshotTable); err != nil {
+		t.Fatalf("expected the table to be copied to a snapshot first: %v", err)
+	}
+	snapshotID := strings.TrimPrefix(snapshotTable, "dataset__")
+	if snapshot := tableRows(t, w, snapshotID, `id, value`); len(snapshot) != 1 {
+		t.Errorf("expected the snapshot to have the rows from before the rewrite, got %v", snapshot)
+	}
+}
+
+func TestDeduplicateTable(t *testing.T) {
+	w := newSQLiteWarehouse(t)
+	sch := testSchema(
+		avro.Field{Name: "id", FieldType: []string{"long", "null"}},
+		avro.Field{Name: "name", FieldType: []string{"string", "null"}},
+	)
+	if err := w.PrepareTable("dataset", "events", sch, backend.TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	row := map[string]interface{}{"id": int64(1), "name": "first"}
+	if err := w.InsertRows("dataset", "events", []map[string]interface{}{row, row, {"id": int64(2), "name": "second"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.DeduplicateTable("project", "dataset", "events", nil); err != nil {
+		t.Fatal(err)
+	}
+	if rows := tableRows(t, w, "events", `id, name`); len(rows) != 2 {
+		t.Errorf("expected 2 rows after deduplicating, got %v", rows)
+	}
+}
+
+func TestAppendTables(t *testing.T) {
+	w := newSQLiteWarehouse(t)
+	sch := testSchema(
+		avro.Field{Name: "id", FieldType: []string{"long", "null"}},
+		avro.Field{Name: "name", FieldType: []string{"string", "null"}},
+	)
+	for _, tableID := range []string{"events", "_jtb_load_events"} {
+		if err := w.PrepareTable("dataset", tableID, sch, backend.TableOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.InsertRows("dataset", "_jtb_load_events", []map[string]interface{}{{"id": int64(1), "name": "first"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A COPY THAT FAILS ROLLS BACK THE ONES BEFORE IT
+	err := w.AppendTables("dataset", []backend.TableCopy{
+		{Source: "_jtb_load_events", Destination: "events"},
+		{Source: "_jtb_load_missing", Destination: "missing"},
+	})
+	if err == nil {
+		t.Fatal("expected appending a table that doesnt exist to fail")
+	}
+	if rows := tableRows(t, w, "events", `id, name`); len(rows) != 0 {
+		t.Errorf("expected the failed append to be rolled back, got %v", rows)
+	}
+
+	if err := w.AppendTables("dataset", []backend.TableCopy{{Source: "_jtb_load_events", Destination: "events"}}); err != nil {
+		t.Fatal(err)
+	}
+	if rows := tableRows(t, w, "events", `id, name`); len(rows) != 1 || rows[0][1] != "first" {
+		t.Errorf("expected the load table rows to be appended, got %v", rows)
+	}
+	if err := w.DropTable("dataset", "_jtb_load_events"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.DropTable("dataset", "_jtb_load_events"); err != nil {
+		t.Errorf("expected dropping a table that doesnt exist not to fail, got %v", err)
+	}
+}
+
+func TestDeduplicateTableOnKeyColumns(t *testing.T) {
+	w := newSQLiteWarehouse(t)
+	sch := testSchema(
+		avro.Field{Name: "id", FieldType: []string{"long", "null"}},
+		avro.Field{Name: "Key", FieldType: []string{"string", "null"}},
+		avro.Field{Name: "_jtb_request_id", FieldType: []string{"string", "null"}},
+	)
+	if err := w.PrepareTable("dataset", "ListMappings", sch, backend.TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err := w.InsertRows("dataset", "ListMappings", []map[string]interface{}{
+		{"id": int64(1), "Key": "tags", "_jtb_request_id": "first"},
+		{"id": int64(1), "Key": "tags", "_jtb_request_id": "second"},
+		{"id": int64(2), "Key": "tags", "_jtb_request_id": "second"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.DeduplicateTable("project", "dataset", "ListMappings", []string{"id", "Key"}); err != nil {
+		t.Fatal(err)
+	}
+	rows := tableRows(t, w, "ListMappings", `id, "Key", "_jtb_request_id"`)
+	if len(rows) != 2 || rows[0][2] == "" || rows[1][2] != "second" {
+		t.Errorf("expected one row for each id and key with its other columns, got %v", rows)
+	}
+}
+
+func TestExecuteQueries(t *testing.T) {
+	w := newSQLiteWarehouse(t)
+	statements := []data.JTBQuery{
+		{SQL: `CREATE TABLE "dataset__summary" (id INTEGER)`},
+		{SQL: `INSERT INTO "missing" VALUES (1)`, ContinueOnError: true},
+		{SQL: `INSERT INTO "dataset__summary" VALUES (1)`},
+	}
+	results, err := w.ExecuteQueries("dataset", "req-1", statements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[1].Error == "" || results[2].Error != "" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	results, err = w.ExecuteQueries("dataset", "req-1", []data.JTBQuery{{SQL: `SELECT * FROM "missing"`}, {SQL: `SELECT 1`}})
+	if err == nil || len(results) != 1 {
+		t.Errorf("expected the queries to stop at the first failure, got %+v", results)
+	}
+}
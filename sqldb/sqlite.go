@@ -0,0 +1,101 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+
+	// REGISTERS THE sqlite3 DRIVER
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite The dialect for SQLite, there are no schemas so each table is named
+// dataset__table
+type SQLite struct{}
+
+var sqliteTypes = map[string]string{
+	"string":           "TEXT",
+	"int":              "INTEGER",
+	"long":             "INTEGER",
+	"float":            "REAL",
+	"double":           "REAL",
+	"boolean":          "BOOLEAN",
+	"timestamp-micros": "TIMESTAMP",
+	"date":             "DATE",
+	"time-micros":      "TIME",
+	"decimal":          "NUMERIC",
+	"uuid":             "TEXT",
+	"json":             "TEXT",
+}
+
+// DriverName The database/sql driver the dialect uses
+func (SQLite) DriverName() string {
+	return "sqlite3"
+}
+
+// ColumnType Returns the column type for an avro type or logical type
+func (SQLite) ColumnType(avroType string) string {
+	if columnType, ok := sqliteTypes[avroType]; ok {
+		return columnType
+	}
+	return "TEXT"
+}
+
+// Placeholder Returns the bind parameter for the nth value
+func (SQLite) Placeholder(n int) string {
+	return "?"
+}
+
+// TableName Returns the quoted name of a table in a dataset
+func (SQLite) TableName(datasetID, tableID string) string {
+	return quote(fmt.Sprintf("%v__%v", datasetID, tableID))
+}
+
+// PrepareDataset Does nothing as SQLite has no schemas
+func (SQLite) PrepareDataset(tx *sql.Tx, datasetID string) error {
+	return nil
+}
+
+// ChangeColumnType Replaces the column with one of the new type, SQLite cant
+// change the type of a column so the values are copied to a new column which
+// then takes the name of the old one
+func (s SQLite) ChangeColumnType(tx *sql.Tx, datasetID, tableID, column, columnType string) error {
+	tableName := s.TableName(datasetID, tableID)
+	temporary := quote(column + "__jtb_migrating")
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", tableName, temporary, columnType),
+		fmt.Sprintf("UPDATE %v SET %v = CAST(%v AS %v)", tableName, temporary, quote(column), columnType),
+		fmt.Sprintf("ALTER TABLE %v DROP COLUMN %v", tableName, quote(column)),
+		fmt.Sprintf("ALTER TABLE %v RENAME COLUMN %v TO %v", tableName, temporary, quote(column)),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Columns Returns the columns of a table and their declared types
+func (s SQLite) Columns(tx *sql.Tx, datasetID, tableID string) (map[string]string, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%v)", s.TableName(datasetID, tableID)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]string)
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = columnType
+	}
+	return columns, rows.Err()
+}